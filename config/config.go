@@ -5,12 +5,16 @@ import (
 )
 
 type Config struct {
-	AppConfig     AppConfig
-	SourceConfig  SourceConfig
-	PulsarConfig  PulsarConfig
-	AlgoliaConfig AlgoliaConfig
-	KafkaConfig   KafkaConfig
-	RedisConfig   RedisConfig
+	AppConfig            AppConfig
+	SourceConfig         SourceConfig
+	PulsarConfig         PulsarConfig
+	AlgoliaConfig        AlgoliaConfig
+	KafkaConfig          KafkaConfig
+	RedisConfig          RedisConfig
+	QueueConfig          QueueConfig
+	ServeConfig          ServeConfig
+	TracingConfig        TracingConfig
+	SchemaRegistryConfig SchemaRegistryConfig
 }
 
 // SourceConfig points at the system of record. Reconcile needs to know which
@@ -24,19 +28,39 @@ type AppConfig struct {
 	APPName string `default:"algolia-sync" env:"APP_NAME"`
 	Port    int    `env:"PORT" default:"3000"`
 	Version string `default:"x.x.x"`
+	// ShutdownTimeout is how many seconds a consumer told to stop gives the
+	// messages it already received to finish before abandoning them.
+	ShutdownTimeout int `default:"30" env:"SHUTDOWN_TIMEOUT"`
 }
 
 type PulsarConfig struct {
 	URL              string `default:"pulsar://localhost:6650" env:"PULSARURL"`
 	Topic            string `default:"public/default/myanimelist.public.anime" env:"PULSARTOPIC"`
 	SubscribtionName string `default:"my-sub" env:"PULSARSUBSCRIPTIONNAME"`
+	// Format is how messages on Topic are encoded: "payload", the
+	// {action, data} object, or "debezium", a Debezium change event with or
+	// without its schema, as the postgres source connector writes them.
+	Format string `default:"payload" env:"PULSAR_FORMAT"`
+	// Encoding is "json" or "avro", Confluent's wire format with the schema
+	// looked up in SchemaRegistryConfig, for either Format.
+	Encoding string `default:"json" env:"PULSAR_ENCODING"`
 }
 
 type AlgoliaConfig struct {
-	AppID        string `default:"" env:"ALGOLIA_APP_ID"`
-	APIKey       string `default:"" env:"ALGOLIA_API_KEY"`
-	Index        string `default:"" env:"ALGOLIA_INDEX"`
-	FlushTimeout int    `default:"10" env:"ALGOLIA_FLUSH_TIMEOUT"`
+	AppID  string `default:"" env:"ALGOLIA_APP_ID"`
+	APIKey string `default:"" env:"ALGOLIA_API_KEY"`
+	Index  string `default:"" env:"ALGOLIA_INDEX"`
+	// FlushTimeout is the longest, in seconds, a pending record waits before
+	// the consumers send it.
+	FlushTimeout int `default:"10" env:"ALGOLIA_FLUSH_TIMEOUT"`
+	BatchSize    int `default:"1000" env:"ALGOLIA_BATCH_SIZE"`
+	// BatchMaxBytes keeps each request under Algolia's payload limit, with
+	// headroom for the envelope around the records.
+	BatchMaxBytes int `default:"8000000" env:"ALGOLIA_BATCH_MAX_BYTES"`
+	// WaitForTasks makes the sync job hold its claimed batch until Algolia
+	// reports every write published, for at most TaskWaitTimeout seconds.
+	WaitForTasks    bool `default:"true" env:"ALGOLIA_WAIT_FOR_TASKS"`
+	TaskWaitTimeout int  `default:"300" env:"ALGOLIA_TASK_WAIT_TIMEOUT"`
 }
 
 type KafkaConfig struct {
@@ -45,13 +69,196 @@ type KafkaConfig struct {
 	Topic             string `default:"algolia-sync" env:"KAFKA_TOPIC"`
 	Offset            string `default:"earliest" env:"KAFKA_OFFSET"`
 	Debug             string `default:"" env:"KAFKA_DEBUG"`
+	// Mode is "buffered", which writes each message to the queue for the
+	// sync job to send on, or "streaming", which sends it to Algolia from the
+	// consumer and commits it only once Algolia has it. Streaming skips the
+	// wait for the next sync; buffered keeps consuming while Algolia is down.
+	Mode string `default:"buffered" env:"KAFKA_MODE"`
+	// Encoding is "json" or "avro", Confluent's wire format with the schema
+	// looked up in SchemaRegistryConfig.
+	Encoding string `default:"json" env:"KAFKA_ENCODING"`
+	// Consumers is how many group members one process runs. Each handles its
+	// partitions a message at a time, so this is what lets writes to Redis
+	// overlap and share pipelines.
+	Consumers int `default:"1" env:"KAFKA_CONSUMERS"`
+	// SecurityProtocol is "plaintext", "ssl", "sasl_plaintext" or
+	// "sasl_ssl". Empty leaves it to librdkafka, which means plaintext.
+	SecurityProtocol string `default:"" env:"KAFKA_SECURITY_PROTOCOL"`
+	// SaslMechanism is "PLAIN", "SCRAM-SHA-256" or "SCRAM-SHA-512", and
+	// needs a sasl_ protocol, Username and Password.
+	SaslMechanism string `default:"" env:"KAFKA_SASL_MECHANISM"`
+	Username      string `default:"" env:"KAFKA_SASL_USERNAME"`
+	Password      string `default:"" env:"KAFKA_SASL_PASSWORD"`
+	// SSLCAFile verifies the brokers against a private CA; without it the
+	// system's CAs are used. SSLCertFile and SSLKeyFile present a client
+	// certificate, and SSLKeyPassword unlocks an encrypted key. All are PEM
+	// paths and need an ssl protocol.
+	SSLCAFile      string `default:"" env:"KAFKA_SSL_CA_FILE"`
+	SSLCertFile    string `default:"" env:"KAFKA_SSL_CERT_FILE"`
+	SSLKeyFile     string `default:"" env:"KAFKA_SSL_KEY_FILE"`
+	SSLKeyPassword string `default:"" env:"KAFKA_SSL_KEY_PASSWORD"`
+	// SessionTimeoutMs is how long the group waits to hear from a consumer
+	// before giving its partitions to another. Zero keeps librdkafka's
+	// default.
+	SessionTimeoutMs int `default:"0" env:"KAFKA_SESSION_TIMEOUT_MS"`
+	// ClientID names the process in broker logs and quotas. Empty keeps
+	// librdkafka's default.
+	ClientID string `default:"" env:"KAFKA_CLIENT_ID"`
+	// MaxRetries is how many more times a message that failed is tried, by
+	// way of RetryTopic, before it goes to DeadLetterTopic. Each retry waits
+	// RetryBackoffMs, doubling per retry up to RetryBackoffMaxMs.
+	MaxRetries        int `default:"3" env:"KAFKA_MAX_RETRIES"`
+	RetryBackoffMs    int `default:"500" env:"KAFKA_RETRY_BACKOFF_MS"`
+	RetryBackoffMaxMs int `default:"30000" env:"KAFKA_RETRY_BACKOFF_MAX_MS"`
+	// RetryTopic and DeadLetterTopic default to Topic with "-retry" and
+	// "-dlq" appended. The consumers read RetryTopic as well as Topic;
+	// nothing reads DeadLetterTopic but replay-dlq.
+	RetryTopic      string `default:"" env:"KAFKA_RETRY_TOPIC"`
+	DeadLetterTopic string `default:"" env:"KAFKA_DEAD_LETTER_TOPIC"`
+	// Overrides sets any other librdkafka property, as key=value pairs
+	// separated by semicolons, since librdkafka's own lists use commas. They
+	// are applied last, so they win over every field above.
+	Overrides string `default:"" env:"KAFKA_OVERRIDES"`
 }
 
 type RedisConfig struct {
+	// Topology is "single", which connects to URL, "sentinel", which asks
+	// SentinelAddrs where SentinelMaster currently is, or "cluster", which
+	// discovers the cluster from ClusterAddrs.
+	Topology string `default:"single" env:"REDIS_TOPOLOGY"`
 	URL      string `default:"redis://localhost:6379" env:"REDIS_URL"`
+	Username string `default:"" env:"REDIS_USERNAME"`
 	Password string `default:"" env:"REDIS_PASSWORD"`
-	DB       int    `default:"0" env:"REDIS_DB"`
-	Key      string `default:"algolia-sync:data" env:"REDIS_KEY"`
+	// DB is ignored by a cluster, which only has database 0.
+	DB int `default:"0" env:"REDIS_DB"`
+	// Key names the queue; every other key the service uses is derived from
+	// it. In a cluster it is wrapped in a hash tag, {Key}, unless it already
+	// has one, so the derived keys share its slot and RENAME and the scripts
+	// can work across them.
+	Key string `default:"algolia-sync:data" env:"REDIS_KEY"`
+	// SentinelAddrs and ClusterAddrs are comma-separated host:port lists.
+	SentinelMaster   string `default:"" env:"REDIS_SENTINEL_MASTER"`
+	SentinelAddrs    string `default:"" env:"REDIS_SENTINEL_ADDRS"`
+	SentinelPassword string `default:"" env:"REDIS_SENTINEL_PASSWORD"`
+	ClusterAddrs     string `default:"" env:"REDIS_CLUSTER_ADDRS"`
+	// TLS turns TLS on for any topology; a rediss:// URL does the same for
+	// "single". TLSCAFile adds a private CA to the system pool, and
+	// TLSCertFile and TLSKeyFile present a client certificate.
+	TLS                   bool   `default:"false" env:"REDIS_TLS"`
+	TLSCAFile             string `default:"" env:"REDIS_TLS_CA_FILE"`
+	TLSCertFile           string `default:"" env:"REDIS_TLS_CERT_FILE"`
+	TLSKeyFile            string `default:"" env:"REDIS_TLS_KEY_FILE"`
+	TLSServerName         string `default:"" env:"REDIS_TLS_SERVER_NAME"`
+	TLSInsecureSkipVerify bool   `default:"false" env:"REDIS_TLS_INSECURE_SKIP_VERIFY"`
+	// DialTimeout, ReadTimeout and WriteTimeout are in milliseconds. Zero
+	// keeps the client's defaults.
+	DialTimeout  int `default:"0" env:"REDIS_DIAL_TIMEOUT"`
+	ReadTimeout  int `default:"0" env:"REDIS_READ_TIMEOUT"`
+	WriteTimeout int `default:"0" env:"REDIS_WRITE_TIMEOUT"`
+	// QueueMode is "batch", which claims and clears the whole queue at once,
+	// "reliable", which acknowledges each item individually, or "coalesce",
+	// which keeps only the latest pending item per anime and otherwise behaves
+	// like "batch". "stream" uses a Redis stream and consumer group so several
+	// sync workers can share the queue.
+	QueueMode string `default:"batch" env:"REDIS_QUEUE_MODE"`
+	// ClaimSize is how many items a sync takes per round: a claim in the
+	// reliable and stream modes, a page of the claimed batch otherwise.
+	ClaimSize int `default:"1000" env:"REDIS_CLAIM_SIZE"`
+	// MaxAttempts is how often an item may fail to reach Algolia before it is
+	// dead-lettered, in every mode. Zero retries forever.
+	MaxAttempts int `default:"5" env:"REDIS_MAX_ATTEMPTS"`
+	// StreamGroup is the consumer group every stream-mode worker joins.
+	StreamGroup string `default:"algolia-sync" env:"REDIS_STREAM_GROUP"`
+	// StreamConsumer names this worker within the group. Empty uses the host
+	// name and pid, which is unique per run.
+	StreamConsumer string `default:"" env:"REDIS_STREAM_CONSUMER"`
+	// StreamClaimIdle is how many seconds an entry may sit unacknowledged
+	// before another worker takes it over. Zero never reclaims.
+	StreamClaimIdle int `default:"300" env:"REDIS_STREAM_CLAIM_IDLE"`
+	// StreamMaxLen and StreamMaxAge (seconds) trim the stream's history on
+	// write; MaxLen wins if both are set. Trimming does not spare unread
+	// entries, so either must comfortably exceed the worst backlog.
+	StreamMaxLen int64 `default:"0" env:"REDIS_STREAM_MAX_LEN"`
+	StreamMaxAge int   `default:"0" env:"REDIS_STREAM_MAX_AGE"`
+	// WriteBatchSize caps how many of the consumer's writes share one
+	// pipeline. WriteLinger holds a write back up to that many milliseconds
+	// to gather a larger group; zero sends at once whenever no pipeline is in
+	// flight.
+	WriteBatchSize int `default:"500" env:"REDIS_WRITE_BATCH_SIZE"`
+	WriteLinger    int `default:"0" env:"REDIS_WRITE_LINGER"`
+	// Codec is how new entries are encoded: "json", "msgpack" or
+	// "zstd-json". Entries in any of them are read whatever this is set to,
+	// so it can be changed with a queue still full.
+	Codec string `default:"json" env:"REDIS_CODEC"`
+	// LockTTL is how many seconds the sync's lease outlives a run that stops
+	// renewing it. Stream mode shares the queue between workers and takes no
+	// lease.
+	LockTTL int `default:"60" env:"REDIS_LOCK_TTL"`
+	// LockBusy is what a sync does when another run holds the lease: "skip"
+	// exits cleanly, "wait" waits up to LockWaitTimeout seconds for it, and
+	// "fail" exits with an error.
+	LockBusy        string `default:"skip" env:"REDIS_LOCK_BUSY"`
+	LockWaitTimeout int    `default:"300" env:"REDIS_LOCK_WAIT_TIMEOUT"`
+	// Watermarks has the sync record the newest version it has sent for each
+	// anime, and drop items older than that instead of writing them over it.
+	Watermarks bool `default:"true" env:"REDIS_WATERMARKS"`
+	// WatermarkTombstoneTTL is how many seconds the watermark a delete
+	// leaves is kept once nothing newer has replaced it. It has to outlast
+	// any retry of what the delete removed; after it, the anime can be
+	// created again by a message with no version. Zero keeps tombstones
+	// for good.
+	WatermarkTombstoneTTL int `default:"2592000" env:"REDIS_WATERMARK_TOMBSTONE_TTL"`
+	// DedupTTL is how many seconds the consumers remember a queued message,
+	// so a redelivery within that time is acknowledged without being queued
+	// again. Zero turns deduplication off.
+	DedupTTL int `default:"86400" env:"REDIS_DEDUP_TTL"`
+}
+
+// QueueConfig picks where queued items wait between the consumer and the
+// sync. "redis" uses RedisConfig. "file" keeps an append-only log under Dir,
+// which a consumer and a cron sync on the same host can share. "memory" lives
+// and dies with the process, so it only suits a consumer and sync running in
+// one process, and tests.
+type QueueConfig struct {
+	Backend string `default:"redis" env:"QUEUE_BACKEND"`
+	Dir     string `default:"data/queue" env:"QUEUE_DIR"`
+	// FileSync fsyncs every write to the file backend. Turning it off trades
+	// the last few items on a power cut for much cheaper writes.
+	FileSync bool `default:"true" env:"QUEUE_FILE_SYNC"`
+}
+
+// ServeConfig picks what the serve command runs in its one process, alongside
+// the HTTP listener on AppConfig.Port.
+type ServeConfig struct {
+	// Sources is a comma-separated list of event sources to consume, from
+	// "pulsar" and "kafka". "none" consumes nothing, for a process that only
+	// syncs.
+	Sources string `default:"kafka" env:"SERVE_SOURCES"`
+	// SyncInterval runs the Redis to Algolia sync every that many seconds in
+	// process, in place of the cron job. Zero leaves it to the cron job.
+	SyncInterval int `default:"0" env:"SERVE_SYNC_INTERVAL"`
+}
+
+// SchemaRegistryConfig is where the schemas of Avro-encoded messages are
+// looked up. Each is fetched once per process, by the id the message carries,
+// as a registered schema never changes.
+type SchemaRegistryConfig struct {
+	URL      string `default:"" env:"SCHEMA_REGISTRY_URL"`
+	Username string `default:"" env:"SCHEMA_REGISTRY_USERNAME"`
+	Password string `default:"" env:"SCHEMA_REGISTRY_PASSWORD"`
+	// Timeout is how many milliseconds a lookup may take.
+	Timeout int `default:"10000" env:"SCHEMA_REGISTRY_TIMEOUT"`
+}
+
+// TracingConfig sends spans to an OpenTelemetry collector over OTLP/HTTP.
+type TracingConfig struct {
+	// Endpoint is the collector's base URL, such as
+	// http://otel-collector:4318; spans go to its /v1/traces. Empty records
+	// no spans, though trace context is still passed through the queue.
+	Endpoint string `default:"" env:"TRACING_ENDPOINT"`
+	// SampleRatio is the share of traces begun here that are recorded. A
+	// message that arrives with a trace keeps its producer's decision.
+	SampleRatio float64 `default:"1" env:"TRACING_SAMPLE_RATIO"`
 }
 
 func LoadConfigOrPanic() Config {
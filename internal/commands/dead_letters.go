@@ -0,0 +1,139 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
+)
+
+var (
+	deadLettersLimit int64
+	deadLettersAll   bool
+)
+
+// deadLettersCmd groups the tools for entries taken out of the queue: ones that
+// could not be decoded, and ones Algolia refused too many times.
+var deadLettersCmd = &cobra.Command{
+	Use:   "dead-letters",
+	Short: "List, inspect, requeue and purge dead-lettered queue entries",
+}
+
+var deadLettersListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Show dead-lettered entries, newest first",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, dlq := deadLetterQueue()
+		letters, err := dlq.List(ctx, deadLettersLimit)
+		if err != nil {
+			return err
+		}
+		if len(letters) == 0 {
+			fmt.Println("No dead letters")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tDEAD AT\tREASON\tATTEMPTS\tERROR")
+		for _, l := range letters {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n",
+				l.ID, time.Unix(l.DeadAt, 0).UTC().Format(time.RFC3339), l.Reason, l.Attempts, truncate(l.Error, 80))
+		}
+		return w.Flush()
+	},
+}
+
+var deadLettersInspectCmd = &cobra.Command{
+	Use:   "inspect <id>",
+	Short: "Print one dead-lettered entry in full",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, dlq := deadLetterQueue()
+		letter, err := dlq.Get(ctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		// Raw is shown decoded when it is an entry in any of the codecs'
+		// formats, which is the common case and far easier to read than an
+		// escaped string.
+		out := struct {
+			redis.DeadLetter
+			Raw any `json:"raw"`
+		}{DeadLetter: *letter, Raw: letter.Raw}
+		var decoded any
+		if redis.DecodeEntry(letter.Raw, &decoded) == nil {
+			out.Raw = decoded
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	},
+}
+
+var deadLettersRequeueCmd = &cobra.Command{
+	Use:   "requeue [id...]",
+	Short: "Put dead-lettered entries back on the queue",
+	Long: `Moves the given entries back onto the queue with a fresh attempt count, to
+be picked up by the next sync. Pass --all to requeue everything.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 && !deadLettersAll {
+			return fmt.Errorf("pass one or more ids, or --all")
+		}
+		ctx, dlq := deadLetterQueue()
+		n, err := dlq.Requeue(ctx, args...)
+		fmt.Printf("Requeued %d entries\n", n)
+		return err
+	},
+}
+
+var deadLettersPurgeCmd = &cobra.Command{
+	Use:   "purge [id...]",
+	Short: "Delete dead-lettered entries for good",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 && !deadLettersAll {
+			return fmt.Errorf("pass one or more ids, or --all")
+		}
+		ctx, dlq := deadLetterQueue()
+		n, err := dlq.Purge(ctx, args...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Purged %d entries\n", n)
+		return nil
+	},
+}
+
+func deadLetterQueue() (context.Context, redis.DeadLetterQueue) {
+	cfg := config.LoadConfigOrPanic()
+	ctx := logger.WithCtx(context.Background(), logger.Get())
+	return ctx, redis.NewDeadLetterQueue[redis_processor.QueuedItem](ctx, cfg.RedisConfig)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+func init() {
+	deadLettersListCmd.Flags().Int64Var(&deadLettersLimit, "limit", 50,
+		"show at most this many entries; 0 shows all")
+	deadLettersRequeueCmd.Flags().BoolVar(&deadLettersAll, "all", false,
+		"requeue every dead-lettered entry")
+	deadLettersPurgeCmd.Flags().BoolVar(&deadLettersAll, "all", false,
+		"purge every dead-lettered entry")
+
+	deadLettersCmd.AddCommand(deadLettersListCmd, deadLettersInspectCmd, deadLettersRequeueCmd, deadLettersPurgeCmd)
+	rootCmd.AddCommand(deadLettersCmd)
+}
@@ -0,0 +1,308 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
+)
+
+var (
+	queueList  string
+	queueLimit int
+	queueID    string
+)
+
+// queueCmd groups the tools for looking at and repairing the queue between
+// the consumer and the sync, without reaching for redis-cli.
+var queueCmd = &cobra.Command{
+	Use:   "queue",
+	Short: "Inspect and repair the Redis queue",
+}
+
+// listStats summarises one list.
+type listStats struct {
+	depth       int64
+	oldest      int64
+	actions     map[string]int
+	undecodable int
+}
+
+var queueStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show depth, oldest item and action breakdown for each list",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, queue, err := queueInspector()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "LIST\tDEPTH\tOLDEST\tACTIONS\tUNDECODABLE")
+		var claimed int64
+		for _, list := range redis.QueueLists {
+			stats := listStats{actions: map[string]int{}}
+			err := queue.Scan(ctx, list, func(e redis.QueueEntry[redis_processor.QueuedItem]) bool {
+				stats.depth++
+				if e.Err != nil {
+					stats.undecodable++
+					return true
+				}
+				stats.actions[e.Data.Action]++
+				if e.Data.Timestamp > 0 && (stats.oldest == 0 || e.Data.Timestamp < stats.oldest) {
+					stats.oldest = e.Data.Timestamp
+				}
+				return true
+			})
+			if err != nil {
+				return err
+			}
+			if list == redis.ClaimedList {
+				claimed = stats.depth
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%d\n",
+				list, stats.depth, age(stats.oldest), formatActions(stats.actions), stats.undecodable)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if claimed > 0 {
+			fmt.Printf("\nA claimed batch of %d items exists. Either a sync is running, or one died\n"+
+				"and the next run will recover it; see `queue requeue-claimed`.\n", claimed)
+		}
+		return nil
+	},
+}
+
+var queuePeekCmd = &cobra.Command{
+	Use:   "peek",
+	Short: "Show the oldest items on a list",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, queue, err := queueInspector()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "POS\tACTION\tID\tQUEUED\tTITLE")
+		shown := 0
+		err = queue.Scan(ctx, queueList, func(e redis.QueueEntry[redis_processor.QueuedItem]) bool {
+			if queueLimit > 0 && shown >= queueLimit {
+				return false
+			}
+			shown++
+			printEntry(w, e)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if shown == 0 {
+			fmt.Printf("The %s list is empty\n", queueList)
+			return nil
+		}
+		return w.Flush()
+	},
+}
+
+var queueFindCmd = &cobra.Command{
+	Use:   "find",
+	Short: "Find every queued item for an anime",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, queue, err := queueInspector()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "LIST\tPOS\tACTION\tID\tQUEUED\tTITLE")
+		found := 0
+		for _, list := range redis.QueueLists {
+			err := queue.Scan(ctx, list, func(e redis.QueueEntry[redis_processor.QueuedItem]) bool {
+				if e.Err == nil && e.Data.Data.Id == queueID {
+					found++
+					fmt.Fprintf(w, "%s\t", list)
+					printEntry(w, e)
+				}
+				return true
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if found == 0 {
+			fmt.Printf("Nothing queued for %s\n", queueID)
+			return nil
+		}
+		return w.Flush()
+	},
+}
+
+var queueDropCmd = &cobra.Command{
+	Use:   "drop",
+	Short: "Remove every queued item for an anime from a list",
+	Long: `Removes the items for the given id from one list, the live queue unless
+--list says otherwise. Dropping from the claimed or processing list takes the
+sync lock, and is refused while a sync is running.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, queue, err := queueInspector()
+		if err != nil {
+			return err
+		}
+		ctx, release, err := leaseClaimed(ctx, queueList)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		var raws []string
+		err = queue.Scan(ctx, queueList, func(e redis.QueueEntry[redis_processor.QueuedItem]) bool {
+			if e.Err == nil && e.Data.Data.Id == queueID {
+				raws = append(raws, e.Raw)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		n, err := queue.Drop(ctx, queueList, raws...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Dropped %d items from the %s list\n", n, queueList)
+		return nil
+	},
+}
+
+var queueRequeueClaimedCmd = &cobra.Command{
+	Use:   "requeue-claimed",
+	Short: "Move an orphaned claimed batch back onto the live queue",
+	Long: `Moves the claimed batch back onto the live queue ahead of anything queued
+since. The next sync recovers an orphaned batch by itself; this is for when
+that batch has to be inspected or trimmed together with the live queue. It
+takes the sync lock, and is refused while a sync is running.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, queue, err := queueInspector()
+		if err != nil {
+			return err
+		}
+		ctx, release, err := leaseClaimed(ctx, redis.ClaimedList)
+		if err != nil {
+			return err
+		}
+		defer release()
+		n, err := queue.RequeueClaimed(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Requeued %d items\n", n)
+		return nil
+	},
+}
+
+var queueForgetWatermarkCmd = &cobra.Command{
+	Use:   "forget-watermark",
+	Short: "Let the next item for an anime through whatever its version",
+	Long: `Removes the watermark the sync keeps for the given id. A deleted anime
+leaves a tombstone that keeps anything no newer than the delete out, including
+a create with no version, until REDIS_WATERMARK_TOMBSTONE_TTL has passed. To
+create it again sooner, forget its watermark first, then send the create.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg := config.LoadConfigOrPanic()
+		ctx := logger.WithCtx(context.Background(), logger.Get())
+		if err := redis.NewWatermarks(ctx, cfg.RedisConfig).Forget(ctx, queueID); err != nil {
+			return err
+		}
+		fmt.Printf("Forgot the watermark of %s\n", queueID)
+		return nil
+	},
+}
+
+func queueInspector() (context.Context, redis.QueueInspector[redis_processor.QueuedItem], error) {
+	cfg := config.LoadConfigOrPanic()
+	ctx := logger.WithCtx(context.Background(), logger.Get())
+	queue, err := redis.NewQueueInspector[redis_processor.QueuedItem](ctx, cfg.RedisConfig)
+	return ctx, queue, err
+}
+
+// leaseClaimed takes the sync lock before a change to list, unless it is the
+// live queue, which no sync claims. Under the lease the change cannot land in
+// the middle of a running sync; while one holds the lock, it is refused with
+// who holds it.
+func leaseClaimed(ctx context.Context, list string) (context.Context, func(), error) {
+	if list == redis.LiveList {
+		return ctx, func() {}, nil
+	}
+	cfg := config.LoadConfigOrPanic()
+	lease, err := redis.NewLocker(ctx, cfg.RedisConfig).Acquire(ctx, 0)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("not changing the %s list while a sync may be working it: %w", list, err)
+	}
+	return redis.WithLease(ctx, lease), func() { _ = lease.Release(ctx) }, nil
+}
+
+func printEntry(w *tabwriter.Writer, e redis.QueueEntry[redis_processor.QueuedItem]) {
+	if e.Err != nil {
+		fmt.Fprintf(w, "%d\t-\t-\t-\tundecodable: %s\n", e.Position, truncate(e.Raw, 60))
+		return
+	}
+	title := ""
+	if e.Data.Data.TitleEn != nil {
+		title = truncate(*e.Data.Data.TitleEn, 40)
+	}
+	fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n",
+		e.Position, e.Data.Action, e.Data.Data.Id, age(e.Data.Timestamp), title)
+}
+
+// age renders a queue timestamp, in unix seconds, as how long ago it was.
+func age(ts int64) string {
+	if ts <= 0 {
+		return "-"
+	}
+	return time.Since(time.Unix(ts, 0)).Truncate(time.Second).String() + " ago"
+}
+
+func formatActions(actions map[string]int) string {
+	if len(actions) == 0 {
+		return "-"
+	}
+	names := make([]string, 0, len(actions))
+	for name := range actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := ""
+	for i, name := range names {
+		if i > 0 {
+			out += " "
+		}
+		out += fmt.Sprintf("%s=%d", name, actions[name])
+	}
+	return out
+}
+
+func init() {
+	for _, c := range []*cobra.Command{queuePeekCmd, queueDropCmd} {
+		c.Flags().StringVar(&queueList, "list", redis.LiveList,
+			"list to read: live, claimed or processing")
+	}
+	queuePeekCmd.Flags().IntVar(&queueLimit, "limit", 10,
+		"show at most this many items; 0 shows all")
+	for _, c := range []*cobra.Command{queueFindCmd, queueDropCmd, queueForgetWatermarkCmd} {
+		c.Flags().StringVar(&queueID, "id", "", "anime id")
+		_ = c.MarkFlagRequired("id")
+	}
+
+	queueCmd.AddCommand(queueStatsCmd, queuePeekCmd, queueFindCmd, queueDropCmd, queueRequeueClaimedCmd, queueForgetWatermarkCmd)
+	rootCmd.AddCommand(queueCmd)
+}
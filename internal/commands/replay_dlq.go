@@ -0,0 +1,40 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/eventing"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+)
+
+var replayDLQLimit int
+
+var replayDLQCmd = &cobra.Command{
+	Use:   "replay-dlq",
+	Short: "Republish dead-lettered Kafka messages to the main topic",
+	Long: `Copies the messages on KAFKA_DEAD_LETTER_TOPIC back to KAFKA_TOPIC, without
+their retry count and dead-letter headers, for the consumers to try again once
+whatever failed them is fixed. Only messages already dead-lettered when it
+starts are replayed; progress is committed as it goes, so running it again
+after an interruption carries on rather than starting over.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg := config.LoadConfigOrPanic()
+		ctx, stop := signal.NotifyContext(logger.WithCtx(context.Background(), logger.Get()), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		n, err := eventing.ReplayDeadLetters(ctx, cfg.KafkaConfig, replayDLQLimit)
+		fmt.Printf("Replayed %d messages from %s to %s\n", n, eventing.DeadLetterTopic(cfg.KafkaConfig), cfg.KafkaConfig.Topic)
+		return err
+	},
+}
+
+func init() {
+	replayDLQCmd.Flags().IntVar(&replayDLQLimit, "limit", 0,
+		"replay at most this many messages; 0 replays all")
+	rootCmd.AddCommand(replayDLQCmd)
+}
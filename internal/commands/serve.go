@@ -0,0 +1,179 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/eventing"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"github.com/weeb-vip/algolia-sync/internal/metrics"
+	"github.com/weeb-vip/algolia-sync/internal/server"
+	"github.com/weeb-vip/algolia-sync/internal/services/algolia"
+	"github.com/weeb-vip/algolia-sync/internal/services/queue"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
+	"github.com/weeb-vip/algolia-sync/internal/tracing"
+	"go.uber.org/zap"
+)
+
+// Event sources selectable through ServeConfig.Sources.
+const (
+	pulsarSource = "pulsar"
+	kafkaSource  = "kafka"
+	noSource     = "none"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run the configured consumers, sync loop and HTTP listener",
+	Long: `Runs everything the configuration asks for in one process: a consumer for
+each of SERVE_SOURCES, the Redis to Algolia sync every SERVE_SYNC_INTERVAL
+seconds if set, and an HTTP listener on PORT. SIGINT or SIGTERM stops them
+together, letting work in progress finish first.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg := config.LoadConfigOrPanic()
+		ctx := logger.WithCtx(context.Background(), logger.Get())
+		return serve(ctx, cfg)
+	},
+}
+
+func serve(ctx context.Context, cfg config.Config) error {
+	sources, err := serveSources(cfg.ServeConfig.Sources)
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 && cfg.ServeConfig.SyncInterval <= 0 {
+		return fmt.Errorf("nothing to serve: no sources and no sync interval")
+	}
+
+	shutdownTracing, err := tracing.Setup(ctx, cfg.AppConfig, cfg.TracingConfig)
+	if err != nil {
+		return err
+	}
+
+	lifecycle := eventing.NewLifecycle(ctx, time.Duration(cfg.AppConfig.ShutdownTimeout)*time.Second)
+	// Registered first, so closed last: every other step may still use them.
+	lifecycle.OnShutdown("tracing", func() error {
+		return flushTraces(ctx, shutdownTracing)
+	})
+	lifecycle.OnShutdown("redis", redis.CloseClients)
+
+	return lifecycle.Finish(ctx, startServing(ctx, cfg, lifecycle, sources))
+}
+
+func startServing(ctx context.Context, cfg config.Config, lifecycle *eventing.Lifecycle, sources []string) error {
+	// The listener is stopped after everything else, so it answers for the
+	// whole drain; readiness fails from its start.
+	httpServer := server.New(cfg.AppConfig)
+	httpServer.AddCheck("lifecycle", func(ctx context.Context) error {
+		if lifecycle.Context().Err() != nil {
+			return fmt.Errorf("shutting down")
+		}
+		return nil
+	})
+	if err := httpServer.Start(ctx, func(err error) { lifecycle.Fail("http", err) }); err != nil {
+		return err
+	}
+	lifecycle.OnShutdown("http", func() error {
+		shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		return httpServer.Shutdown(shutdownCtx)
+	})
+
+	for _, source := range sources {
+		var err error
+		switch source {
+		case pulsarSource:
+			err = eventing.StartPulsar(ctx, cfg, lifecycle, httpServer)
+		case kafkaSource:
+			err = eventing.StartKafka(ctx, cfg, lifecycle, httpServer)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if backend := cfg.QueueConfig.Backend; backend == "" || backend == queue.RedisBackend {
+		httpServer.AddCheck("redis", redis.PingClients)
+		service := redis.NewRedisService[redis_processor.QueuedItem](ctx, cfg.RedisConfig)
+		if depth, ok := service.(redis.DepthReader); ok {
+			if err := metrics.WatchQueueDepth(cfg.RedisConfig.Key, depth.Depth); err != nil {
+				return err
+			}
+		}
+	}
+
+	if cfg.ServeConfig.SyncInterval > 0 {
+		// The buffered consumers stay useful without Algolia; a streaming
+		// Kafka consumer adds this check itself.
+		httpServer.AddCheck("algolia", algolia.Reachable(cfg.AlgoliaConfig))
+		interval := time.Duration(cfg.ServeConfig.SyncInterval) * time.Second
+		lifecycle.Go("sync", func() error {
+			syncEvery(ctx, cfg, lifecycle, interval)
+			return nil
+		})
+	}
+	return nil
+}
+
+// syncEvery runs the sync job until lifecycle stops, starting each run
+// interval after the last one began. A run that fails is logged and retried
+// at the next interval, as a failed cron run is; it does not take the
+// consumers down with it. A run in progress at shutdown is left to finish, as
+// a message being handled is.
+func syncEvery(ctx context.Context, cfg config.Config, lifecycle *eventing.Lifecycle, interval time.Duration) {
+	log := logger.FromCtx(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		runCtx, done := lifecycle.Detach(ctx)
+		if err := runSync(runCtx, cfg); err != nil {
+			log.Error("Sync run failed; retrying at the next interval", zap.Error(err))
+		}
+		done()
+
+		select {
+		case <-lifecycle.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// flushTraces sends the spans still buffered and stops the exporter, giving
+// an unreachable collector a few seconds rather than holding up the exit.
+func flushTraces(ctx context.Context, shutdown func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		logger.FromCtx(ctx).Warn("Failed to export the last spans", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func serveSources(list string) ([]string, error) {
+	var sources []string
+	seen := map[string]bool{}
+	for _, source := range strings.Split(list, ",") {
+		source = strings.ToLower(strings.TrimSpace(source))
+		if source == "" || source == noSource || seen[source] {
+			continue
+		}
+		if source != pulsarSource && source != kafkaSource {
+			return nil, fmt.Errorf("unknown event source %q", source)
+		}
+		seen[source] = true
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+}
@@ -4,8 +4,10 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package commands
 
 import (
+	"context"
 	"github.com/spf13/cobra"
-	"github.com/weeb-vip/algolia-sync/internal/eventing"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
 	"log"
 )
 
@@ -21,7 +23,11 @@ This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		log.Println("Running anime eventing...")
-		return eventing.EventingAlgolia()
+		// serve with this one source and no sync, so the consumer gets the
+		// same shutdown handling and HTTP endpoints.
+		cfg := config.LoadConfigOrPanic()
+		cfg.ServeConfig = config.ServeConfig{Sources: pulsarSource}
+		return serve(logger.WithCtx(context.Background(), logger.Get()), cfg)
 	},
 }
 
@@ -2,13 +2,21 @@ package commands
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/spf13/cobra"
 	"github.com/weeb-vip/algolia-sync/config"
 	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"github.com/weeb-vip/algolia-sync/internal/metrics"
 	"github.com/weeb-vip/algolia-sync/internal/services/algolia"
+	"github.com/weeb-vip/algolia-sync/internal/services/queue"
 	"github.com/weeb-vip/algolia-sync/internal/services/redis"
 	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
+	"github.com/weeb-vip/algolia-sync/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"time"
 )
 
 // syncRedisToAlgoliaCmd represents the sync command that reads from Redis and sends to Algolia
@@ -19,98 +27,559 @@ var syncRedisToAlgoliaCmd = &cobra.Command{
 and then clears the Redis queue. It's designed to be run as a cron job.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cfg := config.LoadConfigOrPanic()
-		ctx := context.Background()
-		log := logger.Get()
-		ctx = logger.WithCtx(ctx, log)
+		ctx := logger.WithCtx(context.Background(), logger.Get())
+		shutdownTracing, err := tracing.Setup(ctx, cfg.AppConfig, cfg.TracingConfig)
+		if err != nil {
+			return err
+		}
+		defer flushTraces(ctx, shutdownTracing)
+		return runSync(ctx, cfg)
+	},
+}
+
+// runSync is one sync job: it sends what the queue holds to Algolia and
+// clears what made it.
+func runSync(ctx context.Context, cfg config.Config) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	log := logger.FromCtx(ctx)
 
-		log.Info("Starting Redis to Algolia sync job")
+	ctx, span := tracing.Tracer().Start(ctx, "sync run",
+		trace.WithAttributes(attribute.String("queue.mode", cfg.RedisConfig.QueueMode)))
+	defer func() { tracing.End(span, err) }()
 
-		// Initialize Redis service
-		redisService := redis.NewRedisService[redis_processor.QueuedItem](ctx, cfg.RedisConfig)
+	log.Info("Starting Redis to Algolia sync job")
 
-		// Initialize Algolia service - using AlgoliaSchema for proper array fields
-		algoliaService := algolia.NewAlgoliaServiceWithoutTimer[redis_processor.AnimeDocument](ctx, cfg.AlgoliaConfig)
+	// Initialize Algolia service - using AlgoliaSchema for proper array fields
+	algoliaService := algolia.NewAlgoliaServiceWithoutTimer[redis_processor.AnimeDocument](ctx, cfg.AlgoliaConfig)
 
-		// Get all data from Redis
-		queuedItems, err := redisService.GetAllData(ctx)
+	// The reliable and stream modes, paging, the lease and the watermarks
+	// are Redis features; other backends claim and clear their whole queue.
+	if backend := cfg.QueueConfig.Backend; backend != "" && backend != queue.RedisBackend {
+		itemQueue, err := queue.New[redis_processor.QueuedItem](ctx, cfg)
 		if err != nil {
-			log.Error("Failed to get data from Redis", zap.Error(err))
 			return err
 		}
+		if _, err := syncClaimedBatch(ctx, cfg, algoliaService, itemQueue, nil); err != nil {
+			return err
+		}
+		log.Info("Redis to Algolia sync job completed successfully")
+		return nil
+	}
 
-		if len(queuedItems) == 0 {
-			log.Info("No data to sync from Redis to Algolia")
-			return nil
+	// A claim of nothing would end the run at once, with the queue untouched
+	// and the run reported a success.
+	if cfg.RedisConfig.ClaimSize <= 0 {
+		return fmt.Errorf("claim size must be positive, not %d", cfg.RedisConfig.ClaimSize)
+	}
+
+	if cfg.RedisConfig.QueueMode != redis.StreamQueueMode {
+		lease, err := acquireSyncLease(ctx, cfg.RedisConfig)
+		if err != nil || lease == nil {
+			return err
+		}
+		defer lease.Release(context.WithoutCancel(ctx))
+		// Every change to the claimed batch made under ctx now applies only
+		// while the lease is held.
+		ctx = redis.WithLease(ctx, lease)
+		// Past this point another run may be working the same batch;
+		// stop rather than race it.
+		go func() {
+			select {
+			case <-lease.Lost():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	var watermarks *redis.Watermarks
+	if cfg.RedisConfig.Watermarks {
+		watermarks = redis.NewWatermarks(ctx, cfg.RedisConfig)
+	}
+
+	if cfg.RedisConfig.QueueMode == redis.ReliableQueueMode {
+		return syncReliableQueue(ctx, cfg, algoliaService, watermarks)
+	}
+
+	// Initialize Redis service
+	redisService := redis.NewRedisService[redis_processor.QueuedItem](ctx, cfg.RedisConfig)
+
+	if paged, ok := redisService.(redis.PagedQueue[redis_processor.QueuedItem]); ok {
+		if err := syncClaimedPages(ctx, cfg, algoliaService, paged, watermarks); err != nil {
+			return err
 		}
+		log.Info("Redis to Algolia sync job completed successfully")
+		return nil
+	}
 
-		log.Info("Processing queued items", zap.Int("count", len(queuedItems)))
-
-		// Process each item
-		successCount := 0
-		failCount := 0
-
-		for _, item := range queuedItems {
-			switch item.Action {
-			case redis_processor.CreateAction, redis_processor.UpdateAction:
-				doc := item.Data.ToDocument()
-				_, err := algoliaService.AddToIndex(ctx, doc)
-				if err != nil {
-					log.Error("Failed to add item to Algolia",
-						zap.Error(err),
-						zap.String("action", string(item.Action)),
-						zap.String("objectId", doc.ObjectID))
-					failCount++
-					continue
-				}
-				successCount++
-			case redis_processor.DeleteAction:
-				// Previously a TODO that logged a warning and moved on, which is
-				// why the index accumulated ~2,860 records whose anime no longer
-				// exists -- every one of them a search result leading to a 404.
-				if err := algoliaService.DeleteFromIndex(ctx, item.Data.Id); err != nil {
-					log.Error("Failed to delete item from Algolia",
-						zap.Error(err), zap.String("objectId", item.Data.Id))
-					failCount++
-					continue
-				}
-				successCount++
-			default:
-				log.Warn("Unknown action type",
-					zap.String("action", string(item.Action)),
-					zap.String("objectId", item.Data.Id))
-				failCount++
+	for {
+		synced, err := syncClaimedBatch(ctx, cfg, algoliaService, redisService, watermarks)
+		if err != nil {
+			return err
+		}
+		// A stream hands out ClaimSize entries at a time, so keep going
+		// until it is drained.
+		if drained, ok := redisService.(redis.DrainedQueue); ok {
+			if drained.Drained() {
+				break
 			}
+			continue
 		}
+		if synced == 0 {
+			break
+		}
+	}
 
-		// Flush any remaining data to Algolia
-		_, err = algoliaService.Flush(ctx)
+	log.Info("Redis to Algolia sync job completed successfully")
+	return nil
+}
+
+// acquireSyncLease takes the lease that keeps overlapping runs off the same
+// claimed batch. It returns no lease and no error when the run should skip.
+func acquireSyncLease(ctx context.Context, redisCfg config.RedisConfig) (*redis.Lease, error) {
+	var wait time.Duration
+	switch redisCfg.LockBusy {
+	case redis.SkipWhenLocked, redis.FailWhenLocked:
+	case redis.WaitWhenLocked:
+		wait = time.Duration(redisCfg.LockWaitTimeout) * time.Second
+	default:
+		return nil, fmt.Errorf("unknown lock behaviour %q", redisCfg.LockBusy)
+	}
+
+	lease, err := redis.NewLocker(ctx, redisCfg).Acquire(ctx, wait)
+	if errors.Is(err, redis.ErrLockHeld) && redisCfg.LockBusy == redis.SkipWhenLocked {
+		logger.FromCtx(ctx).Info("Another sync is running; skipping this one", zap.Error(err))
+		return nil, nil
+	}
+	return lease, err
+}
+
+// syncClaimedBatch claims what the queue holds, sends it to Algolia, and
+// clears the claim only if every item made it. It returns how many items it
+// claimed.
+func syncClaimedBatch(
+	ctx context.Context,
+	cfg config.Config,
+	algoliaService algolia.AlgoliaService[redis_processor.AnimeDocument],
+	itemQueue queue.Queue[redis_processor.QueuedItem],
+	watermarks *redis.Watermarks,
+) (int, error) {
+	log := logger.FromCtx(ctx)
+
+	// Get all data from Redis
+	queuedItems, err := itemQueue.GetAllData(ctx)
+	if err != nil {
+		log.Error("Failed to get data from Redis", zap.Error(err))
+		return 0, err
+	}
+
+	if len(queuedItems) == 0 {
+		log.Info("No data to sync from Redis to Algolia")
+		return 0, nil
+	}
+
+	log.Info("Processing queued items", zap.Int("count", len(queuedItems)))
+
+	failed, err := sendItems(ctx, cfg, algoliaService, queuedItems, watermarks)
+	if err != nil {
+		return 0, err
+	}
+
+	// Clear Redis data only if sync was successful
+	if len(failed) == 0 {
+		err = itemQueue.ClearData(ctx)
+		if err != nil {
+			log.Error("Failed to clear Redis data", zap.Error(err))
+			return 0, err
+		}
+		log.Info("Successfully cleared Redis queue")
+	} else {
+		log.Warn("Not clearing Redis queue due to failed syncs", zap.Int("failCount", len(failed)))
+	}
+
+	return len(queuedItems), nil
+}
+
+// syncClaimedPages works the claimed batch a page at a time, so the run holds
+// one page in memory rather than the whole queue. A page leaves the claimed
+// batch only once Algolia has all of it. The first page that does not stops
+// the run: sending later pages would let them overtake its updates, so it and
+// everything after it are left for the next run.
+//
+// Every failure counts an attempt against the item, and an item that has used
+// up RedisConfig.MaxAttempts is dead-lettered, as in the reliable mode. One
+// record Algolia keeps refusing otherwise held the whole claimed batch back on
+// every run; once it is gone, the rest of its page is acknowledged and the run
+// goes on.
+func syncClaimedPages(
+	ctx context.Context,
+	cfg config.Config,
+	algoliaService algolia.AlgoliaService[redis_processor.AnimeDocument],
+	queue redis.PagedQueue[redis_processor.QueuedItem],
+	watermarks *redis.Watermarks,
+) error {
+	log := logger.FromCtx(ctx)
+
+	pages, err := queue.ClaimPages(ctx, cfg.RedisConfig.ClaimSize)
+	if err != nil {
+		log.Error("Failed to get data from Redis", zap.Error(err))
+		return err
+	}
+	if pages == nil {
+		log.Info("No data to sync from Redis to Algolia")
+		return nil
+	}
+
+	synced := 0
+	for {
+		page, err := pages.Next(ctx)
 		if err != nil {
-			log.Error("Failed to flush data to Algolia", zap.Error(err))
 			return err
 		}
+		if len(page) == 0 {
+			break
+		}
 
-		log.Info("Sync processing completed", 
-			zap.Int("successful", successCount),
-			zap.Int("failed", failCount),
-			zap.Int("total", len(queuedItems)))
+		failed, err := sendItems(ctx, cfg, algoliaService, page, watermarks)
+		if len(failed) > 0 {
+			dead, failErr := pages.Fail(ctx, failed)
+			if failErr != nil {
+				return failErr
+			}
+			if err == nil && dead < len(failed) {
+				log.Warn("Not clearing the rest of the claimed batch due to failed syncs",
+					zap.Int("failCount", len(failed)-dead), zap.Int("synced", synced))
+				return nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if err := pages.Ack(ctx); err != nil {
+			return err
+		}
+		synced += len(page)
+	}
+
+	log.Info("Successfully cleared Redis queue", zap.Int("synced", synced))
+	return nil
+}
+
+// sendItems sends items to Algolia and, if configured, waits for Algolia to
+// publish them. Items older than the watermarks are dropped rather than sent.
+// It returns the items that could not be sent, by index, with why; when the
+// flush fails that is every item, and the error says why.
+func sendItems(
+	ctx context.Context,
+	cfg config.Config,
+	algoliaService algolia.AlgoliaService[redis_processor.AnimeDocument],
+	queuedItems []redis_processor.QueuedItem,
+	watermarks *redis.Watermarks,
+) (map[int]error, error) {
+	log := logger.FromCtx(ctx)
 
-		// Clear Redis data only if sync was successful
-		if failCount == 0 {
-			err = redisService.ClearData(ctx)
-			if err != nil {
-				log.Error("Failed to clear Redis data", zap.Error(err))
-				return err
+	gate, err := openStaleGate(ctx, watermarks, queuedItems)
+	if err != nil {
+		return nil, err
+	}
+
+	// Process each item
+	successCount := 0
+	staleCount := 0
+	failed := make(map[int]error)
+
+	sent := make([]redis_processor.QueuedItem, 0, len(queuedItems))
+	sentIndexes := make([]int, 0, len(queuedItems))
+	spans := make([]trace.Span, 0, len(queuedItems))
+	for i, item := range queuedItems {
+		if !gate.admit(ctx, item) {
+			staleCount++
+			continue
+		}
+		itemCtx, span := startIndexSpan(ctx, item)
+		if err := indexItem(itemCtx, algoliaService, item); err != nil {
+			log.Error("Failed to send item to Algolia",
+				zap.Error(err),
+				zap.String("action", string(item.Action)),
+				zap.String("objectId", item.Data.Id))
+			tracing.End(span, err)
+			countFailure(item)
+			failed[i] = err
+			continue
+		}
+		sent = append(sent, item)
+		sentIndexes = append(sentIndexes, i)
+		spans = append(spans, span)
+		successCount++
+	}
+
+	ctx, flushSpan := startFlushSpan(ctx, spans)
+	err = confirmSent(ctx, cfg, algoliaService)
+	tracing.End(flushSpan, err)
+	for _, span := range spans {
+		tracing.End(span, err)
+	}
+	if err != nil {
+		// Items refused above are counted already, and stale ones were
+		// never to be sent; only what was sent is lost with the flush.
+		countFailure(sent...)
+		for _, i := range sentIndexes {
+			failed[i] = err
+		}
+		return failed, err
+	}
+	if err := gate.record(ctx, sent); err != nil {
+		return nil, err
+	}
+
+	log.Info("Sync processing completed",
+		zap.Int("successful", successCount),
+		zap.Int("failed", len(failed)),
+		zap.Int("stale", staleCount),
+		zap.Int("total", len(queuedItems)))
+
+	return failed, nil
+}
+
+// confirmSent flushes what sendItems queued and, if configured, waits for
+// Algolia to publish it.
+func confirmSent(
+	ctx context.Context,
+	cfg config.Config,
+	algoliaService algolia.AlgoliaService[redis_processor.AnimeDocument],
+) error {
+	log := logger.FromCtx(ctx)
+
+	// Flush any remaining data to Algolia
+	_, err := algoliaService.Flush(ctx)
+	if err != nil {
+		log.Error("Failed to flush data to Algolia", zap.Error(err))
+		return err
+	}
+
+	// Flush only hands the writes to Algolia's queue. The claimed batch is
+	// the sole copy of these items, so it is kept until Algolia confirms
+	// they were published; a run that gives up here is retried from the
+	// claimed key by the next one.
+	if cfg.AlgoliaConfig.WaitForTasks {
+		timeout := time.Duration(cfg.AlgoliaConfig.TaskWaitTimeout) * time.Second
+		results, err := algoliaService.WaitForTasks(ctx, timeout)
+		if err != nil {
+			log.Error("Algolia did not confirm the batch; keeping the claimed items",
+				zap.Error(err), zap.Int("tasks", len(results)))
+			return err
+		}
+	}
+	return nil
+}
+
+// countFailure counts items that did not reach Algolia, by action.
+func countFailure(items ...redis_processor.QueuedItem) {
+	for _, item := range items {
+		metrics.Failures.WithLabelValues(metrics.AlgoliaStage, string(item.Action)).Inc()
+	}
+}
+
+// indexItem queues the Algolia write one item calls for.
+func indexItem(ctx context.Context, algoliaService algolia.AlgoliaService[redis_processor.AnimeDocument], item redis_processor.QueuedItem) error {
+	switch item.Action {
+	case redis_processor.CreateAction, redis_processor.UpdateAction:
+		_, err := algoliaService.AddToIndex(ctx, item.Data.ToDocument())
+		return err
+	case redis_processor.DeleteAction:
+		// Previously a TODO that logged a warning and moved on, which is
+		// why the index accumulated ~2,860 records whose anime no longer
+		// exists -- every one of them a search result leading to a 404.
+		return algoliaService.DeleteFromIndex(ctx, item.Data.Id)
+	default:
+		return fmt.Errorf("unknown action %q", item.Action)
+	}
+}
+
+// syncReliableQueue works the queue a page at a time and settles every item on
+// its own: acknowledged once Algolia has it, returned to the queue otherwise.
+func syncReliableQueue(ctx context.Context, cfg config.Config, algoliaService algolia.AlgoliaService[redis_processor.AnimeDocument], watermarks *redis.Watermarks) error {
+	log := logger.FromCtx(ctx)
+
+	queue := redis.NewReliableQueue[redis_processor.QueuedItem](ctx, cfg.RedisConfig)
+	if _, err := queue.Recover(ctx); err != nil {
+		return err
+	}
+
+	// Failed items stay on the processing list until the run ends. Returned
+	// straight away they would be the next thing claimed, and the run would
+	// spin on them. Newer items for the same anime are still sent meanwhile;
+	// the watermarks drop the failed one when it is retried after them.
+	var failed []redis.Claimed[redis_processor.QueuedItem]
+	acknowledged := 0
+	defer func() {
+		// The run may be stopping because the lease is gone; a context that
+		// is already cancelled would leave the failed items unreturned. Without
+		// the lease, Nack refuses and the next holder recovers them.
+		ctx := context.WithoutCancel(ctx)
+		if err := queue.Nack(ctx, failed...); err != nil {
+			log.Error("Failed to return items to the queue; the next run recovers them", zap.Error(err))
+			return
+		}
+		log.Info("Reliable sync completed",
+			zap.Int("acknowledged", acknowledged),
+			zap.Int("returned", len(failed)))
+	}()
+
+	for {
+		items, err := queue.Claim(ctx, cfg.RedisConfig.ClaimSize)
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		gate, err := openStaleGate(ctx, watermarks, claimedData(items))
+		if err != nil {
+			return err
+		}
+
+		// Stale items are settled by dropping them, and acknowledged with
+		// the sent ones.
+		var stale []redis.Claimed[redis_processor.QueuedItem]
+		sent := make([]redis.Claimed[redis_processor.QueuedItem], 0, len(items))
+		spans := make([]trace.Span, 0, len(items))
+		for _, item := range items {
+			if !gate.admit(ctx, item.Data) {
+				stale = append(stale, item)
+				continue
 			}
-			log.Info("Successfully cleared Redis queue")
+			itemCtx, span := startIndexSpan(ctx, item.Data)
+			if err := indexItem(itemCtx, algoliaService, item.Data); err != nil {
+				log.Error("Failed to send item to Algolia",
+					zap.Error(err),
+					zap.String("action", string(item.Data.Action)),
+					zap.String("objectId", item.Data.Data.Id),
+					zap.Int("attempts", item.Attempts))
+				item.Err = err
+				tracing.End(span, err)
+				countFailure(item.Data)
+				failed = append(failed, item)
+				continue
+			}
+			sent = append(sent, item)
+			spans = append(spans, span)
+		}
+
+		confirmed, unconfirmed, err := confirmWithAlgolia(ctx, cfg.AlgoliaConfig, algoliaService, sent, spans)
+		for _, item := range unconfirmed {
+			countFailure(item.Data)
+		}
+		failed = append(failed, unconfirmed...)
+		if recordErr := gate.record(ctx, claimedData(confirmed)); recordErr != nil {
+			// Still on the processing list, so recovered and resent next run.
+			return recordErr
+		}
+		if ackErr := queue.Ack(ctx, append(confirmed, stale...)...); ackErr != nil {
+			// Still on the processing list, so recovered and resent next run.
+			return ackErr
+		}
+		acknowledged += len(confirmed) + len(stale)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func claimedData(items []redis.Claimed[redis_processor.QueuedItem]) []redis_processor.QueuedItem {
+	data := make([]redis_processor.QueuedItem, len(items))
+	for i, item := range items {
+		data[i] = item.Data
+	}
+	return data
+}
+
+// confirmWithAlgolia flushes and splits the items by whether Algolia took them.
+// With task waiting on, only items in a published task count. spans are the
+// items' index spans, in the same order, and are ended with their outcome.
+func confirmWithAlgolia(
+	ctx context.Context,
+	algoliaCfg config.AlgoliaConfig,
+	algoliaService algolia.AlgoliaService[redis_processor.AnimeDocument],
+	items []redis.Claimed[redis_processor.QueuedItem],
+	spans []trace.Span,
+) (confirmed, unconfirmed []redis.Claimed[redis_processor.QueuedItem], err error) {
+	log := logger.FromCtx(ctx)
+
+	ctx, flushSpan := startFlushSpan(ctx, spans)
+	defer func() { tracing.End(flushSpan, err) }()
+
+	if _, err := algoliaService.Flush(ctx); err != nil {
+		log.Error("Failed to flush data to Algolia", zap.Error(err))
+		for i := range items {
+			items[i].Err = err
+			tracing.End(spans[i], err)
+		}
+		return nil, items, err
+	}
+	if !algoliaCfg.WaitForTasks {
+		for _, span := range spans {
+			tracing.End(span, nil)
+		}
+		return items, nil, nil
+	}
+
+	results, err := algoliaService.WaitForTasks(ctx, time.Duration(algoliaCfg.TaskWaitTimeout)*time.Second)
+	published := make(map[string]struct{})
+	for _, r := range results {
+		if !r.Published {
+			continue
+		}
+		for _, id := range r.ObjectIDs {
+			published[id] = struct{}{}
+		}
+	}
+	cause := err
+	if cause == nil {
+		cause = errors.New("no published task included the record")
+	}
+	for i, item := range items {
+		if _, ok := published[item.Data.Data.Id]; ok {
+			confirmed = append(confirmed, item)
 		} else {
-			log.Warn("Not clearing Redis queue due to failed syncs", zap.Int("failCount", failCount))
+			item.Err = fmt.Errorf("algolia did not confirm the write: %w", cause)
+			unconfirmed = append(unconfirmed, item)
 		}
+		tracing.End(spans[i], item.Err)
+	}
+	if err != nil {
+		log.Error("Algolia did not confirm every write",
+			zap.Error(err), zap.Int("unconfirmed", len(unconfirmed)))
+	}
+	return confirmed, unconfirmed, err
+}
 
-		log.Info("Redis to Algolia sync job completed successfully")
-		return nil
-	},
+// startIndexSpan starts the span covering one item from its hand-off to
+// Algolia until Algolia has it. It continues the trace of the message the item
+// came from, linked to this run, so a trace shows both what produced a record
+// and when it was indexed.
+func startIndexSpan(ctx context.Context, item redis_processor.QueuedItem) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(tracing.Extract(ctx, item.Trace), "algolia index",
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithAttributes(
+			attribute.String("algolia.object_id", item.Data.Id),
+			attribute.String("algolia.action", item.Action)))
+}
+
+// startFlushSpan starts the span of the flush that sends the items spans
+// cover. It is one request for many traces, so it links to each rather than
+// belonging to any.
+func startFlushSpan(ctx context.Context, spans []trace.Span) (context.Context, trace.Span) {
+	links := make([]trace.Link, 0, len(spans))
+	for _, span := range spans {
+		links = append(links, trace.Link{SpanContext: span.SpanContext()})
+	}
+	return tracing.Tracer().Start(ctx, "algolia flush",
+		trace.WithLinks(links...),
+		trace.WithAttributes(attribute.Int("algolia.items", len(spans))))
 }
 
 func init() {
 	rootCmd.AddCommand(syncRedisToAlgoliaCmd)
-}
\ No newline at end of file
+}
@@ -0,0 +1,76 @@
+package commands
+
+import (
+	"context"
+
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"github.com/weeb-vip/algolia-sync/internal/metrics"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
+	"go.uber.org/zap"
+)
+
+// staleGate keeps one batch from writing anything older than what Algolia
+// already has: it drops the stale items before they are sent, and records
+// what was sent once Algolia has it. With no watermarks it admits everything.
+type staleGate struct {
+	watermarks *redis.Watermarks
+	marks      map[string]redis.Watermark
+}
+
+func openStaleGate(ctx context.Context, watermarks *redis.Watermarks, items []redis_processor.QueuedItem) (*staleGate, error) {
+	ids := make([]string, 0, len(items))
+	seen := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		if _, ok := seen[item.Data.Id]; !ok {
+			seen[item.Data.Id] = struct{}{}
+			ids = append(ids, item.Data.Id)
+		}
+	}
+	marks, err := watermarks.Get(ctx, ids...)
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to read the watermarks", zap.Error(err))
+		return nil, err
+	}
+	return &staleGate{watermarks: watermarks, marks: marks}, nil
+}
+
+// admit tells whether item is to be sent. An admitted item moves the mark for
+// the rest of the batch as well, so of two items for one anime the older is
+// dropped when it comes second and overwritten when it comes first.
+func (g *staleGate) admit(ctx context.Context, item redis_processor.QueuedItem) bool {
+	if g.watermarks == nil {
+		return true
+	}
+	version, _ := item.QueueVersion()
+	mark := g.marks[item.Data.Id]
+	if !mark.Admits(version) {
+		logger.FromCtx(ctx).Info("dropped an item older than what Algolia already has",
+			zap.String("objectId", item.Data.Id),
+			zap.String("action", string(item.Action)),
+			zap.Int64("version", version),
+			zap.Int64("watermark", mark.Version),
+			zap.Bool("deleted", mark.Deleted))
+		metrics.ItemsStale.WithLabelValues(string(item.Action)).Inc()
+		return false
+	}
+	g.marks[item.Data.Id] = mark.Advanced(version, item.Action == redis_processor.DeleteAction)
+	return true
+}
+
+// record advances the watermarks past items, which Algolia has.
+func (g *staleGate) record(ctx context.Context, items []redis_processor.QueuedItem) error {
+	if g.watermarks == nil || len(items) == 0 {
+		return nil
+	}
+	marks := make(map[string]redis.Watermark, len(items))
+	for _, item := range items {
+		version, _ := item.QueueVersion()
+		marks[item.Data.Id] = marks[item.Data.Id].Advanced(version, item.Action == redis_processor.DeleteAction)
+	}
+	if err := g.watermarks.Advance(ctx, marks); err != nil {
+		logger.FromCtx(ctx).Error("Failed to record the watermarks", zap.Error(err))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package eventing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"github.com/weeb-vip/algolia-sync/internal/metrics"
+	"github.com/weeb-vip/algolia-sync/internal/services/queue"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis"
+	"go.uber.org/zap"
+)
+
+// newDedup returns the consumers' dedup layer. It is kept in Redis beside the
+// queue, so other backends have none.
+func newDedup(ctx context.Context, cfg config.Config) *redis.Dedup {
+	if backend := cfg.QueueConfig.Backend; backend != "" && backend != queue.RedisBackend {
+		return nil
+	}
+	return redis.NewDedup(ctx, cfg.RedisConfig)
+}
+
+// newWatermarks returns the watermarks the streaming mode holds its writes
+// to, the same ones the sync keeps. They are kept in Redis beside the queue,
+// so other backends have none.
+func newWatermarks(ctx context.Context, cfg config.Config) *redis.Watermarks {
+	if !cfg.RedisConfig.Watermarks {
+		return nil
+	}
+	if backend := cfg.QueueConfig.Backend; backend != "" && backend != queue.RedisBackend {
+		return nil
+	}
+	return redis.NewWatermarks(ctx, cfg.RedisConfig)
+}
+
+// queueOnce queues a message known by keys through enqueue, unless it has
+// been queued before: then it is counted as a duplicate from source, and
+// settled without queueing it again.
+func queueOnce(ctx context.Context, dedup *redis.Dedup, source string, keys []string, enqueue func() error) error {
+	log := logger.FromCtx(ctx)
+
+	seen, err := dedup.Seen(ctx, keys...)
+	if err != nil {
+		// Queueing it a second time is harmless; not queueing it is not.
+		log.Warn("Failed to check for a duplicate; queueing the message", zap.Error(err))
+	}
+	if seen {
+		log.Info("Skipping a message already queued", zap.Strings("keys", keys))
+		metrics.MessagesDuplicate.WithLabelValues(source).Inc()
+		return nil
+	}
+
+	if err := enqueue(); err != nil {
+		return err
+	}
+	if err := dedup.Mark(ctx, keys...); err != nil {
+		log.Warn("Failed to mark the message queued; a redelivery queues it again", zap.Error(err))
+	}
+	return nil
+}
+
+// kafkaDedupKeys know msg by its place in its topic, and by eventID if it was
+// a CloudEvent. A retried message is in the retry topic, so only its event id
+// ties it to the original.
+func kafkaDedupKeys(msg *kafka.Message, eventID string) []string {
+	topic := ""
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+	keys := []string{fmt.Sprintf("kafka:%s:%d:%d", topic, msg.TopicPartition.Partition, msg.TopicPartition.Offset)}
+	return withEventKey(keys, eventID)
+}
+
+// pulsarDedupKeys know msg by its message id, which a redelivery keeps, and
+// by eventID if it was a CloudEvent.
+func pulsarDedupKeys(msg pulsar.Message, eventID string) []string {
+	return withEventKey([]string{"pulsar:" + msg.Topic() + ":" + msg.ID().String()}, eventID)
+}
+
+// withEventKey adds the CloudEvent id. Ids are unique per producer, and the
+// anime events come from one.
+func withEventKey(keys []string, eventID string) []string {
+	if eventID == "" {
+		return keys
+	}
+	return append(keys, "cloudevent:"+eventID)
+}
@@ -0,0 +1,69 @@
+package eventing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis"
+)
+
+func newTestDedup(t *testing.T) *redis.Dedup {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	return redis.NewDedup(context.Background(), config.RedisConfig{
+		URL:      "redis://" + mr.Addr(),
+		Key:      "algolia-sync:data",
+		DedupTTL: 60,
+	})
+}
+
+func kafkaMessage(partition int32, offset kafka.Offset) *kafka.Message {
+	topic := "anime"
+	return &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: offset}}
+}
+
+func TestQueueOnceSkipsARedelivery(t *testing.T) {
+	dedup := newTestDedup(t)
+	ctx := context.Background()
+	queued := 0
+	enqueue := func() error { queued++; return nil }
+
+	for i := 0; i < 2; i++ {
+		if err := queueOnce(ctx, dedup, "kafka", kafkaDedupKeys(kafkaMessage(0, 7), ""), enqueue); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The same CloudEvent sent again lands at another offset.
+	for _, msg := range []*kafka.Message{kafkaMessage(1, 3), kafkaMessage(1, 4)} {
+		if err := queueOnce(ctx, dedup, "kafka", kafkaDedupKeys(msg, "evt-1"), enqueue); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if queued != 2 {
+		t.Errorf("queued %d times, want once per message", queued)
+	}
+}
+
+func TestQueueOnceDoesNotMarkWhatFailedToQueue(t *testing.T) {
+	dedup := newTestDedup(t)
+	ctx := context.Background()
+	keys := kafkaDedupKeys(kafkaMessage(0, 7), "")
+
+	failure := errors.New("redis down")
+	if err := queueOnce(ctx, dedup, "kafka", keys, func() error { return failure }); !errors.Is(err, failure) {
+		t.Fatalf("queueOnce = %v, want the queue's error", err)
+	}
+
+	queued := false
+	if err := queueOnce(ctx, dedup, "kafka", keys, func() error { queued = true; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if !queued {
+		t.Error("the redelivery of a message that was never queued was skipped")
+	}
+}
@@ -0,0 +1,89 @@
+package eventing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/services/cloudevents"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
+	"github.com/weeb-vip/algolia-sync/internal/services/schema_registry"
+)
+
+// Message encodings selectable through KafkaConfig.Encoding and
+// PulsarConfig.Encoding.
+const (
+	jsonEncoding = "json"
+	avroEncoding = "avro"
+)
+
+// avroDecoder returns the decoder for encoding: nil for JSON, which each
+// source decodes as it always has.
+func avroDecoder(encoding string, registryCfg config.SchemaRegistryConfig) (*schema_registry.Decoder, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", jsonEncoding:
+		return nil, nil
+	case avroEncoding:
+		return schema_registry.NewDecoder(registryCfg)
+	default:
+		return nil, fmt.Errorf("unknown message encoding %q", encoding)
+	}
+}
+
+// kafkaTranscoder turns each Kafka message into the JSON payload ep's
+// processor decodes, which keeps the handlers as they are whatever arrives: a
+// CloudEvent in binary mode, with its attributes in ce_ headers, an Avro
+// payload if decoder is set, or a structured CloudEvent. Anything else is
+// passed on as it is.
+func kafkaTranscoder(decoder *schema_registry.Decoder) func(ctx context.Context, msg *kafka.Message) ([]byte, error) {
+	return func(ctx context.Context, msg *kafka.Message) ([]byte, error) {
+		headers := func(key string) (string, bool) { return header(msg.Headers, key) }
+		if event, ok := cloudevents.FromHeaders(headers, msg.Value); ok {
+			return payloadJSON(event)
+		}
+
+		if decoder != nil {
+			var payload redis_processor.Payload
+			if err := decoder.Decode(ctx, msg.Value, &payload); err != nil {
+				return nil, err
+			}
+			return json.Marshal(payload)
+		}
+
+		event, ok, err := cloudevents.ParseStructured(msg.Value)
+		if err != nil || !ok {
+			// Not JSON is left for ep's decode to report, as it always
+			// was.
+			return msg.Value, nil
+		}
+		return payloadJSON(event)
+	}
+}
+
+func payloadJSON(event *cloudevents.Event) ([]byte, error) {
+	payload, err := event.Payload()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(payload)
+}
+
+// decodePayload reads a JSON payload, or a structured CloudEvent, as the
+// Pulsar source's messages may be either.
+func decodePayload(ctx context.Context, raw []byte) (*redis_processor.Payload, error) {
+	event, ok, err := cloudevents.ParseStructured(raw)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return event.Payload()
+	}
+	var payload redis_processor.Payload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, err
+	}
+	return &payload, nil
+}
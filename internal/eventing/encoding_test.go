@@ -0,0 +1,66 @@
+package eventing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/weeb-vip/algolia-sync/internal/services/cloudevents"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
+)
+
+func transcodePayload(t *testing.T, msg *kafka.Message) redis_processor.Payload {
+	t.Helper()
+	value, err := kafkaTranscoder(nil)(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("transcode: %v", err)
+	}
+	var payload redis_processor.Payload
+	if err := json.Unmarshal(value, &payload); err != nil {
+		t.Fatalf("transcoded to %s: %v", value, err)
+	}
+	return payload
+}
+
+func TestKafkaTranscoderReadsCloudEventsInEitherMode(t *testing.T) {
+	structured := &kafka.Message{Value: []byte(`{"specversion":"1.0","type":"anime.deleted","id":"evt-1","subject":"anime-1"}`)}
+	binary := &kafka.Message{
+		Value: []byte(`{"title_en":"Platinum End"}`),
+		Headers: []kafka.Header{
+			{Key: "ce_specversion", Value: []byte("1.0")},
+			{Key: "ce_type", Value: []byte("anime.updated")},
+			{Key: "ce_id", Value: []byte("evt-2")},
+			{Key: "ce_subject", Value: []byte("anime-2")},
+		},
+	}
+
+	if payload := transcodePayload(t, structured); payload.Action != redis_processor.DeleteAction || payload.Data.Id != "anime-1" || payload.EventID != "evt-1" {
+		t.Errorf("structured decoded as %+v", payload)
+	}
+	payload := transcodePayload(t, binary)
+	if payload.Action != redis_processor.UpdateAction || payload.Data.Id != "anime-2" || payload.EventID != "evt-2" {
+		t.Errorf("binary decoded as %+v", payload)
+	}
+	if payload.Data.TitleEn == nil || *payload.Data.TitleEn != "Platinum End" {
+		t.Errorf("title_en = %v, want the message value's", payload.Data.TitleEn)
+	}
+}
+
+func TestKafkaTranscoderPassesOtherMessagesThrough(t *testing.T) {
+	for _, value := range []string{`{"action":"create","data":{"id":"anime-1"}}`, "{"} {
+		got, err := kafkaTranscoder(nil)(context.Background(), &kafka.Message{Value: []byte(value)})
+		if err != nil || string(got) != value {
+			t.Errorf("transcode(%s) = %s, %v, want it unchanged", value, got, err)
+		}
+	}
+}
+
+func TestKafkaTranscoderMarksEventsThatCannotBeIndexedUndecodable(t *testing.T) {
+	msg := &kafka.Message{Value: []byte(`{"specversion":"1.0","type":"anime.archived","id":"evt-1","subject":"anime-1"}`)}
+	_, err := kafkaTranscoder(nil)(context.Background(), msg)
+	if !errors.Is(err, cloudevents.ErrInvalid) || !isDecodeError(err) {
+		t.Errorf("transcode = %v, want an undecodable ErrInvalid", err)
+	}
+}
@@ -2,64 +2,179 @@ package eventing
 
 import (
 	"context"
+	"fmt"
 	"github.com/apache/pulsar-client-go/pulsar"
 	"github.com/weeb-vip/algolia-sync/config"
 	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"github.com/weeb-vip/algolia-sync/internal/metrics"
+	"github.com/weeb-vip/algolia-sync/internal/services/debezium"
 	"github.com/weeb-vip/algolia-sync/internal/services/processor"
+	"github.com/weeb-vip/algolia-sync/internal/services/queue"
 	"github.com/weeb-vip/algolia-sync/internal/services/redis"
 	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
+	"github.com/weeb-vip/algolia-sync/internal/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"strings"
 	"time"
 )
 
-func EventingAlgolia() error {
-	cfg := config.LoadConfigOrPanic()
-	ctx := context.Background()
-	log := logger.Get()
-	ctx = logger.WithCtx(ctx, log)
+// Message formats selectable through PulsarConfig.Format.
+const (
+	payloadFormat  = "payload"
+	debeziumFormat = "debezium"
+)
 
-	redisService := redis.NewRedisService[redis_processor.QueuedItem](ctx, cfg.RedisConfig)
+// StartPulsar starts receiving from Pulsar under lifecycle, which stops it and
+// closes what it opened.
+func StartPulsar(ctx context.Context, cfg config.Config, lifecycle *Lifecycle, checks Checks) error {
+	log := logger.FromCtx(ctx)
 
-	imageProcessor := redis_processor.NewImageProcessor(redisService)
+	messageProcessor, err := pulsarProcessor(cfg)
+	if err != nil {
+		return err
+	}
 
-	messageProcessor := processor.NewProcessor[redis_processor.Payload]()
+	itemQueue, err := queue.New[redis_processor.QueuedItem](ctx, cfg)
+	if err != nil {
+		log.Error("Failed to create the queue", zap.Error(err))
+		return err
+	}
+	lifecycle.OnShutdown("queue", func() error {
+		return queue.Close(itemQueue)
+	})
+
+	imageProcessor := redis_processor.NewImageProcessor(itemQueue)
+	dedup := newDedup(ctx, cfg)
 
 	client, err := pulsar.NewClient(pulsar.ClientOptions{
 		URL: cfg.PulsarConfig.URL,
 	})
 
 	if err != nil {
-		log.Fatal("Error creating pulsar client: ", zap.String("error", err.Error()))
+		log.Error("Error creating pulsar client: ", zap.String("error", err.Error()))
 		return err
 	}
-
-	defer client.Close()
+	lifecycle.OnShutdown("pulsar client", func() error {
+		client.Close()
+		return nil
+	})
+	// A topic lookup goes to the broker, so it fails when the client cannot
+	// reach one.
+	checks.AddCheck("pulsar", func(ctx context.Context) error {
+		_, err := client.TopicPartitions(cfg.PulsarConfig.Topic)
+		return err
+	})
 
 	consumer, err := client.Subscribe(pulsar.ConsumerOptions{
 		Topic:            cfg.PulsarConfig.Topic,
 		SubscriptionName: cfg.PulsarConfig.SubscribtionName,
 		Type:             pulsar.Shared,
 	})
+	if err != nil {
+		log.Error("Error subscribing: ", zap.String("error", err.Error()))
+		return err
+	}
+	lifecycle.OnShutdown("pulsar consumer", func() error {
+		consumer.Close()
+		return nil
+	})
 
-	defer consumer.Close()
+	lifecycle.Go("pulsar consumer", func() error {
+		return receivePulsar(ctx, consumer, messageProcessor, imageProcessor, dedup, lifecycle)
+	})
+	return nil
+}
 
-	// create channel to receive messages
+// pulsarProcessor parses messages in the format and encoding configured for
+// the topic.
+func pulsarProcessor(cfg config.Config) (*processor.Processor[redis_processor.Payload], error) {
+	pulsarCfg := cfg.PulsarConfig
+	decoder, err := avroDecoder(pulsarCfg.Encoding, cfg.SchemaRegistryConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format := strings.ToLower(strings.TrimSpace(pulsarCfg.Format)); format {
+	case "", payloadFormat:
+		if decoder == nil {
+			return processor.NewProcessorWithDecoder(decodePayload), nil
+		}
+		return processor.NewProcessorWithDecoder(func(ctx context.Context, raw []byte) (*redis_processor.Payload, error) {
+			var payload redis_processor.Payload
+			if err := decoder.Decode(ctx, raw, &payload); err != nil {
+				return nil, err
+			}
+			return &payload, nil
+		}), nil
+	case debeziumFormat:
+		if decoder == nil {
+			return processor.NewProcessorWithDecoder(func(ctx context.Context, raw []byte) (*redis_processor.Payload, error) {
+				return debezium.Decode(raw)
+			}), nil
+		}
+		return processor.NewProcessorWithDecoder(func(ctx context.Context, raw []byte) (*redis_processor.Payload, error) {
+			if len(raw) == 0 {
+				// A tombstone.
+				return nil, nil
+			}
+			var envelope debezium.Envelope
+			if err := decoder.Decode(ctx, raw, &envelope); err != nil {
+				return nil, err
+			}
+			return envelope.Payload()
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown format %q for Pulsar topic %s", pulsarCfg.Format, pulsarCfg.Topic)
+	}
+}
+
+func receivePulsar(
+	ctx context.Context,
+	consumer pulsar.Consumer,
+	messageProcessor *processor.Processor[redis_processor.Payload],
+	imageProcessor redis_processor.ImageProcessor,
+	dedup *redis.Dedup,
+	lifecycle *Lifecycle,
+) error {
+	log := logger.FromCtx(ctx)
 
 	for {
-		msg, err := consumer.Receive(ctx)
+		msg, err := consumer.Receive(lifecycle.Context())
 		if err != nil {
-			log.Fatal("Error receiving message: ", zap.String("error", err.Error()))
+			if lifecycle.Context().Err() != nil {
+				return nil
+			}
+			log.Error("Error receiving message: ", zap.String("error", err.Error()))
+			return err
 		}
 
 		log.Info("Received message", zap.String("msgId", msg.ID().String()))
+		metrics.MessagesConsumed.WithLabelValues("pulsar").Inc()
 
-		err = messageProcessor.Process(ctx, string(msg.Payload()), imageProcessor.Process)
+		msgCtx, done := lifecycle.Detach(ctx)
+		msgCtx, span := tracing.Tracer().Start(tracing.Extract(msgCtx, msg.Properties()), "pulsar receive",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				semconv.MessagingSystemKey.String("pulsar"),
+				semconv.MessagingDestinationName(msg.Topic()),
+				semconv.MessagingMessageID(msg.ID().String())))
+		err = messageProcessor.Process(msgCtx, string(msg.Payload()), func(ctx context.Context, payload redis_processor.Payload) error {
+			return queueOnce(ctx, dedup, "pulsar", pulsarDedupKeys(msg, payload.EventID), func() error {
+				return imageProcessor.Process(ctx, payload)
+			})
+		})
+		tracing.End(span, err)
+		done()
 		if err != nil {
 			log.Warn("error processing message: ", zap.String("error", err.Error()))
 			continue
 		}
-		consumer.Ack(msg)
+		if err := consumer.Ack(msg); err != nil {
+			// Redelivered later, which the queue tolerates.
+			log.Warn("error acknowledging message: ", zap.String("error", err.Error()))
+		}
 		time.Sleep(50 * time.Millisecond)
 	}
-	return nil
 }
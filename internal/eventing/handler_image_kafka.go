@@ -2,76 +2,225 @@ package eventing
 
 import (
 	"context"
-	"github.com/ThatCatDev/ep/v2/drivers"
-	epKafka "github.com/ThatCatDev/ep/v2/drivers/kafka"
-	"github.com/ThatCatDev/ep/v2/middlewares/kafka/backoffretry"
+	"fmt"
+	"github.com/ThatCatDev/ep/v2/event"
 	"github.com/ThatCatDev/ep/v2/processor"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/weeb-vip/algolia-sync/config"
 	"github.com/weeb-vip/algolia-sync/internal/logger"
-	"github.com/weeb-vip/algolia-sync/internal/services/redis"
+	"github.com/weeb-vip/algolia-sync/internal/metrics"
+	"github.com/weeb-vip/algolia-sync/internal/services/algolia"
+	"github.com/weeb-vip/algolia-sync/internal/services/algolia_processor_kafka"
+	"github.com/weeb-vip/algolia-sync/internal/services/queue"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
 	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor_kafka"
+	"github.com/weeb-vip/algolia-sync/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"strings"
+	"time"
 )
 
-func EventingAlgoliaKafka() error {
-	cfg := config.LoadConfigOrPanic()
-	ctx := context.Background()
-	log := logger.Get()
-	ctx = logger.WithCtx(ctx, log)
+// Kafka modes selectable through KafkaConfig.Mode.
+const (
+	kafkaBufferedMode  = "buffered"
+	kafkaStreamingMode = "streaming"
+)
+
+// StartKafka starts the Kafka consumers under lifecycle, which stops them and
+// closes what they opened.
+func StartKafka(ctx context.Context, cfg config.Config, lifecycle *Lifecycle, checks Checks) error {
+	log := logger.FromCtx(ctx)
 
-	debug := &cfg.KafkaConfig.Debug
-	if *debug == "" {
-		debug = nil
+	kafkaConfig, err := newKafkaClientConfig(cfg.KafkaConfig)
+	if err != nil {
+		return err
 	}
-	kafkaConfig := &epKafka.KafkaConfig{
-		ConsumerGroupName:        cfg.KafkaConfig.ConsumerGroupName,
-		BootstrapServers:         cfg.KafkaConfig.BootstrapServers,
-		SaslMechanism:            nil,
-		SecurityProtocol:         nil,
-		Username:                 nil,
-		Password:                 nil,
-		ConsumerSessionTimeoutMs: nil,
-		ConsumerAutoOffsetReset:  &cfg.KafkaConfig.Offset,
-		ClientID:                 nil,
-		Debug:                    debug,
+	// One decoder for every consumer, so each schema is fetched once.
+	decoder, err := avroDecoder(cfg.KafkaConfig.Encoding, cfg.SchemaRegistryConfig)
+	if err != nil {
+		return err
 	}
+	transcode := kafkaTranscoder(decoder)
 
-	log.Info("Creating Kafka driver", zap.String("bootstrapServers", cfg.KafkaConfig.BootstrapServers))
-	driver := epKafka.NewKafkaDriver(kafkaConfig)
-	defer func(driver drivers.Driver[*kafka.Message]) {
-		err := driver.Close()
+	var consume func() error
+	switch mode := strings.ToLower(strings.TrimSpace(cfg.KafkaConfig.Mode)); mode {
+	case "", kafkaBufferedMode:
+		log.Info("Creating processor for Kafka messages", zap.String("topic", cfg.KafkaConfig.Topic))
+
+		itemQueue, err := queue.New[redis_processor_kafka.QueuedItem](ctx, cfg)
 		if err != nil {
-			log.Error("Error closing Kafka driver", zap.String("error", err.Error()))
-		} else {
-			log.Info("Kafka driver closed successfully")
+			log.Error("Failed to create the queue", zap.Error(err))
+			return err
+		}
+		lifecycle.OnShutdown("queue", func() error {
+			return queue.Close(itemQueue)
+		})
+
+		redisProcessor := redis_processor_kafka.NewRedisProcessor(itemQueue)
+		dedup := newDedup(ctx, cfg)
+		handle := func(ctx context.Context, data event.Event[*kafka.Message, redis_processor_kafka.Payload]) (event.Event[*kafka.Message, redis_processor_kafka.Payload], error) {
+			keys := kafkaDedupKeys(data.DriverMessage, data.Payload.EventID)
+			err := queueOnce(ctx, dedup, "kafka", keys, func() error {
+				_, err := redisProcessor.Process(ctx, data)
+				return err
+			})
+			return data, err
+		}
+		consume = func() error {
+			return runKafkaConsumer(ctx, cfg, kafkaConfig, transcode, lifecycle, handle, nil)
 		}
-	}(driver)
+	case kafkaStreamingMode:
+		log.Info("Streaming Kafka messages to Algolia",
+			zap.String("topic", cfg.KafkaConfig.Topic), zap.String("index", cfg.AlgoliaConfig.Index))
+		checks.AddCheck("algolia", algolia.Reachable(cfg.AlgoliaConfig))
+		consume = func() error {
+			return runStreamingConsumer(ctx, cfg, kafkaConfig, transcode, lifecycle)
+		}
+	default:
+		return fmt.Errorf("unknown Kafka mode %q", cfg.KafkaConfig.Mode)
+	}
+
+	// The driver keeps its consumers to itself, so readiness asks the
+	// brokers through a client of its own. Creating it has librdkafka check
+	// the configuration, overrides included, before any consumer starts.
+	admin, err := kafka.NewAdminClient(&kafkaConfig.client)
+	if err != nil {
+		log.Error("Failed to create the Kafka admin client", zap.Error(err))
+		return err
+	}
+	lifecycle.OnShutdown("kafka admin", func() error {
+		admin.Close()
+		return nil
+	})
+	checks.AddCheck("kafka", func(ctx context.Context) error {
+		timeout := checkTimeoutMs(ctx)
+		_, err := admin.GetMetadata(&cfg.KafkaConfig.Topic, false, timeout)
+		return err
+	})
+
+	// Each consumer joins the group on its own and is assigned its own
+	// partitions, so per-anime ordering within a partition is unchanged.
+	// One consumer failing takes the process down, as it did with a single
+	// consumer, rather than leaving its partitions unread until a rebalance.
+	consumers := max(cfg.KafkaConfig.Consumers, 1)
+	for i := 0; i < consumers; i++ {
+		lifecycle.Go("kafka consumer", consume)
+	}
+	return nil
+}
 
-	log.Info("Creating processor for Kafka messages", zap.String("topic", cfg.KafkaConfig.Topic))
+// runStreamingConsumer consumes into Algolia, committing only what a flush has
+// sent. Each consumer has a batch of its own: with a shared one, a flush by
+// one consumer could take another's writes and fail after the other had
+// committed them.
+func runStreamingConsumer(
+	ctx context.Context,
+	cfg config.Config,
+	kafkaConfig kafkaClientConfig,
+	transcode func(ctx context.Context, msg *kafka.Message) ([]byte, error),
+	lifecycle *Lifecycle,
+) error {
+	// Without the timer: the committer decides when to flush, as a flush it
+	// did not ask for would send writes without their offsets being
+	// committed.
+	service := algolia.NewAlgoliaServiceWithoutTimer[redis_processor.AnimeDocument](ctx, cfg.AlgoliaConfig)
+	algoliaProcessor := algolia_processor_kafka.NewAlgoliaProcessor(service, cfg.AlgoliaConfig, newWatermarks(ctx, cfg))
 
-	redisService := redis.NewRedisService[redis_processor_kafka.QueuedItem](ctx, cfg.RedisConfig)
+	committer := newCommitAfterFlush(func(ctx context.Context) error {
+		ctx, done := lifecycle.Detach(ctx)
+		defer done()
+		return algoliaProcessor.Flush(ctx)
+	}, cfg.AlgoliaConfig.BatchSize, time.Duration(cfg.AlgoliaConfig.FlushTimeout)*time.Second)
 
-	redisProcessor := redis_processor_kafka.NewRedisProcessor(redisService)
+	return runKafkaConsumer(ctx, cfg, kafkaConfig, transcode, lifecycle, algoliaProcessor.Process, committer)
+}
 
-	processorInstance := processor.NewProcessor[*kafka.Message, redis_processor_kafka.Payload](driver, cfg.KafkaConfig.Topic, redisProcessor.Process)
+// runKafkaConsumer consumes until lifecycle stops receiving, handing each
+// message to handle. The driver only checks for that between messages, and
+// each message is handled on a detached context, so one already received is
+// handled and committed before it returns. transcode, if set, turns each
+// message into the JSON payload first. committer decides when offsets are
+// committed; nil commits each message once handled.
+func runKafkaConsumer[M any](
+	ctx context.Context,
+	cfg config.Config,
+	kafkaConfig kafkaClientConfig,
+	transcode func(ctx context.Context, msg *kafka.Message) ([]byte, error),
+	lifecycle *Lifecycle,
+	handle func(ctx context.Context, data event.Event[*kafka.Message, M]) (event.Event[*kafka.Message, M], error),
+	committer offsetCommitter,
+) error {
+	log := logger.FromCtx(ctx)
 
-	log.Info("initializing backoff retry middleware", zap.String("topic", cfg.KafkaConfig.Topic))
-	backoffRetryInstance := backoffretry.NewBackoffRetry[redis_processor_kafka.Payload](driver, backoffretry.Config{
-		MaxRetries: 3,
-		HeaderKey:  "retry",
-		RetryQueue: cfg.KafkaConfig.Topic + "-retry",
-	})
+	log.Info("Creating Kafka driver", zap.String("bootstrapServers", cfg.KafkaConfig.BootstrapServers))
+	driver := newKafkaDriver(kafkaConfig)
+	driver.committer = committer
+	driver.transcode = transcode
+	lifecycle.OnShutdown("kafka driver", driver.Close)
+
+	// Retried messages come back through the retry topic, so each consumer
+	// reads it too. Ones that can never be decoded skip the retries.
+	retry := newKafkaRetry[M](driver, cfg.KafkaConfig)
+	driver.alsoConsume = []string{RetryTopic(cfg.KafkaConfig)}
+	driver.undecodable = func(ctx context.Context, msg *kafka.Message, err error) error {
+		log.Error("Undecodable message; dead-lettered", zap.Error(err))
+		return deadLetterKafka(ctx, driver, DeadLetterTopic(cfg.KafkaConfig), msg, 0, err)
+	}
+
+	process := func(ctx context.Context, data event.Event[*kafka.Message, M]) (event.Event[*kafka.Message, M], error) {
+		metrics.MessagesConsumed.WithLabelValues("kafka").Inc()
+		ctx, done := lifecycle.Detach(ctx)
+		defer done()
+		ctx, span := startKafkaSpan(ctx, data.DriverMessage)
+		result, err := handle(ctx, data)
+		tracing.End(span, err)
+		return result, err
+	}
+	processorInstance := processor.NewProcessor[*kafka.Message, M](driver, cfg.KafkaConfig.Topic, process)
 
 	log.Info("Starting Kafka processor", zap.String("topic", cfg.KafkaConfig.Topic))
 	err := processorInstance.
-		AddMiddleware(backoffRetryInstance.Process).
-		Run(ctx)
+		AddMiddleware(retry.Process).
+		Run(lifecycle.Context())
 
-	if err != nil && ctx.Err() == nil { // Ignore error if caused by context cancellation
+	if err != nil && lifecycle.Context().Err() == nil { // Ignore error if caused by context cancellation
 		log.Error("Error consuming messages", zap.String("error", err.Error()))
 		return err
 	}
+	if err != nil {
+		// Whatever was left uncommitted is read again after the restart.
+		log.Warn("Error while stopping the consumer", zap.Error(err))
+	}
 
 	return nil
 }
+
+// startKafkaSpan starts the span for handling msg, continuing the trace in its
+// headers if the producer sent one.
+func startKafkaSpan(ctx context.Context, msg *kafka.Message) (context.Context, trace.Span) {
+	attributes := []attribute.KeyValue{semconv.MessagingSystemKafka}
+	if msg != nil {
+		if msg.TopicPartition.Topic != nil {
+			attributes = append(attributes, semconv.MessagingDestinationName(*msg.TopicPartition.Topic))
+		}
+		attributes = append(attributes,
+			semconv.MessagingKafkaDestinationPartition(int(msg.TopicPartition.Partition)),
+			semconv.MessagingKafkaMessageOffset(int(msg.TopicPartition.Offset)))
+	}
+	return tracing.Tracer().Start(tracing.ExtractKafka(ctx, msg), "kafka receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attributes...))
+}
+
+// checkTimeoutMs is what is left of ctx, for calls that take a timeout rather
+// than a context.
+func checkTimeoutMs(ctx context.Context) int {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 5000
+	}
+	return max(int(time.Until(deadline).Milliseconds()), 1)
+}
@@ -0,0 +1,164 @@
+package eventing
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// offsetStore is the part of a consumer that commits; *kafka.Consumer is one.
+type offsetStore interface {
+	CommitMessage(msg *kafka.Message) ([]kafka.TopicPartition, error)
+	CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error)
+}
+
+// offsetCommitter decides when the offsets of messages the handler is done
+// with are committed. The driver calls it from the goroutine that polls,
+// rebalances included, so it needs no lock.
+type offsetCommitter interface {
+	// handled is told of each message the handler is done with.
+	handled(ctx context.Context, consumer offsetStore, msg *kafka.Message) error
+	// idle is called when a poll brought no message.
+	idle(ctx context.Context, consumer offsetStore) error
+	// settle commits all it can, before the consumer's partitions are
+	// revoked and before it closes.
+	settle(ctx context.Context, consumer offsetStore) error
+}
+
+// commitEach commits a message as soon as the handler is done with it: by
+// then the buffered mode has it in the queue.
+type commitEach struct{}
+
+func (commitEach) handled(ctx context.Context, consumer offsetStore, msg *kafka.Message) error {
+	if _, err := consumer.CommitMessage(msg); err != nil {
+		return fmt.Errorf("commit error: %w", err)
+	}
+	return nil
+}
+
+func (commitEach) idle(ctx context.Context, consumer offsetStore) error { return nil }
+
+func (commitEach) settle(ctx context.Context, consumer offsetStore) error { return nil }
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+// commitAfterFlush holds offsets back until the writes of the messages before
+// them are flushed, for the streaming mode, where the handler only queues the
+// write in the batch. It flushes once maxMessages have been handled since the
+// last flush or the oldest of them has waited maxAge, whichever comes first,
+// and when the consumer settles.
+//
+// A flush that still fails after its retries stops the consumer with nothing
+// committed, so the messages are read again after the restart rather than
+// lost with the batch.
+type commitAfterFlush struct {
+	flush       func(ctx context.Context) error
+	maxMessages int
+	maxAge      time.Duration
+	// backoff paces the flush's retries.
+	backoff func() backoff.BackOff
+	now     func() time.Time
+
+	// pending is the offset to commit per partition: one past the last
+	// message handled.
+	pending map[partitionKey]kafka.Offset
+	count   int
+	oldest  time.Time
+}
+
+func newCommitAfterFlush(flush func(ctx context.Context) error, maxMessages int, maxAge time.Duration) *commitAfterFlush {
+	return &commitAfterFlush{
+		flush:       flush,
+		maxMessages: maxMessages,
+		maxAge:      maxAge,
+		backoff: func() backoff.BackOff {
+			return backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 5)
+		},
+		now:     time.Now,
+		pending: map[partitionKey]kafka.Offset{},
+	}
+}
+
+func (c *commitAfterFlush) handled(ctx context.Context, consumer offsetStore, msg *kafka.Message) error {
+	tp := msg.TopicPartition
+	if tp.Topic == nil {
+		return fmt.Errorf("message at offset %v has no topic", tp.Offset)
+	}
+	key := partitionKey{topic: *tp.Topic, partition: tp.Partition}
+	c.pending[key] = max(c.pending[key], tp.Offset+1)
+	if c.count == 0 {
+		c.oldest = c.now()
+	}
+	c.count++
+
+	// Age is checked here as well as when idle: a trickle of messages
+	// keeps the polls from ever coming back empty.
+	if !c.due() {
+		return nil
+	}
+	return c.commit(ctx, consumer)
+}
+
+func (c *commitAfterFlush) idle(ctx context.Context, consumer offsetStore) error {
+	if !c.due() {
+		return nil
+	}
+	return c.commit(ctx, consumer)
+}
+
+// due reports whether enough messages are pending, or the oldest has waited
+// long enough, to flush.
+func (c *commitAfterFlush) due() bool {
+	if c.count == 0 {
+		return false
+	}
+	if c.maxMessages > 0 && c.count >= c.maxMessages {
+		return true
+	}
+	return c.maxAge > 0 && c.now().Sub(c.oldest) >= c.maxAge
+}
+
+func (c *commitAfterFlush) settle(ctx context.Context, consumer offsetStore) error {
+	if c.count == 0 {
+		return nil
+	}
+	return c.commit(ctx, consumer)
+}
+
+// commit flushes and, once that succeeds, commits every pending offset.
+func (c *commitAfterFlush) commit(ctx context.Context, consumer offsetStore) error {
+	log := logger.FromCtx(ctx)
+
+	attempt := func() error {
+		err := c.flush(ctx)
+		if err != nil {
+			log.Warn("Flush to Algolia failed", zap.Error(err), zap.Int("messages", c.count))
+		}
+		return err
+	}
+	if err := backoff.Retry(attempt, backoff.WithContext(c.backoff(), ctx)); err != nil {
+		return fmt.Errorf("flushing %d messages to Algolia: %w", c.count, err)
+	}
+
+	offsets := make([]kafka.TopicPartition, 0, len(c.pending))
+	for key, offset := range c.pending {
+		topic := key.topic
+		offsets = append(offsets, kafka.TopicPartition{Topic: &topic, Partition: key.partition, Offset: offset})
+	}
+	if _, err := consumer.CommitOffsets(offsets); err != nil {
+		return fmt.Errorf("commit error: %w", err)
+	}
+
+	log.Info("Committed messages flushed to Algolia", zap.Int("messages", c.count))
+	c.pending = map[partitionKey]kafka.Offset{}
+	c.count = 0
+	return nil
+}
@@ -0,0 +1,157 @@
+package eventing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// fakeOffsets records the offsets committed to it.
+type fakeOffsets struct {
+	committed []kafka.TopicPartition
+}
+
+func (f *fakeOffsets) CommitMessage(msg *kafka.Message) ([]kafka.TopicPartition, error) {
+	tp := msg.TopicPartition
+	tp.Offset++
+	f.committed = append(f.committed, tp)
+	return nil, nil
+}
+
+func (f *fakeOffsets) CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	f.committed = append(f.committed, offsets...)
+	return offsets, nil
+}
+
+func (f *fakeOffsets) offset(topic string, partition int32) (kafka.Offset, bool) {
+	for i := len(f.committed) - 1; i >= 0; i-- {
+		tp := f.committed[i]
+		if *tp.Topic == topic && tp.Partition == partition {
+			return tp.Offset, true
+		}
+	}
+	return 0, false
+}
+
+func consumed(topic string, partition int32, offset kafka.Offset) *kafka.Message {
+	return &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: offset}}
+}
+
+// testCommitter flushes by calling flush, without waiting between retries.
+func testCommitter(flush func(ctx context.Context) error, maxMessages int, maxAge time.Duration) *commitAfterFlush {
+	c := newCommitAfterFlush(flush, maxMessages, maxAge)
+	c.backoff = func() backoff.BackOff {
+		return backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 2)
+	}
+	return c
+}
+
+func TestCommitAfterFlushCommitsOnlyOnceFlushed(t *testing.T) {
+	flushes := 0
+	committer := testCommitter(func(ctx context.Context) error {
+		flushes++
+		return nil
+	}, 3, 0)
+	consumer := &fakeOffsets{}
+	ctx := retryTestContext()
+
+	for _, msg := range []*kafka.Message{consumed("anime", 0, 10), consumed("anime", 1, 4)} {
+		if err := committer.handled(ctx, consumer, msg); err != nil {
+			t.Fatalf("handled: %v", err)
+		}
+	}
+	if flushes != 0 || len(consumer.committed) != 0 {
+		t.Fatalf("flushed %d times and committed %v before the batch was full", flushes, consumer.committed)
+	}
+
+	if err := committer.handled(ctx, consumer, consumed("anime", 0, 11)); err != nil {
+		t.Fatalf("handled: %v", err)
+	}
+	if flushes != 1 {
+		t.Fatalf("flushed %d times, want 1", flushes)
+	}
+	if got, _ := consumer.offset("anime", 0); got != 12 {
+		t.Errorf("partition 0 committed at %v, want 12", got)
+	}
+	if got, _ := consumer.offset("anime", 1); got != 5 {
+		t.Errorf("partition 1 committed at %v, want 5", got)
+	}
+}
+
+func TestCommitAfterFlushCommitsNothingWhenTheFlushFails(t *testing.T) {
+	attempts := 0
+	committer := testCommitter(func(ctx context.Context) error {
+		attempts++
+		return errors.New("algolia unreachable")
+	}, 1, 0)
+	consumer := &fakeOffsets{}
+
+	err := committer.handled(retryTestContext(), consumer, consumed("anime", 0, 10))
+	if err == nil {
+		t.Fatal("handled succeeded, so the consumer would carry on past writes Algolia never got")
+	}
+	if attempts != 3 {
+		t.Errorf("flush attempted %d times, want 3", attempts)
+	}
+	if len(consumer.committed) != 0 {
+		t.Errorf("committed %v, want nothing", consumer.committed)
+	}
+}
+
+func TestCommitAfterFlushFlushesOnAge(t *testing.T) {
+	committer := testCommitter(func(ctx context.Context) error { return nil }, 100, 10*time.Second)
+	now := time.Unix(1700000000, 0)
+	committer.now = func() time.Time { return now }
+	consumer := &fakeOffsets{}
+	ctx := retryTestContext()
+
+	if err := committer.handled(ctx, consumer, consumed("anime-retry", 0, 7)); err != nil {
+		t.Fatalf("handled: %v", err)
+	}
+	now = now.Add(9 * time.Second)
+	if err := committer.idle(ctx, consumer); err != nil {
+		t.Fatalf("idle: %v", err)
+	}
+	if len(consumer.committed) != 0 {
+		t.Fatalf("committed %v before the batch was due", consumer.committed)
+	}
+
+	now = now.Add(time.Second)
+	if err := committer.idle(ctx, consumer); err != nil {
+		t.Fatalf("idle: %v", err)
+	}
+	if got, ok := consumer.offset("anime-retry", 0); !ok || got != 8 {
+		t.Errorf("committed %v, want anime-retry[0] at 8", consumer.committed)
+	}
+}
+
+func TestCommitAfterFlushSettlesWhatIsPending(t *testing.T) {
+	flushes := 0
+	committer := testCommitter(func(ctx context.Context) error {
+		flushes++
+		return nil
+	}, 100, time.Hour)
+	consumer := &fakeOffsets{}
+	ctx := retryTestContext()
+
+	if err := committer.settle(ctx, consumer); err != nil {
+		t.Fatalf("settle: %v", err)
+	}
+	if flushes != 0 {
+		t.Errorf("flushed %d times with nothing pending", flushes)
+	}
+
+	if err := committer.handled(ctx, consumer, consumed("anime", 2, 0)); err != nil {
+		t.Fatalf("handled: %v", err)
+	}
+	if err := committer.settle(ctx, consumer); err != nil {
+		t.Fatalf("settle: %v", err)
+	}
+	if got, ok := consumer.offset("anime", 2); !ok || got != 1 {
+		t.Errorf("committed %v, want anime[2] at 1", consumer.committed)
+	}
+}
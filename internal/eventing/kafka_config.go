@@ -0,0 +1,160 @@
+package eventing
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	epKafka "github.com/ThatCatDev/ep/v2/drivers/kafka"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/weeb-vip/algolia-sync/config"
+)
+
+// Security protocols and SASL mechanisms KafkaConfig accepts.
+var (
+	kafkaSecurityProtocols = []string{"plaintext", "ssl", "sasl_plaintext", "sasl_ssl"}
+	kafkaSaslMechanisms    = []string{"PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512"}
+)
+
+// kafkaClientConfig is the librdkafka configuration every Kafka client here is
+// built from.
+type kafkaClientConfig struct {
+	// client is for the admin client and producer; consumer adds the group
+	// settings on top.
+	client   kafka.ConfigMap
+	consumer kafka.ConfigMap
+}
+
+// newKafkaClientConfig validates cfg and builds the client configuration from
+// it, so a mistake fails at startup rather than as a connection that never
+// comes up. What epKafka.KafkaConfig has fields for goes through it; TLS files
+// and overrides, which it has no room for, are added to what it produces.
+func newKafkaClientConfig(cfg config.KafkaConfig) (kafkaClientConfig, error) {
+	protocol := strings.ToLower(strings.TrimSpace(cfg.SecurityProtocol))
+	mechanism := strings.ToUpper(strings.TrimSpace(cfg.SaslMechanism))
+	if err := validateKafkaSecurity(cfg, protocol, mechanism); err != nil {
+		return kafkaClientConfig{}, err
+	}
+	overrides, err := parseKafkaOverrides(cfg.Overrides)
+	if err != nil {
+		return kafkaClientConfig{}, err
+	}
+
+	epConfig := epKafka.KafkaConfig{
+		ConsumerGroupName:       cfg.ConsumerGroupName,
+		BootstrapServers:        cfg.BootstrapServers,
+		SaslMechanism:           optional(mechanism),
+		SecurityProtocol:        optional(protocol),
+		Username:                optional(cfg.Username),
+		Password:                optional(cfg.Password),
+		ConsumerAutoOffsetReset: optional(cfg.Offset),
+		ClientID:                optional(cfg.ClientID),
+		Debug:                   optional(cfg.Debug),
+	}
+	if cfg.SessionTimeoutMs > 0 {
+		epConfig.ConsumerSessionTimeoutMs = &cfg.SessionTimeoutMs
+	}
+
+	clientConfig := kafkaClientConfig{
+		client:   *epKafka.GetKafkaConfig(epConfig),
+		consumer: *epKafka.GetKafkaConsumerConfig(epConfig),
+	}
+	for _, m := range []kafka.ConfigMap{clientConfig.client, clientConfig.consumer} {
+		setIfNotEmpty(m, "ssl.ca.location", cfg.SSLCAFile)
+		setIfNotEmpty(m, "ssl.certificate.location", cfg.SSLCertFile)
+		setIfNotEmpty(m, "ssl.key.location", cfg.SSLKeyFile)
+		setIfNotEmpty(m, "ssl.key.password", cfg.SSLKeyPassword)
+		for key, value := range overrides {
+			m[key] = value
+		}
+	}
+	return clientConfig, nil
+}
+
+func validateKafkaSecurity(cfg config.KafkaConfig, protocol, mechanism string) error {
+	if cfg.BootstrapServers == "" {
+		return fmt.Errorf("kafka: no bootstrap servers")
+	}
+	if protocol != "" && !slices.Contains(kafkaSecurityProtocols, protocol) {
+		return fmt.Errorf("kafka: unknown security protocol %q, want one of %s",
+			cfg.SecurityProtocol, strings.Join(kafkaSecurityProtocols, ", "))
+	}
+	if cfg.SessionTimeoutMs < 0 {
+		return fmt.Errorf("kafka: negative session timeout %d", cfg.SessionTimeoutMs)
+	}
+
+	sasl := strings.HasPrefix(protocol, "sasl_")
+	switch {
+	case mechanism != "" && !slices.Contains(kafkaSaslMechanisms, mechanism):
+		return fmt.Errorf("kafka: unknown SASL mechanism %q, want one of %s",
+			cfg.SaslMechanism, strings.Join(kafkaSaslMechanisms, ", "))
+	case mechanism != "" && !sasl:
+		return fmt.Errorf("kafka: SASL mechanism %s needs a sasl_plaintext or sasl_ssl security protocol", mechanism)
+	case sasl && mechanism == "":
+		return fmt.Errorf("kafka: security protocol %s needs a SASL mechanism", protocol)
+	case sasl && (cfg.Username == "" || cfg.Password == ""):
+		return fmt.Errorf("kafka: SASL needs both a username and a password")
+	case !sasl && (cfg.Username != "" || cfg.Password != ""):
+		return fmt.Errorf("kafka: a username or password needs a sasl_plaintext or sasl_ssl security protocol")
+	}
+
+	files := []struct{ name, path string }{
+		{"KAFKA_SSL_CA_FILE", cfg.SSLCAFile},
+		{"KAFKA_SSL_CERT_FILE", cfg.SSLCertFile},
+		{"KAFKA_SSL_KEY_FILE", cfg.SSLKeyFile},
+	}
+	tls := protocol == "ssl" || protocol == "sasl_ssl"
+	for _, file := range files {
+		if file.path == "" {
+			continue
+		}
+		if !tls {
+			return fmt.Errorf("kafka: %s needs an ssl or sasl_ssl security protocol", file.name)
+		}
+		// librdkafka would only say so on the first connection attempt, in
+		// its own log.
+		if _, err := os.Stat(file.path); err != nil {
+			return fmt.Errorf("kafka: %s: %w", file.name, err)
+		}
+	}
+	if (cfg.SSLCertFile == "") != (cfg.SSLKeyFile == "") {
+		return fmt.Errorf("kafka: a client certificate needs both KAFKA_SSL_CERT_FILE and KAFKA_SSL_KEY_FILE")
+	}
+	if cfg.SSLKeyPassword != "" && cfg.SSLKeyFile == "" {
+		return fmt.Errorf("kafka: KAFKA_SSL_KEY_PASSWORD is set without KAFKA_SSL_KEY_FILE")
+	}
+	return nil
+}
+
+// parseKafkaOverrides reads "key=value;key=value" into librdkafka properties.
+// Values stay strings; librdkafka parses them as it would its own config file.
+func parseKafkaOverrides(list string) (kafka.ConfigMap, error) {
+	overrides := kafka.ConfigMap{}
+	for _, pair := range strings.Split(list, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("kafka: override %q is not key=value", pair)
+		}
+		overrides[key] = strings.TrimSpace(value)
+	}
+	return overrides, nil
+}
+
+func optional(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+func setIfNotEmpty(m kafka.ConfigMap, key, value string) {
+	if value != "" {
+		m[key] = value
+	}
+}
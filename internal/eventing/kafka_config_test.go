@@ -0,0 +1,152 @@
+package eventing
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/weeb-vip/algolia-sync/config"
+)
+
+func baseKafkaConfig() config.KafkaConfig {
+	return config.KafkaConfig{
+		ConsumerGroupName: "algolia-sync",
+		BootstrapServers:  "broker:9092",
+		Offset:            "earliest",
+	}
+}
+
+func writePEM(t *testing.T, name string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte("-----BEGIN CERTIFICATE-----\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestKafkaClientConfigPassesSecuritySettingsThrough(t *testing.T) {
+	cfg := baseKafkaConfig()
+	cfg.SecurityProtocol = "SASL_SSL"
+	cfg.SaslMechanism = "scram-sha-512"
+	cfg.Username = "sync"
+	cfg.Password = "secret"
+	cfg.SSLCAFile = writePEM(t, "ca.pem")
+	cfg.SessionTimeoutMs = 45000
+	cfg.ClientID = "algolia-sync-1"
+
+	clientConfig, err := newKafkaClientConfig(cfg)
+	if err != nil {
+		t.Fatalf("newKafkaClientConfig: %v", err)
+	}
+
+	want := kafka.ConfigMap{
+		"bootstrap.servers": "broker:9092",
+		"security.protocol": "sasl_ssl",
+		"sasl.mechanisms":   "SCRAM-SHA-512",
+		"sasl.username":     "sync",
+		"sasl.password":     "secret",
+		"ssl.ca.location":   cfg.SSLCAFile,
+		"client.id":         "algolia-sync-1",
+	}
+	for key, value := range want {
+		if got := clientConfig.client[key]; got != value {
+			t.Errorf("client %s = %v, want %v", key, got, value)
+		}
+		if got := clientConfig.consumer[key]; got != value {
+			t.Errorf("consumer %s = %v, want %v", key, got, value)
+		}
+	}
+	if got := clientConfig.consumer["session.timeout.ms"]; got != 45000 {
+		t.Errorf("consumer session.timeout.ms = %v, want 45000", got)
+	}
+	if got := clientConfig.consumer["group.id"]; got != "algolia-sync" {
+		t.Errorf("consumer group.id = %v, want algolia-sync", got)
+	}
+	if _, ok := clientConfig.client["group.id"]; ok {
+		t.Errorf("client config has group.id, which only a consumer takes")
+	}
+}
+
+func TestKafkaClientConfigLeavesUnsetSettingsToLibrdkafka(t *testing.T) {
+	clientConfig, err := newKafkaClientConfig(baseKafkaConfig())
+	if err != nil {
+		t.Fatalf("newKafkaClientConfig: %v", err)
+	}
+	for _, key := range []string{"security.protocol", "sasl.mechanisms", "ssl.ca.location", "session.timeout.ms", "client.id", "debug"} {
+		if value, ok := clientConfig.consumer[key]; ok {
+			t.Errorf("consumer %s = %v, want it unset", key, value)
+		}
+	}
+}
+
+func TestKafkaClientConfigOverridesWin(t *testing.T) {
+	cfg := baseKafkaConfig()
+	cfg.ClientID = "from-field"
+	cfg.Overrides = "client.id=from-override; debug=consumer,cgrp ;fetch.max.bytes=1048576"
+
+	clientConfig, err := newKafkaClientConfig(cfg)
+	if err != nil {
+		t.Fatalf("newKafkaClientConfig: %v", err)
+	}
+	want := map[string]string{
+		"client.id":       "from-override",
+		"debug":           "consumer,cgrp",
+		"fetch.max.bytes": "1048576",
+	}
+	for key, value := range want {
+		if got := clientConfig.consumer[key]; got != value {
+			t.Errorf("consumer %s = %v, want %v", key, got, value)
+		}
+	}
+}
+
+func TestKafkaClientConfigRejectsInconsistentSettings(t *testing.T) {
+	cert := writePEM(t, "client.pem")
+	tests := map[string]func(cfg *config.KafkaConfig){
+		"no bootstrap servers": func(cfg *config.KafkaConfig) { cfg.BootstrapServers = "" },
+		"unknown protocol":     func(cfg *config.KafkaConfig) { cfg.SecurityProtocol = "tls" },
+		"unknown mechanism": func(cfg *config.KafkaConfig) {
+			cfg.SecurityProtocol, cfg.SaslMechanism = "sasl_ssl", "GSSAPI"
+			cfg.Username, cfg.Password = "sync", "secret"
+		},
+		"mechanism without sasl": func(cfg *config.KafkaConfig) {
+			cfg.SecurityProtocol, cfg.SaslMechanism = "ssl", "PLAIN"
+		},
+		"sasl without mechanism": func(cfg *config.KafkaConfig) {
+			cfg.SecurityProtocol = "sasl_plaintext"
+			cfg.Username, cfg.Password = "sync", "secret"
+		},
+		"sasl without password": func(cfg *config.KafkaConfig) {
+			cfg.SecurityProtocol, cfg.SaslMechanism, cfg.Username = "sasl_ssl", "PLAIN", "sync"
+		},
+		"credentials without sasl": func(cfg *config.KafkaConfig) {
+			cfg.Username, cfg.Password = "sync", "secret"
+		},
+		"ca file without tls": func(cfg *config.KafkaConfig) {
+			cfg.SecurityProtocol, cfg.SSLCAFile = "sasl_plaintext", cert
+			cfg.SaslMechanism, cfg.Username, cfg.Password = "PLAIN", "sync", "secret"
+		},
+		"missing ca file": func(cfg *config.KafkaConfig) {
+			cfg.SecurityProtocol, cfg.SSLCAFile = "ssl", filepath.Join(t.TempDir(), "absent.pem")
+		},
+		"certificate without key": func(cfg *config.KafkaConfig) {
+			cfg.SecurityProtocol, cfg.SSLCertFile = "ssl", cert
+		},
+		"key password without key": func(cfg *config.KafkaConfig) {
+			cfg.SecurityProtocol, cfg.SSLKeyPassword = "ssl", "secret"
+		},
+		"negative session timeout": func(cfg *config.KafkaConfig) { cfg.SessionTimeoutMs = -1 },
+		"override without value":   func(cfg *config.KafkaConfig) { cfg.Overrides = "fetch.max.bytes" },
+	}
+	for name, change := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := baseKafkaConfig()
+			change(&cfg)
+			if _, err := newKafkaClientConfig(cfg); err == nil {
+				t.Errorf("newKafkaClientConfig accepted %+v", cfg)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package eventing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ThatCatDev/ep/v2/event"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"github.com/weeb-vip/algolia-sync/internal/services/cloudevents"
+	"github.com/weeb-vip/algolia-sync/internal/services/schema_registry"
+	"go.uber.org/zap"
+)
+
+// kafkaDriver is ep's Kafka driver, built from a whole librdkafka
+// configuration. ep's own builds its clients from epKafka.KafkaConfig alone,
+// so the TLS files and overrides would never reach them. It behaves as ep's
+// does: the context is checked between messages, and a message is committed
+// once the handler returns without error, unless committer says otherwise.
+type kafkaDriver struct {
+	config kafkaClientConfig
+	// committer decides when handled messages are committed; nil commits
+	// each one at once.
+	committer offsetCommitter
+	// transcode, if set, turns each message into the JSON the handler
+	// decodes, for messages in another encoding or envelope.
+	transcode func(ctx context.Context, msg *kafka.Message) ([]byte, error)
+	// alsoConsume are topics Consume reads along with the one it is given.
+	alsoConsume []string
+	// undecodable, if set, takes a message the handler could not decode,
+	// which would fail the same way however often it was read, and the
+	// consumer carries on. Without it such a message stops the consumer, as
+	// it did with ep's driver.
+	undecodable func(ctx context.Context, msg *kafka.Message, err error) error
+
+	mu       sync.Mutex
+	producer *kafka.Producer
+}
+
+// missingTopicBackoff spaces out reads while a subscribed topic does not
+// exist. The read fails at once rather than after its timeout, so without a
+// pause the consumer spun on it, logging each time.
+const missingTopicBackoff = 5 * time.Second
+
+func newKafkaDriver(config kafkaClientConfig) *kafkaDriver {
+	return &kafkaDriver{config: config}
+}
+
+func (k *kafkaDriver) Consume(ctx context.Context, topic string, handler func(context.Context, *kafka.Message, []byte) error) error {
+	cfg := kafka.ConfigMap{}
+	for key, value := range k.config.consumer {
+		cfg[key] = value
+	}
+	cfg["enable.auto.commit"] = false
+
+	committer := k.committer
+	if committer == nil {
+		committer = commitEach{}
+	}
+
+	consumer, err := kafka.NewConsumer(&cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create consumer: %w", err)
+	}
+	defer consumer.Close()
+
+	// Offsets held back must be committed before the partitions go to
+	// another member, which would otherwise read their messages again. The
+	// callback runs inside ReadMessage, so its error is picked up after it.
+	var revokeErr error
+	rebalance := func(c *kafka.Consumer, e kafka.Event) error {
+		if _, ok := e.(kafka.RevokedPartitions); ok && revokeErr == nil {
+			revokeErr = committer.settle(context.WithoutCancel(ctx), c)
+		}
+		return nil
+	}
+	if err := consumer.SubscribeTopics(append([]string{topic}, k.alsoConsume...), rebalance); err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+
+	// topicMissing is set while reads fail on a missing topic, so that is
+	// logged once rather than on every read.
+	topicMissing := false
+	for {
+		select {
+		case <-ctx.Done():
+			// Messages already handled are settled even though receiving
+			// has stopped.
+			return committer.settle(context.WithoutCancel(ctx), consumer)
+		default:
+		}
+		msg, err := consumer.ReadMessage(time.Second)
+		if revokeErr != nil {
+			return revokeErr
+		}
+		if err != nil {
+			var kafkaErr kafka.Error
+			if errors.As(err, &kafkaErr) && (kafkaErr.IsRetriable() || kafkaErr.Code() == kafka.ErrTimedOut) {
+				if err := committer.idle(ctx, consumer); err != nil {
+					return err
+				}
+				continue
+			}
+			// A retry topic nobody has written to yet may not exist. The
+			// consumer picks it up once it does.
+			if errors.As(err, &kafkaErr) && kafkaErr.Code() == kafka.ErrUnknownTopicOrPart {
+				if !topicMissing {
+					logger.FromCtx(ctx).Warn("Subscribed topic not available yet; waiting for it", zap.Error(err))
+					topicMissing = true
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(missingTopicBackoff):
+				}
+				continue
+			}
+			return fmt.Errorf("read error: %w", err)
+		}
+		topicMissing = false
+		if msg == nil || msg.Value == nil {
+			continue
+		}
+		if err := k.handle(ctx, msg, handler); err != nil {
+			if k.undecodable == nil || !isDecodeError(err) {
+				return err
+			}
+			if err := k.undecodable(ctx, msg, err); err != nil {
+				return err
+			}
+		}
+		if err := committer.handled(ctx, consumer, msg); err != nil {
+			return err
+		}
+	}
+}
+
+// handle hands msg to handler, transcoded first if the driver is set to.
+func (k *kafkaDriver) handle(ctx context.Context, msg *kafka.Message, handler func(context.Context, *kafka.Message, []byte) error) error {
+	value := msg.Value
+	if k.transcode != nil {
+		var err error
+		if value, err = k.transcode(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return handler(ctx, msg, value)
+}
+
+// isDecodeError tells whether err is a payload that is not the JSON expected,
+// which ep's processor returns before any middleware sees the message, an
+// Avro message that cannot be decoded, or a CloudEvent that cannot be indexed.
+func isDecodeError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr) ||
+		errors.Is(err, schema_registry.ErrMalformed) || errors.Is(err, cloudevents.ErrInvalid)
+}
+
+// Produce sends message to topic and waits for the broker to take it. The
+// producer is created on first use; only the retry path produces.
+func (k *kafkaDriver) Produce(ctx context.Context, topic string, message *kafka.Message) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.producer == nil {
+		producer, err := kafka.NewProducer(&k.config.client)
+		if err != nil {
+			return fmt.Errorf("failed to create producer: %w", err)
+		}
+		k.producer = producer
+	}
+
+	delivery := make(chan kafka.Event, 1)
+	err := k.producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Value:          message.Value,
+		Headers:        message.Headers,
+		Key:            message.Key,
+	}, delivery)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case e := <-delivery:
+		if m, ok := e.(*kafka.Message); ok && m.TopicPartition.Error != nil {
+			return m.TopicPartition.Error
+		}
+		return nil
+	case <-ctx.Done():
+		// librdkafka still owns the message and delivers it, or reports the
+		// failure, on the buffered channel.
+		return ctx.Err()
+	}
+}
+
+func (k *kafkaDriver) CreateTopic(ctx context.Context, topic string) error {
+	admin, err := kafka.NewAdminClient(&k.config.client)
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	_, err = admin.CreateTopics(ctx, []kafka.TopicSpecification{{
+		Topic:             topic,
+		NumPartitions:     1,
+		ReplicationFactor: 1,
+	}})
+	return err
+}
+
+func (k *kafkaDriver) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.producer != nil {
+		k.producer.Flush(5000)
+		k.producer.Close()
+		k.producer = nil
+	}
+	return nil
+}
+
+// ExtractEvent is ep's: the headers as strings, and the message as generic
+// JSON.
+func (k *kafkaDriver) ExtractEvent(data *kafka.Message) (*event.SubData[*kafka.Message], error) {
+	eventData := &event.SubData[*kafka.Message]{
+		DriverMessage: data,
+		Headers:       map[string]string{},
+	}
+	for _, header := range data.Headers {
+		eventData.Headers[header.Key] = string(header.Value)
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(raw, &eventData.RawData)
+	return eventData, err
+}
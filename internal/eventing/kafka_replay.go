@@ -0,0 +1,172 @@
+package eventing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// replayPoll is how long the replay waits for each message.
+const replayPoll = time.Second
+
+// ReplayDeadLetters republishes what is on the dead-letter topic to the main
+// topic, with the retry count and dead-letter headers stripped so each message
+// starts afresh. It stops at the end the topic had when it began, so messages
+// that fail again and come back are left for another replay rather than
+// replayed in a loop, or after limit messages if limit is above zero.
+//
+// Progress is committed under a group of its own, one message at a time, so a
+// replay that is interrupted carries on where it stopped, and a message is
+// never replayed twice by runs that each finish.
+func ReplayDeadLetters(ctx context.Context, cfg config.KafkaConfig, limit int) (int, error) {
+	log := logger.FromCtx(ctx)
+	deadLetterTopic := DeadLetterTopic(cfg)
+
+	clientConfig, err := newKafkaClientConfig(cfg)
+	if err != nil {
+		return 0, err
+	}
+	consumerConfig := kafka.ConfigMap{}
+	for key, value := range clientConfig.consumer {
+		consumerConfig[key] = value
+	}
+	consumerConfig["group.id"] = cfg.ConsumerGroupName + "-dlq-replay"
+	consumerConfig["enable.auto.commit"] = false
+	consumerConfig["auto.offset.reset"] = "earliest"
+
+	consumer, err := kafka.NewConsumer(&consumerConfig)
+	if err != nil {
+		return 0, err
+	}
+	defer consumer.Close()
+	producer := newKafkaDriver(clientConfig)
+	defer producer.Close()
+
+	remaining, err := replayEnds(consumer, deadLetterTopic)
+	if err != nil {
+		return 0, err
+	}
+	if len(remaining) == 0 {
+		log.Info("Nothing to replay", zap.String("topic", deadLetterTopic))
+		return 0, nil
+	}
+
+	replayed := 0
+	for len(remaining) > 0 && (limit <= 0 || replayed < limit) {
+		if err := ctx.Err(); err != nil {
+			return replayed, err
+		}
+		msg, err := consumer.ReadMessage(replayPoll)
+		if err != nil {
+			var kafkaErr kafka.Error
+			if errors.As(err, &kafkaErr) && (kafkaErr.IsRetriable() || kafkaErr.Code() == kafka.ErrTimedOut) {
+				// Offsets left by compaction or transaction markers are
+				// never read; the position says whether they were the last.
+				if err := dropReached(consumer, remaining); err != nil {
+					return replayed, err
+				}
+				continue
+			}
+			return replayed, err
+		}
+
+		partition := msg.TopicPartition.Partition
+		end, ok := remaining[partition]
+		if !ok || msg.TopicPartition.Offset >= end {
+			// Dead-lettered after the replay began.
+			delete(remaining, partition)
+			continue
+		}
+
+		replay := &kafka.Message{
+			Key:     msg.Key,
+			Value:   msg.Value,
+			Headers: withoutRetryHeaders(msg.Headers),
+		}
+		if err := producer.Produce(ctx, cfg.Topic, replay); err != nil {
+			return replayed, fmt.Errorf("republishing offset %v of %s: %w", msg.TopicPartition.Offset, deadLetterTopic, err)
+		}
+		if _, err := consumer.CommitMessage(msg); err != nil {
+			return replayed, err
+		}
+		replayed++
+		if msg.TopicPartition.Offset+1 >= end {
+			delete(remaining, partition)
+		}
+	}
+
+	log.Info("Replayed dead-lettered messages",
+		zap.Int("count", replayed), zap.String("from", deadLetterTopic), zap.String("to", cfg.Topic))
+	return replayed, nil
+}
+
+// replayEnds assigns consumer every partition of topic that has messages past
+// the group's committed offset, and returns the offset each one ends at now.
+func replayEnds(consumer *kafka.Consumer, topic string) (map[int32]kafka.Offset, error) {
+	metadata, err := consumer.GetMetadata(&topic, false, 10000)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := metadata.Topics[topic]
+	if !ok {
+		return nil, fmt.Errorf("no metadata for topic %s", topic)
+	}
+	if meta.Error.Code() != kafka.ErrNoError {
+		return nil, fmt.Errorf("topic %s: %w", topic, meta.Error)
+	}
+
+	partitions := make([]kafka.TopicPartition, 0, len(meta.Partitions))
+	for _, p := range meta.Partitions {
+		partitions = append(partitions, kafka.TopicPartition{Topic: &topic, Partition: p.ID})
+	}
+	committed, err := consumer.Committed(partitions, 10000)
+	if err != nil {
+		return nil, err
+	}
+
+	ends := map[int32]kafka.Offset{}
+	var assign []kafka.TopicPartition
+	for _, tp := range committed {
+		low, high, err := consumer.QueryWatermarkOffsets(topic, tp.Partition, 10000)
+		if err != nil {
+			return nil, err
+		}
+		start := kafka.Offset(low)
+		if tp.Offset >= 0 {
+			start = max(tp.Offset, start)
+		}
+		if start >= kafka.Offset(high) {
+			continue
+		}
+		ends[tp.Partition] = kafka.Offset(high)
+		assign = append(assign, kafka.TopicPartition{Topic: &topic, Partition: tp.Partition, Offset: start})
+	}
+	if len(assign) == 0 {
+		return ends, nil
+	}
+	return ends, consumer.Assign(assign)
+}
+
+// dropReached removes the partitions whose position has reached their end.
+func dropReached(consumer *kafka.Consumer, remaining map[int32]kafka.Offset) error {
+	assigned, err := consumer.Assignment()
+	if err != nil {
+		return err
+	}
+	positions, err := consumer.Position(assigned)
+	if err != nil {
+		return err
+	}
+	for _, tp := range positions {
+		if end, ok := remaining[tp.Partition]; ok && tp.Offset >= 0 && tp.Offset >= end {
+			delete(remaining, tp.Partition)
+		}
+	}
+	return nil
+}
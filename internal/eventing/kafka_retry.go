@@ -0,0 +1,213 @@
+package eventing
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThatCatDev/ep/v2/event"
+	"github.com/ThatCatDev/ep/v2/middleware"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"github.com/weeb-vip/algolia-sync/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// Headers the retry path adds. retryHeader is the one ep's backoff retry
+// used, so messages it already put on the retry topic keep their count.
+const (
+	retryHeader = "retry"
+	// deadLetterHeaderPrefix marks the headers saying why a message was
+	// dead-lettered; replay-dlq strips them.
+	deadLetterHeaderPrefix    = "dlq-"
+	deadLetterErrorHeader     = deadLetterHeaderPrefix + "error"
+	deadLetterFailedAtHeader  = deadLetterHeaderPrefix + "failed-at"
+	deadLetterRetriesHeader   = deadLetterHeaderPrefix + "retries"
+	deadLetterTopicHeader     = deadLetterHeaderPrefix + "source-topic"
+	deadLetterPartitionHeader = deadLetterHeaderPrefix + "source-partition"
+	deadLetterOffsetHeader    = deadLetterHeaderPrefix + "source-offset"
+)
+
+// RetryTopic is where messages to be tried again go.
+func RetryTopic(cfg config.KafkaConfig) string {
+	if cfg.RetryTopic != "" {
+		return cfg.RetryTopic
+	}
+	return cfg.Topic + "-retry"
+}
+
+// DeadLetterTopic is where messages that are given up on go.
+func DeadLetterTopic(cfg config.KafkaConfig) string {
+	if cfg.DeadLetterTopic != "" {
+		return cfg.DeadLetterTopic
+	}
+	return cfg.Topic + "-dlq"
+}
+
+type kafkaProducer interface {
+	Produce(ctx context.Context, topic string, message *kafka.Message) error
+}
+
+// kafkaRetry sends a message that failed to the retry topic, after a backoff,
+// until it has been retried MaxRetries times, and then to the dead-letter
+// topic. It replaces ep's backoff retry, which had the count and topic fixed
+// and, after the last retry, dropped the message without a trace.
+//
+// A message is only committed once it is on one topic or the other: if
+// neither takes it, the error stops the consumer and the message is read
+// again after the restart.
+type kafkaRetry[M any] struct {
+	producer        kafkaProducer
+	retryTopic      string
+	deadLetterTopic string
+	maxRetries      int
+	backoff         time.Duration
+	maxBackoff      time.Duration
+}
+
+func newKafkaRetry[M any](producer kafkaProducer, cfg config.KafkaConfig) *kafkaRetry[M] {
+	return &kafkaRetry[M]{
+		producer:        producer,
+		retryTopic:      RetryTopic(cfg),
+		deadLetterTopic: DeadLetterTopic(cfg),
+		maxRetries:      max(cfg.MaxRetries, 0),
+		backoff:         time.Duration(max(cfg.RetryBackoffMs, 0)) * time.Millisecond,
+		maxBackoff:      time.Duration(max(cfg.RetryBackoffMaxMs, 0)) * time.Millisecond,
+	}
+}
+
+func (r *kafkaRetry[M]) Process(
+	ctx context.Context,
+	data event.Event[*kafka.Message, M],
+	next middleware.Handler[*kafka.Message, M],
+) (*event.Event[*kafka.Message, M], error) {
+	result, err := next(ctx, data)
+	if err == nil {
+		return result, nil
+	}
+	return &data, r.handleFailure(ctx, data.DriverMessage, err)
+}
+
+// handleFailure moves msg on after it failed with cause.
+func (r *kafkaRetry[M]) handleFailure(ctx context.Context, msg *kafka.Message, cause error) error {
+	log := logger.FromCtx(ctx)
+	retries, err := retryCount(msg)
+	if err != nil {
+		// A count that cannot be read is no reason to loop forever.
+		log.Warn("Unreadable retry count; dead-lettering the message", zap.Error(err))
+		retries = r.maxRetries
+	}
+
+	if retries < r.maxRetries {
+		r.wait(ctx, retries)
+		// Sent even when shutting down: the wait is cut short, but the
+		// message must still land somewhere before it is committed.
+		retry := &kafka.Message{
+			Key:     msg.Key,
+			Value:   msg.Value,
+			Headers: withHeader(msg.Headers, retryHeader, strconv.Itoa(retries+1)),
+		}
+		if err := r.producer.Produce(context.WithoutCancel(ctx), r.retryTopic, retry); err != nil {
+			return fmt.Errorf("sending to retry topic %s: %w (after: %v)", r.retryTopic, err, cause)
+		}
+		metrics.MessagesRetried.WithLabelValues("kafka").Inc()
+		log.Warn("Message failed; sent to be retried",
+			zap.Error(cause), zap.Int("retry", retries+1), zap.String("topic", r.retryTopic))
+		return nil
+	}
+
+	if err := deadLetterKafka(ctx, r.producer, r.deadLetterTopic, msg, retries, cause); err != nil {
+		return err
+	}
+	log.Error("Message failed for the last time; dead-lettered",
+		zap.Error(cause), zap.Int("retries", retries), zap.String("topic", r.deadLetterTopic))
+	return nil
+}
+
+// wait is the backoff before the given retry: the base doubled per earlier
+// retry, capped unless the cap is zero. It blocks the partition, as ep's did.
+func (r *kafkaRetry[M]) wait(ctx context.Context, retries int) {
+	delay := r.backoff
+	for i := 0; i < retries && (r.maxBackoff <= 0 || delay < r.maxBackoff); i++ {
+		delay *= 2
+	}
+	if r.maxBackoff > 0 {
+		delay = min(delay, r.maxBackoff)
+	}
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// deadLetterKafka sends msg, its payload and headers as they were, to topic,
+// with headers saying why.
+func deadLetterKafka(ctx context.Context, producer kafkaProducer, topic string, msg *kafka.Message, retries int, cause error) error {
+	headers := withHeader(msg.Headers, deadLetterErrorHeader, cause.Error())
+	headers = withHeader(headers, deadLetterFailedAtHeader, time.Now().UTC().Format(time.RFC3339))
+	headers = withHeader(headers, deadLetterRetriesHeader, strconv.Itoa(retries))
+	if source := msg.TopicPartition.Topic; source != nil {
+		headers = withHeader(headers, deadLetterTopicHeader, *source)
+	}
+	headers = withHeader(headers, deadLetterPartitionHeader, strconv.Itoa(int(msg.TopicPartition.Partition)))
+	headers = withHeader(headers, deadLetterOffsetHeader, msg.TopicPartition.Offset.String())
+
+	letter := &kafka.Message{Key: msg.Key, Value: msg.Value, Headers: headers}
+	if err := producer.Produce(context.WithoutCancel(ctx), topic, letter); err != nil {
+		return fmt.Errorf("sending to dead-letter topic %s: %w (after: %v)", topic, err, cause)
+	}
+	metrics.MessagesDeadLettered.WithLabelValues("kafka").Inc()
+	return nil
+}
+
+func retryCount(msg *kafka.Message) (int, error) {
+	value, ok := header(msg.Headers, retryHeader)
+	if !ok || value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// header is the last value of key, as a producer that sets a header again
+// appends it.
+func header(headers []kafka.Header, key string) (string, bool) {
+	for i := len(headers) - 1; i >= 0; i-- {
+		if headers[i].Key == key {
+			return string(headers[i].Value), true
+		}
+	}
+	return "", false
+}
+
+// withHeader returns a copy of headers with key set to value, in place of any
+// value it had.
+func withHeader(headers []kafka.Header, key, value string) []kafka.Header {
+	out := make([]kafka.Header, 0, len(headers)+1)
+	for _, h := range headers {
+		if h.Key != key {
+			out = append(out, h)
+		}
+	}
+	return append(out, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+// withoutRetryHeaders returns a copy of headers without the retry count and
+// dead-letter details, so a replayed message starts afresh.
+func withoutRetryHeaders(headers []kafka.Header) []kafka.Header {
+	out := make([]kafka.Header, 0, len(headers))
+	for _, h := range headers {
+		if h.Key == retryHeader || strings.HasPrefix(h.Key, deadLetterHeaderPrefix) {
+			continue
+		}
+		out = append(out, h)
+	}
+	return out
+}
@@ -0,0 +1,152 @@
+package eventing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ThatCatDev/ep/v2/event"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+)
+
+type produced struct {
+	topic string
+	msg   *kafka.Message
+}
+
+// fakeProducer records what it is given, and fails if err is set.
+type fakeProducer struct {
+	sent []produced
+	err  error
+}
+
+func (p *fakeProducer) Produce(ctx context.Context, topic string, message *kafka.Message) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.sent = append(p.sent, produced{topic: topic, msg: message})
+	return nil
+}
+
+func retryTestConfig() config.KafkaConfig {
+	return config.KafkaConfig{Topic: "anime", MaxRetries: 2}
+}
+
+func failedMessage(headers ...kafka.Header) event.Event[*kafka.Message, string] {
+	topic := "anime"
+	return event.Event[*kafka.Message, string]{
+		DriverMessage: &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 3, Offset: 42},
+			Key:            []byte("anime-1"),
+			Value:          []byte(`{"action":"update"}`),
+			Headers:        headers,
+		},
+	}
+}
+
+func failing(err error) func(context.Context, event.Event[*kafka.Message, string]) (*event.Event[*kafka.Message, string], error) {
+	return func(ctx context.Context, data event.Event[*kafka.Message, string]) (*event.Event[*kafka.Message, string], error) {
+		return &data, err
+	}
+}
+
+func retryTestContext() context.Context {
+	return logger.WithCtx(context.Background(), logger.Get())
+}
+
+func TestKafkaRetrySendsAFailedMessageToTheRetryTopic(t *testing.T) {
+	producer := &fakeProducer{}
+	retry := newKafkaRetry[string](producer, retryTestConfig())
+	traceparent := kafka.Header{Key: "traceparent", Value: []byte("00-abc-def-01")}
+
+	_, err := retry.Process(retryTestContext(), failedMessage(traceparent), failing(errors.New("redis down")))
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+
+	if len(producer.sent) != 1 || producer.sent[0].topic != "anime-retry" {
+		t.Fatalf("sent %+v, want one message to anime-retry", producer.sent)
+	}
+	msg := producer.sent[0].msg
+	if got, _ := header(msg.Headers, retryHeader); got != "1" {
+		t.Errorf("retry header = %q, want 1", got)
+	}
+	if got, _ := header(msg.Headers, "traceparent"); got != "00-abc-def-01" {
+		t.Errorf("traceparent = %q, want it kept", got)
+	}
+	if string(msg.Value) != `{"action":"update"}` || string(msg.Key) != "anime-1" {
+		t.Errorf("retried %q/%q, want the original key and payload", msg.Key, msg.Value)
+	}
+}
+
+func TestKafkaRetryDeadLettersAfterTheLastRetry(t *testing.T) {
+	producer := &fakeProducer{}
+	cfg := retryTestConfig()
+	cfg.DeadLetterTopic = "anime-dead"
+	retry := newKafkaRetry[string](producer, cfg)
+
+	data := failedMessage(kafka.Header{Key: retryHeader, Value: []byte("2")})
+	if _, err := retry.Process(retryTestContext(), data, failing(errors.New("unknown action"))); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+
+	if len(producer.sent) != 1 || producer.sent[0].topic != "anime-dead" {
+		t.Fatalf("sent %+v, want one message to anime-dead", producer.sent)
+	}
+	msg := producer.sent[0].msg
+	if string(msg.Value) != `{"action":"update"}` {
+		t.Errorf("dead-lettered payload %q, want the original", msg.Value)
+	}
+	want := map[string]string{
+		deadLetterErrorHeader:     "unknown action",
+		deadLetterRetriesHeader:   "2",
+		deadLetterTopicHeader:     "anime",
+		deadLetterPartitionHeader: "3",
+		deadLetterOffsetHeader:    "42",
+	}
+	for key, value := range want {
+		if got, _ := header(msg.Headers, key); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+	if got, ok := header(msg.Headers, deadLetterFailedAtHeader); !ok || got == "" {
+		t.Errorf("%s missing", deadLetterFailedAtHeader)
+	}
+}
+
+func TestKafkaRetryFailsWhenNeitherTopicTakesTheMessage(t *testing.T) {
+	producer := &fakeProducer{err: errors.New("broker unreachable")}
+	retry := newKafkaRetry[string](producer, retryTestConfig())
+
+	_, err := retry.Process(retryTestContext(), failedMessage(), failing(errors.New("redis down")))
+	if err == nil {
+		t.Fatal("Process succeeded, so the message would be committed and lost")
+	}
+}
+
+func TestKafkaRetryPassesSuccessThrough(t *testing.T) {
+	producer := &fakeProducer{}
+	retry := newKafkaRetry[string](producer, retryTestConfig())
+
+	if _, err := retry.Process(retryTestContext(), failedMessage(), failing(nil)); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if len(producer.sent) != 0 {
+		t.Errorf("sent %+v, want nothing", producer.sent)
+	}
+}
+
+func TestReplayStartsDeadLettersAfresh(t *testing.T) {
+	headers := []kafka.Header{
+		{Key: "traceparent", Value: []byte("00-abc-def-01")},
+		{Key: retryHeader, Value: []byte("3")},
+		{Key: deadLetterErrorHeader, Value: []byte("unknown action")},
+		{Key: deadLetterOffsetHeader, Value: []byte("42")},
+	}
+	got := withoutRetryHeaders(headers)
+	if len(got) != 1 || got[0].Key != "traceparent" {
+		t.Errorf("withoutRetryHeaders = %v, want only traceparent", got)
+	}
+}
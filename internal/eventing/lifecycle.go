@@ -0,0 +1,178 @@
+package eventing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Lifecycle takes a consumer from running to stopped in order.
+//
+// Both consumers used to run on context.Background() until the process was
+// killed: a deploy cut messages off mid-write, Redis writes still buffered
+// were lost with the process, and a receive error ended it with log.Fatal,
+// skipping every deferred Close. Now SIGINT or SIGTERM stops receiving, lets
+// the messages already received finish for up to the drain timeout, and then
+// runs the shutdown hooks, newest first, so whatever is closed last was
+// opened first.
+//
+// A second signal is not trapped and kills the process as it always did.
+type Lifecycle struct {
+	// stopped is done once the consumer should stop receiving.
+	stopped context.Context
+	stop    context.CancelFunc
+	// working is done once in-flight messages should be abandoned: the drain
+	// timeout after stopped, or at Shutdown.
+	working context.Context
+	abandon context.CancelFunc
+	drain   time.Duration
+
+	mu    sync.Mutex
+	hooks []shutdownHook
+	done  bool
+
+	running  sync.WaitGroup
+	errOnce  sync.Once
+	firstErr error
+}
+
+// Checks takes the readiness checks of what a consumer connects to;
+// server.Server is one.
+type Checks interface {
+	AddCheck(name string, check func(ctx context.Context) error)
+}
+
+type shutdownHook struct {
+	name string
+	fn   func() error
+}
+
+func NewLifecycle(ctx context.Context, drain time.Duration) *Lifecycle {
+	signalled, stopSignals := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	stopped, stop := context.WithCancel(signalled)
+	working, abandon := context.WithCancel(context.WithoutCancel(ctx))
+
+	l := &Lifecycle{
+		stopped: stopped,
+		stop:    stop,
+		working: working,
+		abandon: abandon,
+		drain:   drain,
+	}
+	go func() {
+		<-stopped.Done()
+		stopSignals()
+		if signalled.Err() != nil && ctx.Err() == nil {
+			logger.FromCtx(ctx).Info("shutting down", zap.Duration("drain", drain))
+		}
+		timer := time.NewTimer(drain)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			logger.FromCtx(ctx).Warn("drain timed out, abandoning in-flight messages")
+			abandon()
+		case <-working.Done():
+		}
+	}()
+	return l
+}
+
+// Context is done once the consumer should stop receiving.
+func (l *Lifecycle) Context() context.Context {
+	return l.stopped
+}
+
+// Stop begins shutting down as a signal would, for a consumer that cannot go
+// on.
+func (l *Lifecycle) Stop() {
+	l.stop()
+}
+
+// Detach returns ctx for handling one message: it keeps ctx's values but is
+// cancelled only when draining gives up, not when receiving stops. A message
+// received just before a signal is written through rather than abandoned
+// half way.
+func (l *Lifecycle) Detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	unhook := context.AfterFunc(l.working, cancel)
+	return detached, func() {
+		unhook()
+		cancel()
+	}
+}
+
+// Go runs fn alongside whatever else the process runs. The first fn to fail
+// stops the rest, as one failing consumer always took the process down rather
+// than leaving its share of the work undone.
+func (l *Lifecycle) Go(name string, fn func() error) {
+	l.running.Add(1)
+	go func() {
+		defer l.running.Done()
+		if err := fn(); err != nil {
+			l.Fail(name, err)
+		}
+	}()
+}
+
+// Fail stops the process with err, for something that runs outside Go.
+func (l *Lifecycle) Fail(name string, err error) {
+	l.errOnce.Do(func() { l.firstErr = fmt.Errorf("%s: %w", name, err) })
+	l.Stop()
+}
+
+// Wait waits for everything started with Go and returns the first failure.
+func (l *Lifecycle) Wait() error {
+	l.running.Wait()
+	return l.firstErr
+}
+
+// Finish waits for everything started with Go, then shuts down. startErr is a
+// failure while starting, which stops whatever had already started.
+func (l *Lifecycle) Finish(ctx context.Context, startErr error) error {
+	if startErr != nil {
+		l.Stop()
+	}
+	return errors.Join(startErr, l.Wait(), l.Shutdown(ctx))
+}
+
+// OnShutdown registers fn to run at Shutdown. Hooks run newest first.
+func (l *Lifecycle) OnShutdown(name string, fn func() error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, shutdownHook{name: name, fn: fn})
+}
+
+// Shutdown runs the hooks and reports every one that failed. Call it once the
+// consumer has stopped receiving and its in-flight messages are done.
+func (l *Lifecycle) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	if l.done {
+		l.mu.Unlock()
+		return nil
+	}
+	l.done = true
+	hooks := l.hooks
+	l.mu.Unlock()
+
+	l.stop()
+	defer l.abandon()
+
+	log := logger.FromCtx(ctx)
+	var errs []error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].fn(); err != nil {
+			log.Error("shutdown step failed", zap.String("step", hooks[i].name), zap.Error(err))
+			errs = append(errs, fmt.Errorf("%s: %w", hooks[i].name, err))
+			continue
+		}
+		log.Info("shutdown step done", zap.String("step", hooks[i].name))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,62 @@
+package eventing
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownRunsHooksNewestFirst(t *testing.T) {
+	ctx := context.Background()
+	lifecycle := NewLifecycle(ctx, time.Second)
+
+	var order []string
+	hook := func(name string, err error) {
+		lifecycle.OnShutdown(name, func() error {
+			order = append(order, name)
+			return err
+		})
+	}
+	hook("queue", nil)
+	hook("client", errors.New("refused"))
+	hook("consumer", nil)
+
+	err := lifecycle.Shutdown(ctx)
+	if got := strings.Join(order, ","); got != "consumer,client,queue" {
+		t.Errorf("expected hooks in reverse order, got %s", got)
+	}
+	if err == nil || !strings.Contains(err.Error(), "client: refused") {
+		t.Errorf("expected the failing hook reported, got %v", err)
+	}
+	if lifecycle.Context().Err() == nil {
+		t.Error("shutting down should stop receiving")
+	}
+	if err := lifecycle.Shutdown(ctx); err != nil {
+		t.Errorf("a second Shutdown should do nothing, got %v", err)
+	}
+}
+
+func TestDetachedMessagesOutliveStopUntilTheDrainTimeout(t *testing.T) {
+	ctx := context.Background()
+	lifecycle := NewLifecycle(ctx, 50*time.Millisecond)
+	defer lifecycle.Shutdown(ctx)
+
+	msgCtx, done := lifecycle.Detach(lifecycle.Context())
+	defer done()
+
+	lifecycle.Stop()
+	if lifecycle.Context().Err() == nil {
+		t.Fatal("Stop should stop receiving")
+	}
+	if msgCtx.Err() != nil {
+		t.Fatal("a message in flight should not be cancelled by Stop")
+	}
+
+	select {
+	case <-msgCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("a message still in flight after the drain timeout should be cancelled")
+	}
+}
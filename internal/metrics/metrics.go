@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Stages a failure is counted against.
+const (
+	// QueueStage is storing a consumed item on the queue.
+	QueueStage = "queue"
+	// AlgoliaStage is sending queued items to Algolia.
+	AlgoliaStage = "algolia"
+)
+
+// Algolia operations.
+const (
+	SaveOperation   = "save"
+	DeleteOperation = "delete"
+)
+
+var (
+	MessagesConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "algolia_sync",
+		Name:      "messages_consumed_total",
+		Help:      "Messages received from an event source.",
+	}, []string{"source"})
+
+	MessagesRetried = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "algolia_sync",
+		Name:      "messages_retried_total",
+		Help:      "Messages that failed and were sent to be tried again.",
+	}, []string{"source"})
+
+	MessagesDeadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "algolia_sync",
+		Name:      "messages_dead_lettered_total",
+		Help:      "Messages given up on and sent to the dead-letter topic.",
+	}, []string{"source"})
+
+	MessagesDuplicate = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "algolia_sync",
+		Name:      "messages_duplicate_total",
+		Help:      "Messages already queued once, acknowledged without queueing them again.",
+	}, []string{"source"})
+
+	ItemsQueued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "algolia_sync",
+		Name:      "items_queued_total",
+		Help:      "Items stored on the queue, by action.",
+	}, []string{"action"})
+
+	ItemsStale = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "algolia_sync",
+		Name:      "items_stale_total",
+		Help:      "Queued items dropped as older than what was already sent to Algolia, by action.",
+	}, []string{"action"})
+
+	AlgoliaObjects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "algolia_sync",
+		Name:      "algolia_objects_total",
+		Help:      "Objects Algolia accepted, by operation.",
+	}, []string{"operation"})
+
+	Failures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "algolia_sync",
+		Name:      "failures_total",
+		Help:      "Items that failed, by stage and action.",
+	}, []string{"stage", "action"})
+
+	AlgoliaFlushSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "algolia_sync",
+		Name:      "algolia_flush_seconds",
+		Help:      "Time for one batch request to Algolia, by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"operation"})
+
+	RedisFlushSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "algolia_sync",
+		Name:      "redis_flush_seconds",
+		Help:      "Time for one pipeline of queued writes to Redis.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+	})
+)
+
+// WatchQueueDepth exports depth as algolia_sync_queue_depth, read afresh at
+// every scrape. A scrape that cannot read it reports NaN rather than a stale
+// count.
+func WatchQueueDepth(queue string, depth func(ctx context.Context) (int64, error)) error {
+	gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   "algolia_sync",
+		Name:        "queue_depth",
+		Help:        "Items waiting to reach Algolia, including a claimed batch.",
+		ConstLabels: prometheus.Labels{"queue": queue},
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		n, err := depth(ctx)
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(n)
+	})
+	err := prometheus.Register(gauge)
+	if errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+		return nil
+	}
+	return err
+}
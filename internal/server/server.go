@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Server is the HTTP listener the serve command runs beside its consumers.
+// Routes are added before Start; checks at any time.
+//
+// /healthz answers while the process runs, for a liveness probe. /readyz runs
+// every check and fails if any does, so a broken dependency takes the pod out
+// of service without restarting it. /metrics is Prometheus.
+type Server struct {
+	addr string
+	mux  *http.ServeMux
+	http *http.Server
+
+	mu     sync.Mutex
+	checks []check
+}
+
+type check struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// checkTimeout bounds each readiness check, so one hung dependency does not
+// hang the probe.
+const checkTimeout = 2 * time.Second
+
+func New(appCfg config.AppConfig) *Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s\n", appCfg.APPName, appCfg.Version)
+	})
+	s := &Server{
+		addr: fmt.Sprintf(":%d", appCfg.Port),
+		mux:  mux,
+		http: &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /readyz", s.ready)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	return s
+}
+
+// AddCheck adds a readiness check. It is called on every /readyz. A name
+// added again replaces its check, so everything that needs the same
+// dependency can add it.
+func (s *Server) AddCheck(name string, fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.checks {
+		if s.checks[i].name == name {
+			s.checks[i].fn = fn
+			return
+		}
+	}
+	s.checks = append(s.checks, check{name: name, fn: fn})
+}
+
+func (s *Server) ready(w http.ResponseWriter, r *http.Request) {
+	failures := s.runChecks(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	status := "ok"
+	if len(failures) > 0 {
+		status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(struct {
+		Status string            `json:"status"`
+		Failed map[string]string `json:"failed,omitempty"`
+	}{Status: status, Failed: failures})
+}
+
+// runChecks runs the checks at once and returns the failures by name.
+func (s *Server) runChecks(ctx context.Context) map[string]string {
+	s.mu.Lock()
+	checks := s.checks
+	s.mu.Unlock()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		failures = map[string]string{}
+	)
+	for _, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+			if err := c.fn(ctx); err != nil {
+				mu.Lock()
+				failures[c.name] = err.Error()
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return failures
+}
+
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Start binds the port, so a port already in use fails here rather than later
+// in the background, then serves until Shutdown. A listener that fails after
+// that calls onErr.
+func (s *Server) Start(ctx context.Context, onErr func(error)) error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	logger.FromCtx(ctx).Info("HTTP listener started", zap.String("addr", listener.Addr().String()))
+	go func() {
+		if err := s.http.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.FromCtx(ctx).Error("HTTP listener failed", zap.Error(err))
+			onErr(err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops accepting connections and waits, up to ctx, for requests in
+// progress.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/weeb-vip/algolia-sync/config"
+)
+
+func get(t *testing.T, s *Server, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestReadyzReportsEachFailingCheck(t *testing.T) {
+	s := New(config.AppConfig{Port: 0})
+	s.AddCheck("redis", func(ctx context.Context) error { return nil })
+	s.AddCheck("kafka", func(ctx context.Context) error { return errors.New("no brokers") })
+
+	rec := get(t, s, "/readyz")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	var body struct {
+		Failed map[string]string `json:"failed"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Failed) != 1 || body.Failed["kafka"] != "no brokers" {
+		t.Errorf("expected only kafka reported, got %v", body.Failed)
+	}
+
+	if rec := get(t, s, "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("a failing dependency should not fail liveness, got %d", rec.Code)
+	}
+}
+
+func TestReadyzWithNoFailures(t *testing.T) {
+	s := New(config.AppConfig{})
+	s.AddCheck("redis", func(ctx context.Context) error { return nil })
+	if rec := get(t, s, "/readyz"); rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rec.Code)
+	}
+}
+
+func TestAddCheckReplacesACheckOfTheSameName(t *testing.T) {
+	s := New(config.AppConfig{})
+	s.AddCheck("algolia", func(ctx context.Context) error { return errors.New("stale") })
+	s.AddCheck("algolia", func(ctx context.Context) error { return nil })
+	if rec := get(t, s, "/readyz"); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 from the replacement, got %d", rec.Code)
+	}
+}
+
+func TestMetricsAreServed(t *testing.T) {
+	rec := get(t, New(config.AppConfig{}), "/metrics")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "go_goroutines") {
+		t.Errorf("expected Prometheus metrics, got %d", rec.Code)
+	}
+}
@@ -2,15 +2,25 @@ package algolia
 
 import (
 	"context"
+	"github.com/algolia/algoliasearch-client-go/v3/algolia/errs"
 	"github.com/algolia/algoliasearch-client-go/v3/algolia/opt"
 	"github.com/algolia/algoliasearch-client-go/v3/algolia/search"
 	"github.com/weeb-vip/algolia-sync/config"
 	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"github.com/weeb-vip/algolia-sync/internal/metrics"
 	"go.uber.org/zap"
 	"io"
+	"net/http"
 	"time"
 )
 
+// AlgoliaService batches writes to one index.
+//
+// AddToIndex and DeleteFromIndex queue a write, and fail only when it was not
+// queued. A batch one of them fills is sent at once, and may carry other
+// callers' writes; if Algolia refuses it, it is kept and sent again, ahead of
+// anything newer, by the next send, so the caller is not told. Flush sends
+// everything queued or kept and reports whether Algolia took it.
 type AlgoliaService[T any] interface {
 	AddToIndex(ctx context.Context, object T) (res search.GroupBatchRes, err error)
 	DeleteFromIndex(ctx context.Context, objectID string) error
@@ -20,6 +30,9 @@ type AlgoliaService[T any] interface {
 	AllObjectIDs(ctx context.Context) (map[string]struct{}, error)
 	ApplySettings(ctx context.Context) error
 	ReplaceLiveIndex(ctx context.Context, sourceIndex string) error
+	// WaitForTasks blocks until every task sent since the last call has been
+	// published, or timeout passes. A zero timeout waits as long as ctx allows.
+	WaitForTasks(ctx context.Context, timeout time.Duration) ([]BatchResult, error)
 }
 
 type AlgoliaServiceImpl[T any] struct {
@@ -27,83 +40,98 @@ type AlgoliaServiceImpl[T any] struct {
 	Index         *search.Index
 	// The v3 client's Index has no accessor for its own name, and both the
 	// settings and swap calls need it.
-	IndexName   string
-	AddBatch    []T
-	DeleteBatch []string
-}
-
-func AutoFlush[T any](ctx context.Context, service AlgoliaService[T]) {
-	log := logger.FromCtx(ctx)
-	_, err := service.Flush(ctx)
-	if err != nil {
-		log.Error(err.Error())
-	}
+	IndexName string
+	batch     *batcher[T]
+	tasks     *taskTracker
 }
 
+// NewAlgoliaService returns a service that also flushes on age, for the
+// long-running consumers. The timer stops when ctx is cancelled, after one
+// last flush.
 func NewAlgoliaService[T any](ctx context.Context, algoliaCfg config.AlgoliaConfig) AlgoliaService[T] {
-	client := search.NewClient(algoliaCfg.AppID, algoliaCfg.APIKey)
-	service := &AlgoliaServiceImpl[T]{
-		AlgoliaSearch: client,
-		Index:         client.InitIndex(algoliaCfg.Index),
-		IndexName:     algoliaCfg.Index,
-		AddBatch:      make([]T, 0),
-		DeleteBatch:   make([]string, 0),
-	}
-	timeout := time.Duration(algoliaCfg.FlushTimeout) * time.Second
-	// start autoflush which runs ever 5 minutes
-	go func() {
-		for {
-			AutoFlush[T](ctx, service)
-			<-time.After(timeout)
-		}
-	}()
+	service := newAlgoliaService[T](algoliaCfg)
+	go service.batch.run(ctx)
 
 	return service
 }
 
 func NewAlgoliaServiceWithoutTimer[T any](ctx context.Context, algoliaCfg config.AlgoliaConfig) AlgoliaService[T] {
+	// No timer-based auto flush for cron job usage
+	return newAlgoliaService[T](algoliaCfg)
+}
+
+func newAlgoliaService[T any](algoliaCfg config.AlgoliaConfig) *AlgoliaServiceImpl[T] {
 	client := search.NewClient(algoliaCfg.AppID, algoliaCfg.APIKey)
+	index := client.InitIndex(algoliaCfg.Index)
 	service := &AlgoliaServiceImpl[T]{
 		AlgoliaSearch: client,
-		Index:         client.InitIndex(algoliaCfg.Index),
+		Index:         index,
 		IndexName:     algoliaCfg.Index,
-		AddBatch:      make([]T, 0),
-		DeleteBatch:   make([]string, 0),
+		tasks:         newTaskTracker(index.GetStatus),
 	}
-	// No timer-based auto flush for cron job usage
+	service.batch = newBatcher[T](
+		BatchLimits{
+			MaxRecords: algoliaCfg.BatchSize,
+			MaxBytes:   algoliaCfg.BatchMaxBytes,
+			MaxAge:     time.Duration(algoliaCfg.FlushTimeout) * time.Second,
+		},
+		func(objects []T) (search.GroupBatchRes, error) {
+			start := time.Now()
+			res, err := index.SaveObjects(objects)
+			observe(metrics.SaveOperation, start, len(objects), err)
+			if err == nil {
+				service.tasks.track(SaveTask, res.Responses...)
+			}
+			return res, err
+		},
+		func(objectIDs []string) (search.BatchRes, error) {
+			start := time.Now()
+			res, err := index.DeleteObjects(objectIDs)
+			observe(metrics.DeleteOperation, start, len(objectIDs), err)
+			if err == nil {
+				service.tasks.track(DeleteTask, res)
+			}
+			return res, err
+		},
+	)
 	return service
 }
 
-func (a *AlgoliaServiceImpl[T]) AddToIndex(ctx context.Context, object T) (res search.GroupBatchRes, err error) {
-	log := logger.FromCtx(ctx)
-	log.Info("adding to batch...")
-	a.AddBatch = append(a.AddBatch, object)
-	if len(a.AddBatch) >= 1000 {
-		log.Info("Adding to algolia...")
-		res, err = a.Index.SaveObjects(a.AddBatch)
-		if err != nil {
-			return res, err
+// observe records one batch request. Failures are counted by the sync, which
+// knows each item's action; a failed batch here is only requeued.
+func observe(operation string, start time.Time, objects int, err error) {
+	metrics.AlgoliaFlushSeconds.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err == nil {
+		metrics.AlgoliaObjects.WithLabelValues(operation).Add(float64(objects))
+	}
+}
+
+// Reachable returns a readiness check that Algolia answers for the index with
+// these credentials. An index that does not exist yet passes: the first save
+// creates it.
+func Reachable(algoliaCfg config.AlgoliaConfig) func(ctx context.Context) error {
+	index := search.NewClient(algoliaCfg.AppID, algoliaCfg.APIKey).InitIndex(algoliaCfg.Index)
+	return func(ctx context.Context) error {
+		_, err := index.GetSettings(ctx)
+		if _, missing := errs.IsAlgoliaErrWithCode(err, http.StatusNotFound); missing {
+			return nil
 		}
-		a.AddBatch = make([]T, 0)
+		return err
 	}
+}
 
-	return res, err
+func (a *AlgoliaServiceImpl[T]) AddToIndex(ctx context.Context, object T) (res search.GroupBatchRes, err error) {
+	log := logger.FromCtx(ctx)
+	log.Info("adding to batch...")
+	return a.batch.add(ctx, object)
 }
 
 // DeleteFromIndex removes a record. Batched like adds, because a reconcile
 // run can produce thousands of deletions at once and one HTTP call each would
 // be both slow and a good way to hit the rate limit.
 func (a *AlgoliaServiceImpl[T]) DeleteFromIndex(ctx context.Context, objectID string) error {
-	log := logger.FromCtx(ctx)
-	a.DeleteBatch = append(a.DeleteBatch, objectID)
-	if len(a.DeleteBatch) >= 1000 {
-		log.Info("deleting batch from algolia", zap.Int("batchSize", len(a.DeleteBatch)))
-		if _, err := a.Index.DeleteObjects(a.DeleteBatch); err != nil {
-			return err
-		}
-		a.DeleteBatch = make([]string, 0)
-	}
-	return nil
+	_, err := a.batch.remove(ctx, objectID)
+	return err
 }
 
 // AllObjectIDs pages through the entire index. Only objectID is requested, so
@@ -194,21 +222,19 @@ func (a *AlgoliaServiceImpl[T]) ReplaceLiveIndex(ctx context.Context, sourceInde
 }
 
 func (a *AlgoliaServiceImpl[T]) Flush(ctx context.Context) (res search.GroupBatchRes, err error) {
+	return a.batch.flush(ctx)
+}
+
+func (a *AlgoliaServiceImpl[T]) WaitForTasks(ctx context.Context, timeout time.Duration) ([]BatchResult, error) {
 	log := logger.FromCtx(ctx)
-	if len(a.AddBatch) > 0 {
-		log.With(zap.Int("batchSize", len(a.AddBatch))).Info("Flushing algolia...")
-		res, err = a.Index.SaveObjects(a.AddBatch)
-		if err != nil {
-			return res, err
-		}
-		a.AddBatch = make([]T, 0)
-	}
-	if len(a.DeleteBatch) > 0 {
-		log.With(zap.Int("batchSize", len(a.DeleteBatch))).Info("Flushing algolia deletes...")
-		if _, err := a.Index.DeleteObjects(a.DeleteBatch); err != nil {
-			return res, err
+	results, err := a.tasks.wait(ctx, timeout)
+	published := 0
+	for _, r := range results {
+		if r.Published {
+			published++
 		}
-		a.DeleteBatch = make([]string, 0)
 	}
-	return res, err
+	log.Info("waited for algolia tasks",
+		zap.Int("tasks", len(results)), zap.Int("published", published))
+	return results, err
 }
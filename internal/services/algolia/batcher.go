@@ -0,0 +1,358 @@
+package algolia
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/algolia/algoliasearch-client-go/v3/algolia/search"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// BatchLimits decides when pending writes are sent. Whichever is reached first
+// wins; a zero value disables that trigger.
+type BatchLimits struct {
+	// MaxRecords caps adds and deletes together.
+	MaxRecords int
+	// MaxBytes caps the serialized size of the pending records. Algolia
+	// rejects a batch request over its payload limit outright, and a catalogue
+	// replay of full synopses reaches it long before 1000 records.
+	MaxBytes int
+	// MaxAge bounds how long the oldest pending record may wait, so a quiet
+	// stream still reaches the index.
+	MaxAge time.Duration
+}
+
+// deleteOverhead approximates the JSON wrapped around each objectID in a
+// deleteObject operation.
+const deleteOverhead = len(`{"action":"deleteObject","body":{"objectID":""}},`)
+
+type pendingBatch[T any] struct {
+	adds []T
+	// addIDs and addSizes are the objectID and encoded size of each add.
+	addIDs   []string
+	addSizes []int
+	deletes  []string
+	bytes    int
+	oldest   time.Time
+}
+
+func (b *pendingBatch[T]) len() int {
+	return len(b.adds) + len(b.deletes)
+}
+
+// A batch sends all its adds and then all its deletes, so holding both for one
+// objectID would lose their order: a delete and then a re-create of the same
+// anime left it deleted. A newer write therefore replaces a pending write of
+// the other kind for the same id. Writes with no id replace nothing.
+
+// putAdd queues an add, dropping any pending delete of the same id.
+func (b *pendingBatch[T]) putAdd(id string, object T, size int) {
+	if id != "" {
+		kept := b.deletes[:0]
+		for _, pending := range b.deletes {
+			if pending == id {
+				b.bytes -= len(pending) + deleteOverhead
+				continue
+			}
+			kept = append(kept, pending)
+		}
+		b.deletes = kept
+	}
+	b.adds = append(b.adds, object)
+	b.addIDs = append(b.addIDs, id)
+	b.addSizes = append(b.addSizes, size)
+	b.bytes += size
+}
+
+// putDelete queues a delete, dropping any pending add of the same id.
+func (b *pendingBatch[T]) putDelete(id string) {
+	if id != "" {
+		n := 0
+		for i, pending := range b.addIDs {
+			if pending == id {
+				b.bytes -= b.addSizes[i]
+				continue
+			}
+			b.adds[n], b.addIDs[n], b.addSizes[n] = b.adds[i], b.addIDs[i], b.addSizes[i]
+			n++
+		}
+		b.adds, b.addIDs, b.addSizes = b.adds[:n], b.addIDs[:n], b.addSizes[:n]
+	}
+	b.deletes = append(b.deletes, id)
+	b.bytes += len(id) + deleteOverhead
+}
+
+// objectID reads the objectID of an encoded record, as AllObjectIDs does.
+func objectID(encoded []byte) string {
+	var rec struct {
+		ObjectID string `json:"objectID"`
+	}
+	_ = json.Unmarshal(encoded, &rec)
+	return rec.ObjectID
+}
+
+// batcher collects writes from any number of goroutines.
+//
+// It replaces two bare slices that the auto-flush goroutine emptied while the
+// consumer was still appending to them. Without a lock, a record appended
+// between SaveObjects returning and the slice being reset was dropped, and a
+// flush racing an append could send the same records twice.
+type batcher[T any] struct {
+	limits BatchLimits
+	save   func(objects []T) (search.GroupBatchRes, error)
+	delete func(objectIDs []string) (search.BatchRes, error)
+	now    func() time.Time
+
+	mu      sync.Mutex
+	pending pendingBatch[T]
+	// failed is what the last send could not deliver. It is only set and
+	// taken while sendMu is held, and the next send delivers it ahead of its
+	// own batch.
+	failed pendingBatch[T]
+
+	// sendMu keeps sends in the order their batches were taken. Without it a
+	// size-triggered flush and a timer flush could overtake each other, and an
+	// older version of a record would land after a newer one.
+	sendMu sync.Mutex
+}
+
+func newBatcher[T any](
+	limits BatchLimits,
+	save func([]T) (search.GroupBatchRes, error),
+	del func([]string) (search.BatchRes, error),
+) *batcher[T] {
+	return &batcher[T]{
+		limits: limits,
+		save:   save,
+		delete: del,
+		now:    time.Now,
+	}
+}
+
+// add queues a record, sending the batch if this record fills it. An error
+// means the record was not queued; see sendAll for one the send returns.
+func (b *batcher[T]) add(ctx context.Context, object T) (search.GroupBatchRes, error) {
+	encoded, err := json.Marshal(object)
+	if err != nil {
+		return search.GroupBatchRes{}, err
+	}
+	size := len(encoded)
+	if b.limits.MaxBytes > 0 && size > b.limits.MaxBytes {
+		// Queuing it would wedge every batch it joined.
+		return search.GroupBatchRes{}, fmt.Errorf("record of %d bytes exceeds the %d byte batch limit", size, b.limits.MaxBytes)
+	}
+
+	b.mu.Lock()
+	overflow := b.takeIfOverflowing(size)
+	b.mark()
+	b.pending.putAdd(objectID(encoded), object, size)
+	full := b.takeIfFull()
+	b.mu.Unlock()
+
+	return b.sendAll(ctx, overflow, full), nil
+}
+
+// remove queues a deletion, sending the batch if this deletion fills it.
+func (b *batcher[T]) remove(ctx context.Context, objectID string) (search.GroupBatchRes, error) {
+	size := len(objectID) + deleteOverhead
+
+	b.mu.Lock()
+	overflow := b.takeIfOverflowing(size)
+	b.mark()
+	b.pending.putDelete(objectID)
+	full := b.takeIfFull()
+	b.mu.Unlock()
+
+	return b.sendAll(ctx, overflow, full), nil
+}
+
+// flush sends whatever is pending, regardless of the limits.
+func (b *batcher[T]) flush(ctx context.Context) (search.GroupBatchRes, error) {
+	b.mu.Lock()
+	taken := b.take()
+	b.mu.Unlock()
+
+	return b.send(ctx, taken)
+}
+
+// due reports whether the oldest record waiting, pending or failed, has
+// waited past MaxAge.
+func (b *batcher[T]) due() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limits.MaxAge <= 0 {
+		return false
+	}
+	for _, batch := range []*pendingBatch[T]{&b.failed, &b.pending} {
+		if batch.len() > 0 && b.now().Sub(batch.oldest) >= b.limits.MaxAge {
+			return true
+		}
+	}
+	return false
+}
+
+// run flushes on age until ctx is cancelled, then flushes one last time so
+// records accepted before shutdown are not abandoned.
+func (b *batcher[T]) run(ctx context.Context) {
+	log := logger.FromCtx(ctx)
+
+	interval := b.limits.MaxAge / 2
+	if interval <= 0 || interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// ctx is already cancelled; the final flush needs one that is not.
+			if _, err := b.flush(context.WithoutCancel(ctx)); err != nil {
+				log.Error("final flush failed", zap.Error(err))
+			}
+			return
+		case <-ticker.C:
+			if !b.due() {
+				continue
+			}
+			if _, err := b.flush(ctx); err != nil {
+				log.Error("age-triggered flush failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+// mark records when the batch started waiting. Callers hold mu.
+func (b *batcher[T]) mark() {
+	if b.pending.len() == 0 {
+		b.pending.oldest = b.now()
+	}
+}
+
+// takeIfOverflowing makes room for a record of size bytes by taking the current
+// batch when adding to it would exceed MaxBytes. Callers hold mu.
+func (b *batcher[T]) takeIfOverflowing(size int) pendingBatch[T] {
+	if b.limits.MaxBytes <= 0 || b.pending.len() == 0 || b.pending.bytes+size <= b.limits.MaxBytes {
+		return pendingBatch[T]{}
+	}
+	return b.take()
+}
+
+// takeIfFull takes the batch once it has reached MaxRecords. Callers hold mu.
+func (b *batcher[T]) takeIfFull() pendingBatch[T] {
+	if b.limits.MaxRecords <= 0 || b.pending.len() < b.limits.MaxRecords {
+		return pendingBatch[T]{}
+	}
+	return b.take()
+}
+
+// take empties the pending batch and returns what it held. Callers hold mu.
+func (b *batcher[T]) take() pendingBatch[T] {
+	taken := b.pending
+	b.pending = pendingBatch[T]{}
+	return taken
+}
+
+// followedBy returns older with the writes of newer applied after it, so one
+// send delivers both in order: what newer holds replaces a write of the other
+// kind for the same id in older.
+func (older pendingBatch[T]) followedBy(newer pendingBatch[T]) pendingBatch[T] {
+	if older.len() == 0 {
+		return newer
+	}
+	if newer.len() > 0 && newer.oldest.Before(older.oldest) {
+		older.oldest = newer.oldest
+	}
+	for i, object := range newer.adds {
+		older.putAdd(newer.addIDs[i], object, newer.addSizes[i])
+	}
+	for _, id := range newer.deletes {
+		older.putDelete(id)
+	}
+	return older
+}
+
+// sendAll sends the batches add or remove took. Their records were already
+// accepted, some of them from other callers, so a failure is not the
+// caller's: whatever was not delivered is kept for the next send and its
+// error is only logged. Flush reports it if it fails again.
+func (b *batcher[T]) sendAll(ctx context.Context, batches ...pendingBatch[T]) search.GroupBatchRes {
+	var res search.GroupBatchRes
+	for _, batch := range batches {
+		// A failed batch is kept, so the next one is still sent, carrying
+		// it along ahead of its own records.
+		sent, err := b.send(ctx, batch)
+		res.Responses = append(res.Responses, sent.Responses...)
+		if err != nil {
+			logger.FromCtx(ctx).Warn("Failed to send a full batch; it is retried with the next send", zap.Error(err))
+		}
+	}
+	return res
+}
+
+// send writes a taken batch to Algolia, preceded by whatever the last send
+// failed to deliver. Holding sendMu from taking the failed writes to keeping
+// them again means a batch taken later cannot be sent in between, so a retry
+// never lands after a newer write. What is not accepted now is kept for the
+// next send rather than dropped.
+func (b *batcher[T]) send(ctx context.Context, batch pendingBatch[T]) (res search.GroupBatchRes, err error) {
+	log := logger.FromCtx(ctx)
+
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+
+	b.mu.Lock()
+	batch = b.failed.followedBy(batch)
+	b.failed = pendingBatch[T]{}
+	b.mu.Unlock()
+	if batch.len() == 0 {
+		return res, nil
+	}
+
+	if len(batch.adds) > 0 {
+		log.Info("Flushing algolia...", zap.Int("batchSize", len(batch.adds)), zap.Int("bytes", batch.bytes))
+		saved, err := b.save(batch.adds)
+		if err != nil {
+			b.keepFailed(batch)
+			return res, err
+		}
+		res.Responses = append(res.Responses, saved.Responses...)
+	}
+
+	if len(batch.deletes) > 0 {
+		log.Info("Flushing algolia deletes...", zap.Int("batchSize", len(batch.deletes)))
+		deleted, err := b.delete(batch.deletes)
+		if err != nil {
+			// The adds went through; only the deletions are retried.
+			b.keepFailed(pendingBatch[T]{
+				deletes: batch.deletes,
+				bytes:   deleteBytes(batch.deletes),
+				oldest:  batch.oldest,
+			})
+			return res, err
+		}
+		res.Responses = append(res.Responses, deleted)
+	}
+
+	return res, nil
+}
+
+// keepFailed holds a batch that failed to send for the next send. Callers hold
+// sendMu.
+func (b *batcher[T]) keepFailed(failed pendingBatch[T]) {
+	b.mu.Lock()
+	b.failed = failed
+	b.mu.Unlock()
+}
+
+func deleteBytes(objectIDs []string) int {
+	total := 0
+	for _, id := range objectIDs {
+		total += len(id) + deleteOverhead
+	}
+	return total
+}
@@ -0,0 +1,395 @@
+package algolia
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/algolia/algoliasearch-client-go/v3/algolia/search"
+)
+
+type record struct {
+	ObjectID string `json:"objectID"`
+	Body     string `json:"body,omitempty"`
+}
+
+// fakeIndex stands in for the Algolia index and records every send.
+type fakeIndex struct {
+	mu       sync.Mutex
+	saves    [][]record
+	deletes  [][]string
+	failNext error
+}
+
+func (f *fakeIndex) save(objects []record) (search.GroupBatchRes, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failNext != nil {
+		err := f.failNext
+		f.failNext = nil
+		return search.GroupBatchRes{}, err
+	}
+	f.saves = append(f.saves, append([]record(nil), objects...))
+	return search.GroupBatchRes{Responses: []search.BatchRes{{TaskID: len(f.saves)}}}, nil
+}
+
+func (f *fakeIndex) delete(objectIDs []string) (search.BatchRes, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deletes = append(f.deletes, append([]string(nil), objectIDs...))
+	return search.BatchRes{TaskID: 100 + len(f.deletes)}, nil
+}
+
+func (f *fakeIndex) saved() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []string
+	for _, batch := range f.saves {
+		for _, r := range batch {
+			ids = append(ids, r.ObjectID)
+		}
+	}
+	return ids
+}
+
+func newTestBatcher(limits BatchLimits) (*batcher[record], *fakeIndex) {
+	idx := &fakeIndex{}
+	return newBatcher[record](limits, idx.save, idx.delete), idx
+}
+
+func TestBatcherSendsWhenRecordCountIsReached(t *testing.T) {
+	b, idx := newTestBatcher(BatchLimits{MaxRecords: 3})
+	ctx := context.Background()
+
+	for _, id := range []string{"a", "b"} {
+		if _, err := b.add(ctx, record{ObjectID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(idx.saves) != 0 {
+		t.Fatalf("nothing should be sent below the limit, got %d sends", len(idx.saves))
+	}
+	// Deletes count towards the same limit.
+	res, err := b.remove(ctx, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.saves) != 1 || len(idx.deletes) != 1 {
+		t.Fatalf("the third write should send the batch, got %d saves %d deletes", len(idx.saves), len(idx.deletes))
+	}
+	if len(res.Responses) != 2 {
+		t.Errorf("both the save and the delete should be reported, got %d responses", len(res.Responses))
+	}
+}
+
+// Algolia rejects an oversized request outright, so the batch that would
+// cross the limit is sent first and the new record starts the next one.
+func TestBatcherSplitsOnSerializedSize(t *testing.T) {
+	b, idx := newTestBatcher(BatchLimits{MaxBytes: 100})
+	ctx := context.Background()
+
+	body := strings.Repeat("x", 40)
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := b.add(ctx, record{ObjectID: id, Body: body}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each record is ~70 bytes, so no two fit together.
+	if len(idx.saves) != 2 || len(idx.saves[0]) != 1 || len(idx.saves[1]) != 1 {
+		t.Fatalf("expected each earlier record sent alone, got %v", idx.saves)
+	}
+	if _, err := b.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := idx.saved(); len(got) != 3 {
+		t.Errorf("every record should eventually be sent once, got %v", got)
+	}
+}
+
+func TestBatcherRejectsARecordLargerThanABatch(t *testing.T) {
+	b, idx := newTestBatcher(BatchLimits{MaxBytes: 10})
+	if _, err := b.add(context.Background(), record{ObjectID: "far-too-long-for-the-limit"}); err == nil {
+		t.Fatal("expected an error for a record that can never fit")
+	}
+	if _, err := b.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.saves) != 0 {
+		t.Errorf("the oversized record must not be queued, got %v", idx.saves)
+	}
+}
+
+func TestBatcherIsDueOnceTheOldestRecordIsOld(t *testing.T) {
+	b, _ := newTestBatcher(BatchLimits{MaxAge: time.Minute})
+	now := time.Unix(1_700_000_000, 0)
+	b.now = func() time.Time { return now }
+
+	if b.due() {
+		t.Fatal("an empty batch is never due")
+	}
+	if _, err := b.add(context.Background(), record{ObjectID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(59 * time.Second)
+	if _, err := b.add(context.Background(), record{ObjectID: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if b.due() {
+		t.Fatal("not due before MaxAge")
+	}
+	// Age is measured from the first record, not the latest.
+	now = now.Add(time.Second)
+	if !b.due() {
+		t.Fatal("due once the oldest record reaches MaxAge")
+	}
+}
+
+func TestBatcherKeepsAFailedBatchInOrder(t *testing.T) {
+	b, idx := newTestBatcher(BatchLimits{})
+	ctx := context.Background()
+
+	for _, id := range []string{"a", "b"} {
+		if _, err := b.add(ctx, record{ObjectID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx.failNext = errors.New("algolia unavailable")
+	if _, err := b.flush(ctx); err == nil {
+		t.Fatal("expected the send error to surface")
+	}
+	if _, err := b.add(ctx, record{ObjectID: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got := idx.saved()
+	if len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("retried records should go first and only once, got %v", got)
+	}
+}
+
+func TestBatcherLosesNothingUnderConcurrentProducers(t *testing.T) {
+	b, idx := newTestBatcher(BatchLimits{MaxRecords: 7})
+	ctx := context.Background()
+
+	const producers, perProducer = 8, 250
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				if _, err := b.add(ctx, record{ObjectID: fmt.Sprintf("%d-%d", p, i)}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(p)
+	}
+	// A flush racing the producers is exactly what the auto-flush timer does.
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_, _ = b.flush(ctx)
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	if _, err := b.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]int{}
+	for _, id := range idx.saved() {
+		seen[id]++
+	}
+	if len(seen) != producers*perProducer {
+		t.Errorf("expected %d distinct records, got %d", producers*perProducer, len(seen))
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("%q sent %d times", id, n)
+		}
+	}
+}
+
+func TestBatcherFlushesOnceMoreWhenStopped(t *testing.T) {
+	b, idx := newTestBatcher(BatchLimits{MaxAge: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if _, err := b.add(ctx, record{ObjectID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		b.run(ctx)
+		close(done)
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return after cancellation")
+	}
+	if got := idx.saved(); len(got) != 1 {
+		t.Errorf("pending record should be flushed on shutdown, got %v", got)
+	}
+}
+
+func TestBatcherKeepsTheLatestWritePerRecord(t *testing.T) {
+	b, idx := newTestBatcher(BatchLimits{})
+	ctx := context.Background()
+
+	// Deleted and re-created: a's create must win. Created and deleted: b's
+	// delete must.
+	if _, err := b.remove(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.add(ctx, record{ObjectID: "a", Body: "again"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.add(ctx, record{ObjectID: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.remove(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := idx.saved(); len(got) != 1 || got[0] != "a" {
+		t.Errorf("saved %v, want only a", got)
+	}
+	if len(idx.deletes) != 1 || len(idx.deletes[0]) != 1 || idx.deletes[0][0] != "b" {
+		t.Errorf("deleted %v, want only b", idx.deletes)
+	}
+	if b.pending.bytes != 0 {
+		t.Errorf("%d bytes left pending after the flush", b.pending.bytes)
+	}
+}
+
+func TestBatcherRequeueYieldsToNewerWrites(t *testing.T) {
+	b, idx := newTestBatcher(BatchLimits{})
+	ctx := context.Background()
+
+	if _, err := b.add(ctx, record{ObjectID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	taken := b.take()
+	b.mu.Unlock()
+	// Deleted while the batch holding its create was failing.
+	if _, err := b.remove(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	idx.failNext = errors.New("unavailable")
+	if _, err := b.send(ctx, taken); err == nil {
+		t.Fatal("expected the send to fail")
+	}
+	if _, err := b.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := idx.saved(); len(got) != 0 {
+		t.Errorf("saved %v after a newer delete", got)
+	}
+	if len(idx.deletes) != 1 || idx.deletes[0][0] != "a" {
+		t.Errorf("deleted %v, want a", idx.deletes)
+	}
+}
+
+func TestBatcherSendsTheNextBatchAfterOneFails(t *testing.T) {
+	b, idx := newTestBatcher(BatchLimits{})
+	ctx := context.Background()
+
+	// As add takes them when a record overflows the batch and then fills
+	// the next one.
+	var batches []pendingBatch[record]
+	for _, id := range []string{"a", "b"} {
+		if _, err := b.add(ctx, record{ObjectID: id}); err != nil {
+			t.Fatal(err)
+		}
+		b.mu.Lock()
+		batches = append(batches, b.take())
+		b.mu.Unlock()
+	}
+	idx.failNext = errors.New("unavailable")
+	b.sendAll(ctx, batches...)
+
+	if got := idx.saved(); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("saved %v, want the overflow a and then b", got)
+	}
+	if b.failed.len() != 0 || b.pending.len() != 0 {
+		t.Errorf("nothing should be left to send, have %+v and %+v", b.failed, b.pending)
+	}
+}
+
+func TestBatcherAddDoesNotFailForABatchItKeeps(t *testing.T) {
+	b, idx := newTestBatcher(BatchLimits{MaxRecords: 1})
+	ctx := context.Background()
+
+	idx.failNext = errors.New("unavailable")
+	if _, err := b.add(ctx, record{ObjectID: "a"}); err != nil {
+		t.Fatalf("a record kept for the next send is queued, got %v", err)
+	}
+	if got := idx.saved(); len(got) != 0 {
+		t.Fatalf("saved %v, want the send to have failed", got)
+	}
+	if _, err := b.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := idx.saved(); len(got) != 1 || got[0] != "a" {
+		t.Errorf("saved %v, want a once", got)
+	}
+}
+
+func TestBatcherRetriesAheadOfANewerBatch(t *testing.T) {
+	b, idx := newTestBatcher(BatchLimits{})
+	ctx := context.Background()
+
+	if _, err := b.add(ctx, record{ObjectID: "a", Body: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	older := b.take()
+	b.mu.Unlock()
+	// Taken by another producer while the older batch was being sent.
+	if _, err := b.add(ctx, record{ObjectID: "a", Body: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	newer := b.take()
+	b.mu.Unlock()
+
+	idx.failNext = errors.New("unavailable")
+	if _, err := b.send(ctx, older); err == nil {
+		t.Fatal("expected the send to fail")
+	}
+	if _, err := b.send(ctx, newer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var bodies []string
+	for _, batch := range idx.saves {
+		for _, r := range batch {
+			bodies = append(bodies, r.Body)
+		}
+	}
+	if len(bodies) == 0 || bodies[len(bodies)-1] != "new" {
+		t.Errorf("sent %v, the newer write must land last", bodies)
+	}
+}
@@ -0,0 +1,110 @@
+package algolia
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/algolia/algoliasearch-client-go/v3/algolia/search"
+)
+
+type TaskAction string
+
+const (
+	SaveTask   TaskAction = "save"
+	DeleteTask TaskAction = "delete"
+)
+
+// BatchResult is one indexing task Algolia accepted, and, once waited on,
+// whether it reached the index.
+type BatchResult struct {
+	TaskID    int
+	Action    TaskAction
+	ObjectIDs []string
+	Published bool
+	Err       error
+}
+
+// taskTracker remembers every task a flush produced until someone waits on it.
+//
+// SaveObjects and DeleteObjects return as soon as Algolia has queued the work.
+// Treating that as done is how the sync job came to delete its claimed batch
+// before the records were searchable: a task that never published left nothing
+// behind to retry.
+type taskTracker struct {
+	status       func(taskID int) (search.TaskStatusRes, error)
+	pollInterval time.Duration
+
+	mu      sync.Mutex
+	pending []BatchResult
+}
+
+func newTaskTracker(status func(taskID int) (search.TaskStatusRes, error)) *taskTracker {
+	return &taskTracker{
+		status:       status,
+		pollInterval: 500 * time.Millisecond,
+	}
+}
+
+func (t *taskTracker) track(action TaskAction, responses ...search.BatchRes) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, res := range responses {
+		t.pending = append(t.pending, BatchResult{
+			TaskID:    res.TaskID,
+			Action:    action,
+			ObjectIDs: res.ObjectIDs,
+		})
+	}
+}
+
+// wait polls every tracked task until it is published or the deadline passes.
+// Results are returned in the order the tasks were sent, confirmed or not; the
+// error reports the first task that could not be confirmed.
+func (t *taskTracker) wait(ctx context.Context, timeout time.Duration) ([]BatchResult, error) {
+	t.mu.Lock()
+	results := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var firstErr error
+	for i := range results {
+		results[i].Err = t.waitOne(ctx, results[i].TaskID)
+		results[i].Published = results[i].Err == nil
+		if results[i].Err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("task %d (%s of %d records) not published: %w",
+				results[i].TaskID, results[i].Action, len(results[i].ObjectIDs), results[i].Err)
+		}
+	}
+	return results, firstErr
+}
+
+func (t *taskTracker) waitOne(ctx context.Context, taskID int) error {
+	ticker := time.NewTicker(t.pollInterval)
+	defer ticker.Stop()
+	var lastErr error
+	for {
+		// A failed status call is retried until the deadline; the task itself
+		// may well be fine.
+		res, err := t.status(taskID)
+		if err == nil && res.Status == "published" {
+			return nil
+		}
+		lastErr = err
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return lastErr
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package algolia
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/algolia/algoliasearch-client-go/v3/algolia/search"
+)
+
+// statusAfter reports each task published once it has been polled n times.
+func statusAfter(n int) (func(int) (search.TaskStatusRes, error), map[int]int) {
+	polls := map[int]int{}
+	return func(taskID int) (search.TaskStatusRes, error) {
+		polls[taskID]++
+		if polls[taskID] >= n {
+			return search.TaskStatusRes{Status: "published"}, nil
+		}
+		return search.TaskStatusRes{Status: "notPublished"}, nil
+	}, polls
+}
+
+func TestWaitConfirmsEveryTrackedTask(t *testing.T) {
+	status, polls := statusAfter(2)
+	tracker := newTaskTracker(status)
+	tracker.pollInterval = time.Millisecond
+
+	tracker.track(SaveTask,
+		search.BatchRes{TaskID: 1, ObjectIDs: []string{"a", "b"}},
+		search.BatchRes{TaskID: 2, ObjectIDs: []string{"c"}})
+	tracker.track(DeleteTask, search.BatchRes{TaskID: 3, ObjectIDs: []string{"d"}})
+
+	results, err := tracker.wait(context.Background(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected one result per task, got %d", len(results))
+	}
+	for _, r := range results {
+		if !r.Published || r.Err != nil {
+			t.Errorf("task %d should be published, got %+v", r.TaskID, r)
+		}
+		if polls[r.TaskID] != 2 {
+			t.Errorf("task %d polled %d times, want 2", r.TaskID, polls[r.TaskID])
+		}
+	}
+	if results[2].Action != DeleteTask || results[2].ObjectIDs[0] != "d" {
+		t.Errorf("results should keep the action and records of each task: %+v", results[2])
+	}
+
+	// Tasks are handed out once; the next wait starts from an empty slate.
+	if again, err := tracker.wait(context.Background(), time.Second); err != nil || len(again) != 0 {
+		t.Errorf("expected nothing left to wait on, got %v %v", again, err)
+	}
+}
+
+func TestWaitGivesUpAtTheTimeout(t *testing.T) {
+	status, _ := statusAfter(1 << 30)
+	tracker := newTaskTracker(status)
+	tracker.pollInterval = time.Millisecond
+	tracker.track(SaveTask, search.BatchRes{TaskID: 7, ObjectIDs: []string{"a"}})
+
+	results, err := tracker.wait(context.Background(), 20*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	if len(results) != 1 || results[0].Published {
+		t.Errorf("an unconfirmed task must not be reported published: %+v", results)
+	}
+}
+
+// A status call failing does not mean the task did; keep asking.
+func TestWaitRetriesFailedStatusCalls(t *testing.T) {
+	calls := 0
+	tracker := newTaskTracker(func(int) (search.TaskStatusRes, error) {
+		calls++
+		if calls == 1 {
+			return search.TaskStatusRes{}, errors.New("connection reset")
+		}
+		return search.TaskStatusRes{Status: "published"}, nil
+	})
+	tracker.pollInterval = time.Millisecond
+	tracker.track(SaveTask, search.BatchRes{TaskID: 1})
+
+	if _, err := tracker.wait(context.Background(), time.Second); err != nil {
+		t.Fatalf("a transient status error should be retried, got %v", err)
+	}
+}
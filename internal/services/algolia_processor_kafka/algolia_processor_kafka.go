@@ -3,26 +3,54 @@ package algolia_processor_kafka
 import (
 	"context"
 	"fmt"
+	"maps"
+	"sync"
+	"time"
+
 	"github.com/ThatCatDev/ep/v2/event"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/weeb-vip/algolia-sync/config"
 	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"github.com/weeb-vip/algolia-sync/internal/metrics"
 	"github.com/weeb-vip/algolia-sync/internal/services/algolia"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
 	"go.uber.org/zap"
-	"net/url"
-	"time"
 )
 
+// AlgoliaProcessor writes Kafka messages straight to Algolia, for the
+// streaming mode. Process only queues the write in the batch; a message is not
+// in the index until Flush has returned.
 type AlgoliaProcessor interface {
 	Process(ctx context.Context, data event.Event[*kafka.Message, Payload]) (event.Event[*kafka.Message, Payload], error)
+	// Flush sends every queued write and, if configured, waits for Algolia
+	// to publish them.
+	Flush(ctx context.Context) error
 }
 
 type AlgoliaProcessorImpl struct {
-	algolia.AlgoliaService[AlgoliaSchema]
+	algolia.AlgoliaService[redis_processor.AnimeDocument]
+	waitForTasks    bool
+	taskWaitTimeout time.Duration
+
+	// watermarks, if set, keeps a message older than what Algolia already
+	// has from being written over it, as the sync does. queued holds the
+	// marks of the writes queued since the last flush, which are recorded
+	// only once the flush has sent them.
+	watermarks *redis.Watermarks
+	mu         sync.Mutex
+	queued     map[string]redis.Watermark
 }
 
-func NewAlgoliaProcessor(algoliaService algolia.AlgoliaService[AlgoliaSchema]) AlgoliaProcessor {
+// NewAlgoliaProcessor returns a processor writing through algoliaService.
+// watermarks may be nil, to write every message.
+func NewAlgoliaProcessor(algoliaService algolia.AlgoliaService[redis_processor.AnimeDocument], algoliaCfg config.AlgoliaConfig, watermarks *redis.Watermarks) AlgoliaProcessor {
 	return &AlgoliaProcessorImpl{
-		AlgoliaService: algoliaService,
+		AlgoliaService:  algoliaService,
+		waitForTasks:    algoliaCfg.WaitForTasks,
+		taskWaitTimeout: time.Duration(algoliaCfg.TaskWaitTimeout) * time.Second,
+		watermarks:      watermarks,
+		queued:          make(map[string]redis.Watermark),
 	}
 }
 
@@ -30,39 +58,108 @@ func (p *AlgoliaProcessorImpl) Process(ctx context.Context, data event.Event[*ka
 	log := logger.FromCtx(ctx)
 
 	payload := data.Payload
+	if payload.Data.Id == "" {
+		return data, fmt.Errorf("cannot index a record with no id")
+	}
 
-	if payload.Action == CreateAction {
-		log.Info("Processing create action")
-		payload.Data.ObjectId = &payload.Data.Id
-		if payload.Data.ObjectId == nil {
-			return data, fmt.Errorf("object id is nil")
-		}
-		// convert to url encoded string
-		encoded := url.QueryEscape(*payload.Data.ObjectId)
-		payload.Data.ObjectId = &encoded
-		// convert startDate to unix timestamp
-		if payload.Data.StartDate != nil {
-			// format of startDate 2007-04-02 04:00:00
-			startDate, err := time.Parse("2006-01-02 15:04:05", *payload.Data.StartDate)
-			if err != nil {
-				log.Warn("Failed to parse start date, continuing without date_rank",
-					zap.String("startDate", *payload.Data.StartDate),
-					zap.Error(err))
-			} else {
-				dateRank := startDate.Unix()
-				dateRank = dateRank / 1000
-				payload.Data.DateRank = &dateRank
-			}
-		}
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-		// Convert Schema to AlgoliaSchema (transforms JSON strings to arrays)
-		algoliaData := payload.Data.ToAlgoliaSchema()
+	version, _ := redis_processor.QueuedItem{Data: payload.Data, EventTime: payload.EventTime}.QueueVersion()
+	mark, err := p.mark(ctx, payload.Data.Id)
+	if err != nil {
+		log.Error("Failed to read the watermark", zap.String("objectId", payload.Data.Id), zap.Error(err))
+		metrics.Failures.WithLabelValues(metrics.AlgoliaStage, string(payload.Action)).Inc()
+		return data, err
+	}
+	if !mark.Admits(version) {
+		log.Info("dropped a message older than what Algolia already has",
+			zap.String("objectId", payload.Data.Id),
+			zap.String("action", string(payload.Action)),
+			zap.Int64("version", version),
+			zap.Int64("watermark", mark.Version),
+			zap.Bool("deleted", mark.Deleted))
+		metrics.ItemsStale.WithLabelValues(string(payload.Action)).Inc()
+		return data, nil
+	}
 
-		_, err := p.AlgoliaService.AddToIndex(ctx, algoliaData)
-		if err != nil {
-			return data, err
-		}
+	switch payload.Action {
+	case CreateAction, UpdateAction:
+		_, err = p.AlgoliaService.AddToIndex(ctx, payload.Data.ToDocument())
+	case DeleteAction:
+		err = p.AlgoliaService.DeleteFromIndex(ctx, payload.Data.Id)
+	default:
+		err = fmt.Errorf("unknown action %q", payload.Action)
+	}
+	if err != nil {
+		metrics.Failures.WithLabelValues(metrics.AlgoliaStage, string(payload.Action)).Inc()
+		return data, err
+	}
+	if p.watermarks != nil {
+		p.queued[payload.Data.Id] = mark.Advanced(version, payload.Action == DeleteAction)
 	}
 
+	log.Info("Queued write to Algolia",
+		zap.String("action", string(payload.Action)),
+		zap.String("objectId", payload.Data.Id))
+
 	return data, nil
 }
+
+// mark returns the watermark of id: the one a write queued since the last
+// flush has moved it to, or else the recorded one. With no watermarks it is
+// the zero Watermark, which admits everything.
+func (p *AlgoliaProcessorImpl) mark(ctx context.Context, id string) (redis.Watermark, error) {
+	if mark, ok := p.queued[id]; ok {
+		return mark, nil
+	}
+	marks, err := p.watermarks.Get(ctx, id)
+	if err != nil {
+		return redis.Watermark{}, err
+	}
+	return marks[id], nil
+}
+
+func (p *AlgoliaProcessorImpl) Flush(ctx context.Context) error {
+	// Process holds the lock while it queues, so every write behind these
+	// marks is in the batch this flush sends. The marks stay queued until
+	// they are recorded, so a message read meanwhile is still held to them.
+	p.mu.Lock()
+	sent := maps.Clone(p.queued)
+	p.mu.Unlock()
+
+	if err := p.flush(ctx); err != nil {
+		// The writes stay in the batch for the next flush, and so do their
+		// marks.
+		return err
+	}
+	if err := p.watermarks.Advance(ctx, sent); err != nil {
+		// The writes are in Algolia, so the flush did its job; the next
+		// flush records these marks along with its own.
+		logger.FromCtx(ctx).Error("Failed to record the watermarks", zap.Error(err))
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, mark := range sent {
+		if p.queued[id] == mark {
+			delete(p.queued, id)
+		}
+	}
+	return nil
+}
+
+func (p *AlgoliaProcessorImpl) flush(ctx context.Context) error {
+	if _, err := p.AlgoliaService.Flush(ctx); err != nil {
+		return err
+	}
+	if !p.waitForTasks {
+		return nil
+	}
+	// As in the sync: Flush only hands the writes to Algolia's queue, and
+	// once the offsets are committed after it the messages are not read
+	// again.
+	_, err := p.AlgoliaService.WaitForTasks(ctx, p.taskWaitTimeout)
+	return err
+}
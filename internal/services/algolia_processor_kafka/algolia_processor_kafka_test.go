@@ -0,0 +1,248 @@
+package algolia_processor_kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ThatCatDev/ep/v2/event"
+	"github.com/algolia/algoliasearch-client-go/v3/algolia/search"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"github.com/weeb-vip/algolia-sync/internal/services/algolia"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
+)
+
+// MockAlgoliaService implements algolia.AlgoliaService for testing
+type MockAlgoliaService struct {
+	Added   []redis_processor.AnimeDocument
+	Deleted []string
+	Flushes int
+	Waits   int
+	AddErr  error
+	WaitErr error
+}
+
+func (m *MockAlgoliaService) AddToIndex(ctx context.Context, object redis_processor.AnimeDocument) (search.GroupBatchRes, error) {
+	if m.AddErr != nil {
+		return search.GroupBatchRes{}, m.AddErr
+	}
+	m.Added = append(m.Added, object)
+	return search.GroupBatchRes{}, nil
+}
+
+func (m *MockAlgoliaService) DeleteFromIndex(ctx context.Context, objectID string) error {
+	m.Deleted = append(m.Deleted, objectID)
+	return nil
+}
+
+func (m *MockAlgoliaService) Flush(ctx context.Context) (search.GroupBatchRes, error) {
+	m.Flushes++
+	return search.GroupBatchRes{}, nil
+}
+
+func (m *MockAlgoliaService) AllObjectIDs(ctx context.Context) (map[string]struct{}, error) {
+	return nil, nil
+}
+
+func (m *MockAlgoliaService) ApplySettings(ctx context.Context) error {
+	return nil
+}
+
+func (m *MockAlgoliaService) ReplaceLiveIndex(ctx context.Context, sourceIndex string) error {
+	return nil
+}
+
+func (m *MockAlgoliaService) WaitForTasks(ctx context.Context, timeout time.Duration) ([]algolia.BatchResult, error) {
+	m.Waits++
+	return nil, m.WaitErr
+}
+
+func setupTestContext() context.Context {
+	return logger.WithCtx(context.Background(), logger.Get())
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func message(payload Payload) event.Event[*kafka.Message, Payload] {
+	return event.Event[*kafka.Message, Payload]{Payload: payload, DriverMessage: &kafka.Message{}}
+}
+
+func TestProcess_IndexesTheSameDocumentAsTheSync(t *testing.T) {
+	mockAlgolia := &MockAlgoliaService{}
+	processor := NewAlgoliaProcessor(mockAlgolia, config.AlgoliaConfig{}, nil)
+
+	data := Schema{
+		Id:        "anime-1",
+		UrlSlug:   stringPtr("cowboy-bebop"),
+		TitleEn:   stringPtr("Cowboy Bebop"),
+		StartDate: stringPtr("1998-04-03T00:00:00Z"),
+		Genres:    stringPtr(`["Action","Sci-Fi"]`),
+	}
+	for _, action := range []Action{CreateAction, UpdateAction} {
+		if _, err := processor.Process(setupTestContext(), message(Payload{Action: action, Data: data})); err != nil {
+			t.Fatalf("%s: %v", action, err)
+		}
+	}
+
+	if len(mockAlgolia.Added) != 2 {
+		t.Fatalf("added %d documents, want one per create and update", len(mockAlgolia.Added))
+	}
+	want := data.ToDocument()
+	got := mockAlgolia.Added[1]
+	if got.ObjectID != "anime-1" || got.Slug == nil || *got.Slug != *want.Slug {
+		t.Errorf("document %+v, want objectID anime-1 and the slug", got)
+	}
+	if got.Year == nil || want.Year == nil || *got.Year != *want.Year {
+		t.Errorf("year = %v, want %v", got.Year, want.Year)
+	}
+	if len(got.Tags) != len(want.Tags) {
+		t.Errorf("tags = %v, want %v", got.Tags, want.Tags)
+	}
+}
+
+func TestProcess_DeletesTheRecord(t *testing.T) {
+	mockAlgolia := &MockAlgoliaService{}
+	processor := NewAlgoliaProcessor(mockAlgolia, config.AlgoliaConfig{}, nil)
+
+	payload := Payload{Action: DeleteAction, Data: Schema{Id: "anime-1"}}
+	if _, err := processor.Process(setupTestContext(), message(payload)); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if len(mockAlgolia.Deleted) != 1 || mockAlgolia.Deleted[0] != "anime-1" {
+		t.Errorf("deleted %v, want [anime-1]", mockAlgolia.Deleted)
+	}
+	if len(mockAlgolia.Added) != 0 {
+		t.Errorf("added %v on a delete", mockAlgolia.Added)
+	}
+}
+
+func TestProcess_RejectsWhatCannotBeIndexed(t *testing.T) {
+	tests := map[string]Payload{
+		"no id":          {Action: CreateAction, Data: Schema{}},
+		"unknown action": {Action: "upsert", Data: Schema{Id: "anime-1"}},
+	}
+	for name, payload := range tests {
+		t.Run(name, func(t *testing.T) {
+			mockAlgolia := &MockAlgoliaService{}
+			processor := NewAlgoliaProcessor(mockAlgolia, config.AlgoliaConfig{}, nil)
+			if _, err := processor.Process(setupTestContext(), message(payload)); err == nil {
+				t.Error("Process succeeded")
+			}
+			if len(mockAlgolia.Added) != 0 || len(mockAlgolia.Deleted) != 0 {
+				t.Errorf("wrote %v / %v", mockAlgolia.Added, mockAlgolia.Deleted)
+			}
+		})
+	}
+}
+
+func TestProcess_ReturnsAlgoliaErrors(t *testing.T) {
+	mockAlgolia := &MockAlgoliaService{AddErr: errors.New("batch send failed")}
+	processor := NewAlgoliaProcessor(mockAlgolia, config.AlgoliaConfig{}, nil)
+
+	payload := Payload{Action: CreateAction, Data: Schema{Id: "anime-1"}}
+	if _, err := processor.Process(setupTestContext(), message(payload)); err == nil {
+		t.Error("Process succeeded")
+	}
+}
+
+func TestFlush_WaitsForTasksWhenConfigured(t *testing.T) {
+	mockAlgolia := &MockAlgoliaService{}
+	if err := NewAlgoliaProcessor(mockAlgolia, config.AlgoliaConfig{}, nil).Flush(setupTestContext()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if mockAlgolia.Flushes != 1 || mockAlgolia.Waits != 0 {
+		t.Errorf("flushed %d and waited %d times, want 1 and 0", mockAlgolia.Flushes, mockAlgolia.Waits)
+	}
+
+	mockAlgolia = &MockAlgoliaService{WaitErr: errors.New("task still pending")}
+	processor := NewAlgoliaProcessor(mockAlgolia, config.AlgoliaConfig{WaitForTasks: true, TaskWaitTimeout: 1}, nil)
+	if err := processor.Flush(setupTestContext()); err == nil {
+		t.Error("Flush succeeded though Algolia did not confirm the writes")
+	}
+	if mockAlgolia.Waits != 1 {
+		t.Errorf("waited %d times, want 1", mockAlgolia.Waits)
+	}
+}
+
+func TestProcess_DropsWhatIsOlderThanAlgoliaHas(t *testing.T) {
+	ctx := setupTestContext()
+	mr := miniredis.RunT(t)
+	watermarks := redis.NewWatermarks(ctx, config.RedisConfig{URL: "redis://" + mr.Addr(), Key: "algolia-sync:data"})
+	version := func(v int64) *int64 { return &v }
+
+	mockAlgolia := &MockAlgoliaService{}
+	processor := NewAlgoliaProcessor(mockAlgolia, config.AlgoliaConfig{}, watermarks)
+	process := func(action Action, id string, updatedAt int64) {
+		t.Helper()
+		payload := Payload{Action: action, Data: Schema{Id: id, UpdatedAt: version(updatedAt)}}
+		if _, err := processor.Process(ctx, message(payload)); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	}
+
+	// Within one batch, before anything is recorded.
+	process(UpdateAction, "anime-1", 5)
+	process(UpdateAction, "anime-1", 3)
+	process(DeleteAction, "anime-2", 5)
+	process(CreateAction, "anime-2", 4)
+	if len(mockAlgolia.Added) != 1 || len(mockAlgolia.Deleted) != 1 {
+		t.Fatalf("queued %d adds and %d deletes, want 1 and 1", len(mockAlgolia.Added), len(mockAlgolia.Deleted))
+	}
+	if err := processor.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	// Across flushes, and across processors: what was sent is recorded.
+	mockAlgolia = &MockAlgoliaService{}
+	processor = NewAlgoliaProcessor(mockAlgolia, config.AlgoliaConfig{}, watermarks)
+	process(UpdateAction, "anime-1", 4)
+	process(CreateAction, "anime-2", 5)
+	if len(mockAlgolia.Added) != 0 {
+		t.Errorf("wrote %d stale documents over newer ones", len(mockAlgolia.Added))
+	}
+	process(UpdateAction, "anime-1", 6)
+	process(CreateAction, "anime-2", 6)
+	if len(mockAlgolia.Added) != 2 {
+		t.Errorf("queued %d newer documents, want 2", len(mockAlgolia.Added))
+	}
+}
+
+func TestFlush_RecordsNothingUnsent(t *testing.T) {
+	ctx := setupTestContext()
+	mr := miniredis.RunT(t)
+	watermarks := redis.NewWatermarks(ctx, config.RedisConfig{URL: "redis://" + mr.Addr(), Key: "algolia-sync:data"})
+	updatedAt := int64(5)
+
+	mockAlgolia := &MockAlgoliaService{WaitErr: errors.New("task still pending")}
+	processor := NewAlgoliaProcessor(mockAlgolia, config.AlgoliaConfig{WaitForTasks: true, TaskWaitTimeout: 1}, watermarks)
+	payload := Payload{Action: UpdateAction, Data: Schema{Id: "anime-1", UpdatedAt: &updatedAt}}
+	if _, err := processor.Process(ctx, message(payload)); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if err := processor.Flush(ctx); err == nil {
+		t.Fatal("Flush succeeded though Algolia did not confirm the writes")
+	}
+
+	marks, err := watermarks.Get(ctx, "anime-1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if mark, ok := marks["anime-1"]; ok {
+		t.Errorf("recorded %+v for a write Algolia did not confirm", mark)
+	}
+
+	mockAlgolia.WaitErr = nil
+	if err := processor.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if marks, _ = watermarks.Get(ctx, "anime-1"); marks["anime-1"].Version != 5 {
+		t.Errorf("recorded %+v once the write was confirmed, want version 5", marks["anime-1"])
+	}
+}
@@ -0,0 +1,143 @@
+package cloudevents
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
+)
+
+// Event is a CloudEvent, as far as indexing needs it: which anime, what
+// happened to it and its state after, and the id and time that tell one
+// delivery of an event from another and order events for the same anime.
+type Event struct {
+	SpecVersion     string          `json:"specversion"`
+	Type            string          `json:"type"`
+	Source          string          `json:"source"`
+	ID              string          `json:"id"`
+	Subject         string          `json:"subject"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// ErrInvalid marks an event that cannot be indexed however often it is tried.
+var ErrInvalid = errors.New("invalid CloudEvent")
+
+// Kafka's binary mode carries the attributes as headers with this prefix, and
+// the data as the message value.
+const (
+	HeaderPrefix      = "ce_"
+	ContentTypeHeader = "content-type"
+)
+
+// ParseStructured reads an event in structured mode, the attributes and data
+// in one JSON object. ok is false, with no error, for a message that is not a
+// CloudEvent, which the caller decodes as it would have.
+func ParseStructured(raw []byte) (event *Event, ok bool, err error) {
+	var e Event
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return nil, false, err
+	}
+	if e.SpecVersion == "" {
+		return nil, false, nil
+	}
+	return &e, true, nil
+}
+
+// FromHeaders reads an event in Kafka's binary mode from its headers, each
+// attribute under HeaderPrefix, and its value. ok is false for a message
+// without ce_specversion, which is not one.
+func FromHeaders(header func(key string) (string, bool), value []byte) (event *Event, ok bool) {
+	specVersion, ok := header(HeaderPrefix + "specversion")
+	if !ok || specVersion == "" {
+		return nil, false
+	}
+	attribute := func(name string) string {
+		v, _ := header(HeaderPrefix + name)
+		return v
+	}
+	contentType, _ := header(ContentTypeHeader)
+	return &Event{
+		SpecVersion:     specVersion,
+		Type:            attribute("type"),
+		Source:          attribute("source"),
+		ID:              attribute("id"),
+		Subject:         attribute("subject"),
+		Time:            attribute("time"),
+		DataContentType: contentType,
+		Data:            value,
+	}, true
+}
+
+// Payload maps the event onto the payload the rest of the pipeline queues.
+// The action is the last part of the type, so "anime.deleted" and
+// "com.example.anime.deleted" both delete; the anime id is the subject, or the
+// data's id for an event without one.
+func (e *Event) Payload() (*redis_processor.Payload, error) {
+	if e.ID == "" {
+		return nil, fmt.Errorf("%w: type %q has no id", ErrInvalid, e.Type)
+	}
+	action, err := actionOf(e.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	var data redis_processor.Schema
+	if len(e.Data) > 0 && string(e.Data) != "null" {
+		if !isJSON(e.DataContentType) {
+			return nil, fmt.Errorf("%w: %s has %s data, not JSON", ErrInvalid, e.ID, e.DataContentType)
+		}
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			return nil, fmt.Errorf("decoding the data of CloudEvent %s: %w", e.ID, err)
+		}
+	}
+	if e.Subject != "" {
+		data.Id = e.Subject
+	}
+	if data.Id == "" {
+		return nil, fmt.Errorf("%w: %s names no anime, with no subject and no id in its data", ErrInvalid, e.ID)
+	}
+
+	payload := &redis_processor.Payload{Action: action, Data: data, EventID: e.ID}
+	if e.Time != "" {
+		t, err := time.Parse(time.RFC3339Nano, e.Time)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s time: %v", ErrInvalid, e.ID, err)
+		}
+		payload.EventTime = t.UnixMicro()
+	}
+	return payload, nil
+}
+
+// actionOf derives the action from an event type.
+func actionOf(eventType string) (redis_processor.Action, error) {
+	verb := strings.ToLower(eventType[strings.LastIndex(eventType, ".")+1:])
+	switch verb {
+	case "created", "create":
+		return redis_processor.CreateAction, nil
+	case "updated", "update":
+		return redis_processor.UpdateAction, nil
+	case "deleted", "delete":
+		return redis_processor.DeleteAction, nil
+	default:
+		return "", fmt.Errorf("%w: no action for type %q", ErrInvalid, eventType)
+	}
+}
+
+// isJSON tells whether data of contentType is JSON. No content type means
+// JSON, as it does in structured mode.
+func isJSON(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,131 @@
+package cloudevents
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
+)
+
+const animeData = `{"id":"from-data","url_slug":"platinum-end","title_en":"Platinum End","episodes":24}`
+
+func TestPayloadTakesTheActionFromTheType(t *testing.T) {
+	tests := map[string]redis_processor.Action{
+		"anime.created":             redis_processor.CreateAction,
+		"anime.updated":             redis_processor.UpdateAction,
+		"anime.deleted":             redis_processor.DeleteAction,
+		"com.example.anime.Deleted": redis_processor.DeleteAction,
+		"update":                    redis_processor.UpdateAction,
+	}
+	for eventType, action := range tests {
+		t.Run(eventType, func(t *testing.T) {
+			event := &Event{SpecVersion: "1.0", Type: eventType, ID: "evt-1", Subject: "anime-1"}
+			payload, err := event.Payload()
+			if err != nil {
+				t.Fatalf("Payload: %v", err)
+			}
+			if payload.Action != action {
+				t.Errorf("action = %q, want %q", payload.Action, action)
+			}
+		})
+	}
+}
+
+func TestParseStructuredMapsTheEvent(t *testing.T) {
+	raw := `{"specversion":"1.0","type":"anime.updated","source":"/anime","id":"evt-1",` +
+		`"subject":"anime-1","time":"2024-05-01T12:00:00.5Z","datacontenttype":"application/json","data":` + animeData + `}`
+
+	event, ok, err := ParseStructured([]byte(raw))
+	if err != nil || !ok {
+		t.Fatalf("ParseStructured = %v, %v, want a CloudEvent", ok, err)
+	}
+	payload, err := event.Payload()
+	if err != nil {
+		t.Fatalf("Payload: %v", err)
+	}
+	if payload.Data.Id != "anime-1" {
+		t.Errorf("id = %q, want the subject", payload.Data.Id)
+	}
+	if payload.Data.Episodes == nil || *payload.Data.Episodes != 24 {
+		t.Errorf("episodes = %v, want 24", payload.Data.Episodes)
+	}
+	if payload.EventID != "evt-1" {
+		t.Errorf("event id = %q, want evt-1", payload.EventID)
+	}
+	want := time.Date(2024, 5, 1, 12, 0, 0, 500_000_000, time.UTC).UnixMicro()
+	if payload.EventTime != want {
+		t.Errorf("event time = %d, want %d", payload.EventTime, want)
+	}
+}
+
+func TestParseStructuredLeavesOtherMessagesAlone(t *testing.T) {
+	event, ok, err := ParseStructured([]byte(`{"action":"create","data":` + animeData + `}`))
+	if err != nil || ok || event != nil {
+		t.Errorf("ParseStructured = %+v, %v, %v, want not a CloudEvent", event, ok, err)
+	}
+	if _, _, err := ParseStructured([]byte("{")); err == nil {
+		t.Error("ParseStructured accepted invalid JSON")
+	}
+}
+
+func TestFromHeadersReadsBinaryMode(t *testing.T) {
+	headers := map[string]string{
+		"ce_specversion": "1.0",
+		"ce_type":        "anime.deleted",
+		"ce_id":          "evt-2",
+		"ce_subject":     "anime-2",
+		"content-type":   "application/json; charset=utf-8",
+	}
+	lookup := func(key string) (string, bool) {
+		v, ok := headers[key]
+		return v, ok
+	}
+
+	event, ok := FromHeaders(lookup, []byte(animeData))
+	if !ok {
+		t.Fatal("FromHeaders did not recognise the event")
+	}
+	payload, err := event.Payload()
+	if err != nil {
+		t.Fatalf("Payload: %v", err)
+	}
+	if payload.Action != redis_processor.DeleteAction || payload.Data.Id != "anime-2" || payload.EventID != "evt-2" {
+		t.Errorf("decoded %+v, want the delete of anime-2 by evt-2", payload)
+	}
+
+	delete(headers, "ce_specversion")
+	if _, ok := FromHeaders(lookup, []byte(animeData)); ok {
+		t.Error("FromHeaders took a message without ce_specversion for an event")
+	}
+}
+
+func TestPayloadFallsBackToTheDataID(t *testing.T) {
+	event := &Event{SpecVersion: "1.0", Type: "anime.created", ID: "evt-1", Data: []byte(animeData)}
+	payload, err := event.Payload()
+	if err != nil {
+		t.Fatalf("Payload: %v", err)
+	}
+	if payload.Data.Id != "from-data" {
+		t.Errorf("id = %q, want the data's", payload.Data.Id)
+	}
+}
+
+func TestPayloadRejectsWhatCannotBeIndexed(t *testing.T) {
+	tests := map[string]Event{
+		"no id":         {Type: "anime.created", Subject: "anime-1"},
+		"unknown type":  {Type: "anime.archived", ID: "evt-1", Subject: "anime-1"},
+		"no anime":      {Type: "anime.deleted", ID: "evt-1"},
+		"not json data": {Type: "anime.created", ID: "evt-1", Subject: "anime-1", DataContentType: "application/avro", Data: []byte{1, 2}},
+		"bad time":      {Type: "anime.created", ID: "evt-1", Subject: "anime-1", Time: "yesterday"},
+	}
+	for name, event := range tests {
+		t.Run(name, func(t *testing.T) {
+			event.SpecVersion = "1.0"
+			payload, err := event.Payload()
+			if !errors.Is(err, ErrInvalid) {
+				t.Errorf("Payload = %+v, %v, want ErrInvalid", payload, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package debezium
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
+)
+
+// Debezium's operation codes.
+const (
+	OpCreate   = "c"
+	OpUpdate   = "u"
+	OpDelete   = "d"
+	OpRead     = "r"
+	OpTruncate = "t"
+	OpMessage  = "m"
+)
+
+// Envelope is a Debezium change event: the row before and after the change,
+// and what the change was. Either row may be absent, and only the one the
+// operation needs is used. The tags are the JSON and, through the schema
+// registry decoder, the Avro field names.
+type Envelope struct {
+	Before *redis_processor.Schema `json:"before"`
+	After  *redis_processor.Schema `json:"after"`
+	Op     string                  `json:"op"`
+	Source Source                  `json:"source"`
+	TsMs   *int64                  `json:"ts_ms"`
+}
+
+// Source says where in the database the change happened.
+type Source struct {
+	Connector string `json:"connector"`
+	DB        string `json:"db"`
+	Schema    string `json:"schema"`
+	Table     string `json:"table"`
+	TsMs      *int64 `json:"ts_ms"`
+}
+
+// wrapped is the envelope as the JSON converter writes it with schemas
+// enabled, the default: the envelope under payload, its Connect schema
+// alongside.
+type wrapped struct {
+	Schema  json.RawMessage `json:"schema"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Decode turns one JSON Debezium message into the payload the rest of the
+// pipeline queues. It returns nil, and no error, for a tombstone, which
+// Debezium sends after a delete so compaction can drop the key.
+func Decode(raw []byte) (*redis_processor.Payload, error) {
+	envelope, err := unwrap(raw)
+	if err != nil || envelope == nil {
+		return nil, err
+	}
+	return envelope.Payload()
+}
+
+// Payload is the change as the payload the rest of the pipeline queues.
+// Snapshot reads and inserts become creates, updates updates, and deletes
+// deletes of the row as it was before.
+//
+// It returns nil, and no error, for a change that names no row: a truncate
+// or a logical message.
+func (e *Envelope) Payload() (*redis_processor.Payload, error) {
+	switch e.Op {
+	case OpCreate, OpRead:
+		return row(redis_processor.CreateAction, e.After, "after")
+	case OpUpdate:
+		return row(redis_processor.UpdateAction, e.After, "after")
+	case OpDelete:
+		return row(redis_processor.DeleteAction, e.Before, "before")
+	case OpTruncate, OpMessage:
+		return nil, nil
+	case "":
+		return nil, fmt.Errorf("not a Debezium change event: no op")
+	default:
+		return nil, fmt.Errorf("unknown Debezium op %q", e.Op)
+	}
+}
+
+// unwrap finds the envelope in raw, with or without the schema around it.
+// It returns nil for a tombstone.
+func unwrap(raw []byte) (*Envelope, error) {
+	if isNull(raw) {
+		return nil, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	_, hasOp := fields["op"]
+	_, hasSchema := fields["schema"]
+	_, hasPayload := fields["payload"]
+	if !hasOp && hasSchema && hasPayload {
+		var w wrapped
+		if err := json.Unmarshal(raw, &w); err != nil {
+			return nil, err
+		}
+		if isNull(w.Payload) {
+			return nil, nil
+		}
+		raw = w.Payload
+	}
+
+	var envelope Envelope
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return nil, err
+	}
+	return &envelope, nil
+}
+
+// row is the payload for action on data. name is which side of the envelope
+// it was, for the error.
+func row(action redis_processor.Action, data *redis_processor.Schema, name string) (*redis_processor.Payload, error) {
+	if data == nil {
+		// A delete has no before when the table's replica identity leaves
+		// it out, and then there is no id to delete.
+		return nil, fmt.Errorf("%s event has no %s row", action, name)
+	}
+	return &redis_processor.Payload{Action: action, Data: *data}, nil
+}
+
+func isNull(raw []byte) bool {
+	raw = bytes.TrimSpace(raw)
+	return len(raw) == 0 || bytes.Equal(raw, []byte("null"))
+}
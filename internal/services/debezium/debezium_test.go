@@ -0,0 +1,99 @@
+package debezium
+
+import (
+	"testing"
+
+	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
+)
+
+const animeRow = `{"id":"00057440-b6f2-438b-a296-e90ccabd00a0","url_slug":"platinum-end","title_en":"Platinum End","episodes":24,"updated_at":1700000000000000}`
+
+const source = `{"connector":"postgresql","db":"anime","schema":"public","table":"anime","ts_ms":1700000000000}`
+
+func TestDecodeMapsOperationsToActions(t *testing.T) {
+	tests := map[string]struct {
+		event  string
+		action redis_processor.Action
+	}{
+		"insert":   {`{"before":null,"after":` + animeRow + `,"op":"c","source":` + source + `}`, redis_processor.CreateAction},
+		"snapshot": {`{"before":null,"after":` + animeRow + `,"op":"r","source":` + source + `}`, redis_processor.CreateAction},
+		"update":   {`{"before":null,"after":` + animeRow + `,"op":"u","source":` + source + `}`, redis_processor.UpdateAction},
+		"delete":   {`{"before":` + animeRow + `,"after":null,"op":"d","source":` + source + `}`, redis_processor.DeleteAction},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			payload, err := Decode([]byte(tt.event))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if payload == nil {
+				t.Fatal("Decode returned nothing to process")
+			}
+			if payload.Action != tt.action {
+				t.Errorf("action = %q, want %q", payload.Action, tt.action)
+			}
+			data := payload.Data
+			if data.Id != "00057440-b6f2-438b-a296-e90ccabd00a0" {
+				t.Errorf("id = %q", data.Id)
+			}
+			if data.UrlSlug == nil || *data.UrlSlug != "platinum-end" {
+				t.Errorf("url_slug = %v, want platinum-end", data.UrlSlug)
+			}
+			if data.Episodes == nil || *data.Episodes != 24 {
+				t.Errorf("episodes = %v, want 24", data.Episodes)
+			}
+		})
+	}
+}
+
+func TestDecodeUnwrapsTheSchema(t *testing.T) {
+	event := `{"schema":{"type":"struct","name":"anime.public.anime.Envelope","fields":[]},` +
+		`"payload":{"before":null,"after":` + animeRow + `,"op":"u","source":` + source + `,"ts_ms":1700000000123}}`
+
+	payload, err := Decode([]byte(event))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if payload == nil || payload.Action != redis_processor.UpdateAction || payload.Data.Id == "" {
+		t.Errorf("decoded %+v, want the update of the row under payload", payload)
+	}
+}
+
+func TestDecodeSkipsWhatChangesNoRow(t *testing.T) {
+	tests := map[string]string{
+		"empty tombstone":   "",
+		"null tombstone":    "null",
+		"wrapped tombstone": `{"schema":null,"payload":null}`,
+		"truncate":          `{"before":null,"after":null,"op":"t","source":` + source + `}`,
+		"logical message":   `{"op":"m","source":` + source + `,"message":{"prefix":"x","content":""}}`,
+	}
+	for name, event := range tests {
+		t.Run(name, func(t *testing.T) {
+			payload, err := Decode([]byte(event))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if payload != nil {
+				t.Errorf("decoded %+v, want nothing to process", payload)
+			}
+		})
+	}
+}
+
+func TestDecodeRejectsWhatIsNotAChangeEvent(t *testing.T) {
+	tests := map[string]string{
+		"not json":            "{",
+		"our own payload":     `{"action":"create","data":` + animeRow + `}`,
+		"unknown op":          `{"after":` + animeRow + `,"op":"x"}`,
+		"delete without row":  `{"before":null,"after":null,"op":"d"}`,
+		"insert without row":  `{"before":null,"after":null,"op":"c"}`,
+		"row of another type": `{"after":{"id":42},"op":"c"}`,
+	}
+	for name, event := range tests {
+		t.Run(name, func(t *testing.T) {
+			if payload, err := Decode([]byte(event)); err == nil {
+				t.Errorf("Decode accepted it as %+v", payload)
+			}
+		})
+	}
+}
@@ -14,13 +14,24 @@ type ProcessorImpl[T any] interface {
 }
 
 type Processor[T any] struct {
+	decode func(ctx context.Context, payload []byte) (*T, error)
 }
 
 func NewProcessor[T any]() *Processor[T] {
 	return &Processor[T]{}
 }
 
+// NewProcessorWithDecoder parses payloads with decode in place of plain JSON,
+// for sources whose messages wrap T in an envelope. decode returns nil, and
+// no error, for a message that carries nothing to process.
+func NewProcessorWithDecoder[T any](decode func(ctx context.Context, payload []byte) (*T, error)) *Processor[T] {
+	return &Processor[T]{decode: decode}
+}
+
 func (p *Processor[T]) Parse(ctx context.Context, payload string) (*T, error) {
+	if p.decode != nil {
+		return p.decode(ctx, []byte(payload))
+	}
 	// parse from json
 	var data T
 	err := json.Unmarshal([]byte(payload), &data)
@@ -36,6 +47,10 @@ func (p *Processor[T]) Process(ctx context.Context, payload string, fn Processor
 	if err != nil {
 		return err
 	}
+	if data == nil {
+		// Nothing to process, as with a tombstone.
+		return nil
+	}
 
 	// do something with data
 
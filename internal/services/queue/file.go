@@ -0,0 +1,208 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// FileQueue is an append-only log of JSON lines on local disk, for running the
+// pipeline without a Redis server.
+//
+// It claims the way the Redis list does: the log is renamed to a claimed file,
+// so writes that arrive mid-sync start a fresh log, and a leftover claimed
+// file is the batch of a sync that died and is worked before anything newer.
+// Every StoreData opens, appends and closes under a lock on the directory; no
+// writer keeps the log open across a rename and ends up appending to the
+// claimed batch.
+type FileQueue[T any] struct {
+	dir  string
+	sync bool
+}
+
+func NewFileQueue[T any](queueCfg config.QueueConfig) (*FileQueue[T], error) {
+	if err := os.MkdirAll(queueCfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create queue directory: %w", err)
+	}
+	return &FileQueue[T]{dir: queueCfg.Dir, sync: queueCfg.FileSync}, nil
+}
+
+func (q *FileQueue[T]) logPath() string     { return filepath.Join(q.dir, "queue.log") }
+func (q *FileQueue[T]) claimedPath() string { return filepath.Join(q.dir, "queue.claimed.log") }
+func (q *FileQueue[T]) deadPath() string    { return filepath.Join(q.dir, "queue.dead.log") }
+func (q *FileQueue[T]) lockPath() string    { return filepath.Join(q.dir, "queue.lock") }
+
+func (q *FileQueue[T]) StoreData(ctx context.Context, data T) error {
+	log := logger.FromCtx(ctx)
+
+	line, err := json.Marshal(data)
+	if err != nil {
+		log.Error("Failed to marshal data to JSON", zap.Error(err))
+		return err
+	}
+
+	err = q.locked(func() error {
+		return q.appendLine(q.logPath(), line)
+	})
+	if err != nil {
+		log.Error("Failed to store data in the queue log", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetAllData claims the log, or recovers a claimed batch left behind.
+func (q *FileQueue[T]) GetAllData(ctx context.Context) ([]T, error) {
+	log := logger.FromCtx(ctx)
+
+	err := q.locked(func() error {
+		if _, err := os.Stat(q.claimedPath()); err == nil {
+			log.Warn("recovering a batch left behind by a previous run",
+				zap.String("path", q.claimedPath()))
+			return nil
+		}
+		err := os.Rename(q.logPath(), q.claimedPath())
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		log.Error("Failed to claim the queue log", zap.Error(err))
+		return nil, err
+	}
+
+	f, err := os.Open(q.claimedPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		results []T
+		kept    [][]byte
+		dead    [][]byte
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var data T
+		if err := json.Unmarshal(line, &data); err != nil {
+			// Most likely the last line of a write cut short by a crash.
+			log.Warn("Failed to unmarshal item, moving it to the dead log", zap.Error(err))
+			dead = append(dead, append([]byte(nil), line...))
+			continue
+		}
+		results = append(results, data)
+		kept = append(kept, append([]byte(nil), line...))
+	}
+	if err := scanner.Err(); err != nil {
+		log.Error("Failed to read the claimed queue log", zap.Error(err))
+		return nil, err
+	}
+
+	if len(dead) > 0 {
+		// The claimed file loses the dead lines in the same step, or a sync
+		// that fails and is retried moves them to the dead log again.
+		err := q.locked(func() error {
+			for _, line := range dead {
+				if err := q.appendLine(q.deadPath(), line); err != nil {
+					return err
+				}
+			}
+			return q.rewrite(q.claimedPath(), kept)
+		})
+		if err != nil {
+			log.Error("Failed to move items to the dead log", zap.Error(err))
+			return nil, err
+		}
+	}
+
+	log.Info("Retrieved data from the queue log", zap.Int("count", len(results)))
+	return results, nil
+}
+
+func (q *FileQueue[T]) ClearData(ctx context.Context) error {
+	err := os.Remove(q.claimedPath())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.FromCtx(ctx).Error("Failed to clear the claimed queue log", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func (q *FileQueue[T]) appendLine(path string, line []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if q.sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// rewrite replaces the file at path with lines. It writes a new file and
+// renames it over the old one, so a crash leaves one or the other whole.
+func (q *FileQueue[T]) rewrite(path string, lines [][]byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range lines {
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if q.sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// locked runs fn holding the directory lock, which other processes using the
+// same directory respect too.
+func (q *FileQueue[T]) locked(fn func() error) error {
+	unlock, err := lockFile(q.lockPath())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn()
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package queue
+
+import "sync"
+
+var fileLock sync.Mutex
+
+// lockFile only excludes this process where flock is unavailable, so the file
+// backend there supports a consumer and sync running in one process.
+func lockFile(path string) (func(), error) {
+	fileLock.Lock()
+	return fileLock.Unlock, nil
+}
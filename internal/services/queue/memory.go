@@ -0,0 +1,89 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// MemoryQueue keeps items in the process. Nothing survives a restart.
+//
+// Items are held encoded, as Redis holds them, so queues of different item
+// types can share a store: the consumers and the sync each have their own
+// QueuedItem type, and in one serve process they must still see the same
+// queue.
+type MemoryQueue[T any] struct {
+	store *memoryStore
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	pending [][]byte
+	claimed [][]byte
+	// dead holds the items that did not decode, as the Redis and file
+	// backends keep theirs, so they can be looked at rather than lost.
+	dead [][]byte
+}
+
+// processMemory is the store every queue New builds shares, as every consumer
+// shares one Redis key.
+var processMemory = &memoryStore{}
+
+// NewMemoryQueue returns a queue with a store of its own.
+func NewMemoryQueue[T any]() *MemoryQueue[T] {
+	return &MemoryQueue[T]{store: &memoryStore{}}
+}
+
+func (q *MemoryQueue[T]) StoreData(ctx context.Context, data T) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to marshal data to JSON", zap.Error(err))
+		return err
+	}
+
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	q.store.pending = append(q.store.pending, encoded)
+	return nil
+}
+
+// GetAllData claims everything pending, or returns the unfinished claim again.
+func (q *MemoryQueue[T]) GetAllData(ctx context.Context) ([]T, error) {
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+
+	if q.store.claimed == nil {
+		q.store.claimed, q.store.pending = q.store.pending, nil
+	}
+	results := make([]T, 0, len(q.store.claimed))
+	kept := q.store.claimed[:0]
+	for _, encoded := range q.store.claimed {
+		var data T
+		if err := json.Unmarshal(encoded, &data); err != nil {
+			// Taken off the claim as well, so a retried sync does not
+			// dead-letter it a second time.
+			logger.FromCtx(ctx).Warn("Failed to unmarshal item, dead-lettering it", zap.Error(err))
+			q.store.dead = append(q.store.dead, encoded)
+			continue
+		}
+		results = append(results, data)
+		kept = append(kept, encoded)
+	}
+	q.store.claimed = kept
+	if len(kept) == 0 {
+		// Nothing left to clear, so the next call claims afresh.
+		q.store.claimed = nil
+	}
+	logger.FromCtx(ctx).Info("Retrieved data from the memory queue", zap.Int("count", len(results)))
+	return results, nil
+}
+
+func (q *MemoryQueue[T]) ClearData(ctx context.Context) error {
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	q.store.claimed = nil
+	return nil
+}
@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis"
+)
+
+// Backends selectable through QueueConfig.Backend.
+const (
+	RedisBackend  = "redis"
+	FileBackend   = "file"
+	MemoryBackend = "memory"
+)
+
+// Queue holds items between the consumer, which stores them, and the sync,
+// which claims everything stored, sends it to Algolia, and clears the claim.
+//
+// It is the contract redis.RedisService has always offered, so the Redis
+// implementation satisfies it as it is. GetAllData returns the same claimed
+// items again until ClearData, which is how a sync that died part way is
+// retried by the next one.
+type Queue[T any] interface {
+	StoreData(ctx context.Context, data T) error
+	GetAllData(ctx context.Context) ([]T, error)
+	ClearData(ctx context.Context) error
+}
+
+// New builds the backend cfg selects. Writes to Redis go through a
+// redis.BufferedWriter, so concurrent producers share pipelines; it runs until
+// ctx is done.
+func New[T any](ctx context.Context, cfg config.Config) (Queue[T], error) {
+	switch cfg.QueueConfig.Backend {
+	case "", RedisBackend:
+		writer, err := redis.NewBufferedWriter[T](ctx, redis.NewRedisService[T](ctx, cfg.RedisConfig), cfg.RedisConfig)
+		if err != nil {
+			return nil, err
+		}
+		return writer, nil
+	case FileBackend:
+		return NewFileQueue[T](cfg.QueueConfig)
+	case MemoryBackend:
+		return &MemoryQueue[T]{store: processMemory}, nil
+	}
+	return nil, fmt.Errorf("unknown queue backend %q", cfg.QueueConfig.Backend)
+}
+
+// Close releases what q holds, writing out anything it buffers first. Backends
+// with nothing to release are left alone.
+func Close[T any](q Queue[T]) error {
+	if closer, ok := q.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
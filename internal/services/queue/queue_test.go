@@ -0,0 +1,195 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/weeb-vip/algolia-sync/config"
+)
+
+type item struct {
+	ID string `json:"id"`
+}
+
+func ids(items []item) []string {
+	out := make([]string, len(items))
+	for i, it := range items {
+		out[i] = it.ID
+	}
+	return out
+}
+
+func backends(t *testing.T) map[string]Queue[item] {
+	t.Helper()
+	file, err := NewFileQueue[item](config.QueueConfig{Dir: t.TempDir(), FileSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Queue[item]{
+		MemoryBackend: NewMemoryQueue[item](),
+		FileBackend:   file,
+	}
+}
+
+func TestClaimKeepsLaterWritesForTheNextRun(t *testing.T) {
+	for name, q := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			_ = q.StoreData(ctx, item{ID: "a"})
+			_ = q.StoreData(ctx, item{ID: "b"})
+
+			claimed, err := q.GetAllData(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(claimed); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+				t.Fatalf("expected a, b; got %v", got)
+			}
+
+			_ = q.StoreData(ctx, item{ID: "c"})
+			// Not cleared: the same batch comes back, without c.
+			again, _ := q.GetAllData(ctx)
+			if got := ids(again); len(got) != 2 || got[1] != "b" {
+				t.Fatalf("an unfinished claim should be returned again, got %v", got)
+			}
+
+			if err := q.ClearData(ctx); err != nil {
+				t.Fatal(err)
+			}
+			next, _ := q.GetAllData(ctx)
+			if got := ids(next); len(got) != 1 || got[0] != "c" {
+				t.Errorf("expected c alone, got %v", got)
+			}
+		})
+	}
+}
+
+func TestConcurrentWritesDuringClaimsAreNotLost(t *testing.T) {
+	for name, q := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			const n = 200
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < n; i++ {
+					_ = q.StoreData(ctx, item{ID: fmt.Sprint(i)})
+				}
+			}()
+
+			seen := map[string]bool{}
+			drain := func() {
+				items, err := q.GetAllData(ctx)
+				if err != nil {
+					t.Error(err)
+				}
+				for _, it := range items {
+					seen[it.ID] = true
+				}
+				_ = q.ClearData(ctx)
+			}
+			for i := 0; i < 20; i++ {
+				drain()
+			}
+			wg.Wait()
+			drain()
+
+			if len(seen) != n {
+				t.Errorf("expected %d distinct items, got %d", n, len(seen))
+			}
+		})
+	}
+}
+
+func TestFileQueueMovesATornLineToTheDeadLog(t *testing.T) {
+	dir := t.TempDir()
+	q, _ := NewFileQueue[item](config.QueueConfig{Dir: dir})
+	ctx := context.Background()
+	_ = q.StoreData(ctx, item{ID: "a"})
+
+	f, _ := os.OpenFile(q.logPath(), os.O_APPEND|os.O_WRONLY, 0o644)
+	_, _ = f.WriteString(`{"id":"b`)
+	f.Close()
+
+	items, err := q.GetAllData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(items); len(got) != 1 || got[0] != "a" {
+		t.Errorf("expected a alone, got %v", got)
+	}
+	dead, _ := os.ReadFile(q.deadPath())
+	if string(dead) != "{\"id\":\"b\n" {
+		t.Errorf("expected the torn line in the dead log, got %q", dead)
+	}
+}
+
+func TestFileQueueDeadLettersATornLineOnce(t *testing.T) {
+	q, _ := NewFileQueue[item](config.QueueConfig{Dir: t.TempDir()})
+	ctx := context.Background()
+	_ = q.StoreData(ctx, item{ID: "a"})
+	f, _ := os.OpenFile(q.logPath(), os.O_APPEND|os.O_WRONLY, 0o644)
+	_, _ = f.WriteString(`{"id":"b`)
+	f.Close()
+
+	// The sync fails and is retried from the claimed file.
+	for run := 0; run < 2; run++ {
+		items, err := q.GetAllData(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(items); len(got) != 1 || got[0] != "a" {
+			t.Fatalf("run %d: expected a alone, got %v", run, got)
+		}
+	}
+	dead, _ := os.ReadFile(q.deadPath())
+	if string(dead) != "{\"id\":\"b\n" {
+		t.Errorf("expected the torn line in the dead log once, got %q", dead)
+	}
+}
+
+func TestMemoryQueueDeadLettersAnUndecodableItem(t *testing.T) {
+	q := NewMemoryQueue[item]()
+	ctx := context.Background()
+	_ = q.StoreData(ctx, item{ID: "a"})
+	q.store.pending = append(q.store.pending, []byte(`{"id":`))
+
+	for run := 0; run < 2; run++ {
+		items, err := q.GetAllData(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(items); len(got) != 1 || got[0] != "a" {
+			t.Fatalf("run %d: expected a alone, got %v", run, got)
+		}
+	}
+	if len(q.store.dead) != 1 || string(q.store.dead[0]) != `{"id":` {
+		t.Errorf("expected the undecodable item dead-lettered once, got %q", q.store.dead)
+	}
+}
+
+func TestMemoryQueuesFromNewShareTheProcessStore(t *testing.T) {
+	type other struct {
+		ID   string `json:"id"`
+		Note string `json:"note"`
+	}
+	ctx := context.Background()
+	cfg := config.Config{QueueConfig: config.QueueConfig{Backend: MemoryBackend}}
+	producer, _ := New[item](ctx, cfg)
+	consumer, _ := New[other](ctx, cfg)
+	t.Cleanup(func() { _ = consumer.ClearData(ctx) })
+
+	_ = producer.StoreData(ctx, item{ID: "a"})
+	got, err := consumer.GetAllData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ID != "a" {
+		t.Errorf("expected the item stored through another type, got %v", got)
+	}
+}
@@ -0,0 +1,223 @@
+package redis
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Topologies selectable through RedisConfig.Topology.
+const (
+	SingleTopology   = "single"
+	SentinelTopology = "sentinel"
+	ClusterTopology  = "cluster"
+)
+
+// clients holds one client per configuration. A client is a connection pool
+// meant to be shared; building one per service was harmless in a cron job, but
+// a process syncing on an interval opened fresh pools every run and never
+// closed them.
+var (
+	clientsMu sync.Mutex
+	clients   = map[config.RedisConfig]redis.UniversalClient{}
+)
+
+func newClient(ctx context.Context, redisCfg config.RedisConfig) redis.UniversalClient {
+	log := logger.FromCtx(ctx)
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if client, ok := clients[redisCfg]; ok {
+		return client
+	}
+
+	client, err := buildClient(redisCfg)
+	if err != nil {
+		log.Fatal("Failed to configure Redis", zap.Error(err))
+	}
+
+	// Test connection
+	_, err = client.Ping(ctx).Result()
+	if err != nil {
+		log.Fatal("Failed to connect to Redis", zap.Error(err))
+	}
+
+	log.Info("Successfully connected to Redis", zap.String("topology", redisCfg.Topology))
+
+	clients[redisCfg] = client
+	return client
+}
+
+// PingClients is a readiness check on every connection the package opened.
+func PingClients(ctx context.Context) error {
+	clientsMu.Lock()
+	open := make([]redis.UniversalClient, 0, len(clients))
+	for _, client := range clients {
+		open = append(open, client)
+	}
+	clientsMu.Unlock()
+
+	for _, client := range open {
+		if err := client.Ping(ctx).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CloseClients closes every connection the package opened. Call it once
+// nothing uses Redis any more.
+func CloseClients() error {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	var errs []error
+	for redisCfg, client := range clients {
+		errs = append(errs, client.Close())
+		delete(clients, redisCfg)
+	}
+	return errors.Join(errs...)
+}
+
+func buildClient(redisCfg config.RedisConfig) (redis.UniversalClient, error) {
+	tlsConfig, err := buildTLSConfig(redisCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch redisCfg.Topology {
+	case "", SingleTopology:
+		opts, err := redis.ParseURL(redisCfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("parse Redis URL: %w", err)
+		}
+		if redisCfg.Username != "" {
+			opts.Username = redisCfg.Username
+		}
+		if redisCfg.Password != "" {
+			opts.Password = redisCfg.Password
+		}
+		opts.DB = redisCfg.DB
+		// A rediss:// URL already set a default; explicit settings replace it.
+		if tlsConfig != nil {
+			opts.TLSConfig = tlsConfig
+		}
+		opts.DialTimeout, opts.ReadTimeout, opts.WriteTimeout = timeouts(redisCfg)
+		return redis.NewClient(opts), nil
+
+	case SentinelTopology, ClusterTopology:
+		opts := &redis.UniversalOptions{
+			Username:  redisCfg.Username,
+			Password:  redisCfg.Password,
+			TLSConfig: tlsConfig,
+		}
+		opts.DialTimeout, opts.ReadTimeout, opts.WriteTimeout = timeouts(redisCfg)
+
+		if redisCfg.Topology == ClusterTopology {
+			opts.Addrs = splitAddrs(redisCfg.ClusterAddrs)
+			if len(opts.Addrs) == 0 {
+				return nil, fmt.Errorf("cluster topology needs ClusterAddrs")
+			}
+			return redis.NewClusterClient(opts.Cluster()), nil
+		}
+
+		opts.Addrs = splitAddrs(redisCfg.SentinelAddrs)
+		opts.MasterName = redisCfg.SentinelMaster
+		opts.SentinelPassword = redisCfg.SentinelPassword
+		opts.DB = redisCfg.DB
+		if len(opts.Addrs) == 0 || opts.MasterName == "" {
+			return nil, fmt.Errorf("sentinel topology needs SentinelAddrs and SentinelMaster")
+		}
+		return redis.NewFailoverClient(opts.Failover()), nil
+	}
+
+	return nil, fmt.Errorf("unknown Redis topology %q", redisCfg.Topology)
+}
+
+// buildTLSConfig returns nil when nothing asks for TLS, which leaves a
+// rediss:// URL's own setting alone.
+func buildTLSConfig(redisCfg config.RedisConfig) (*tls.Config, error) {
+	if !redisCfg.TLS && redisCfg.TLSCAFile == "" && redisCfg.TLSCertFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         redisCfg.TLSServerName,
+		InsecureSkipVerify: redisCfg.TLSInsecureSkipVerify,
+	}
+
+	if redisCfg.TLSCAFile != "" {
+		pem, err := os.ReadFile(redisCfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read Redis CA: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", redisCfg.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if redisCfg.TLSCertFile != "" || redisCfg.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(redisCfg.TLSCertFile, redisCfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load Redis client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func timeouts(redisCfg config.RedisConfig) (dial, read, write time.Duration) {
+	return time.Duration(redisCfg.DialTimeout) * time.Millisecond,
+		time.Duration(redisCfg.ReadTimeout) * time.Millisecond,
+		time.Duration(redisCfg.WriteTimeout) * time.Millisecond
+}
+
+func splitAddrs(addrs string) []string {
+	var out []string
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// queueKey is the key every other is derived from. A cluster places keys by
+// the hash of their {tag} when they have one, so tagging the base key keeps
+// the live queue, its claimed twin and the rest on one slot; RENAME and the
+// scripts fail with CROSSSLOT otherwise.
+func queueKey(redisCfg config.RedisConfig) string {
+	key := redisCfg.Key
+	if redisCfg.Topology != ClusterTopology || hasHashTag(key) {
+		return key
+	}
+	return "{" + key + "}"
+}
+
+func hasHashTag(key string) bool {
+	open := strings.IndexByte(key, '{')
+	if open < 0 {
+		return false
+	}
+	end := strings.IndexByte(key[open+1:], '}')
+	// An empty {} is not a tag; Redis hashes the whole key.
+	return end > 0
+}
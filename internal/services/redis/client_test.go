@@ -0,0 +1,72 @@
+package redis
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/weeb-vip/algolia-sync/config"
+)
+
+func TestQueueKeyIsHashTaggedOnlyInACluster(t *testing.T) {
+	for _, tc := range []struct {
+		topology, key, want string
+	}{
+		{SingleTopology, "algolia-sync:data", "algolia-sync:data"},
+		{SentinelTopology, "algolia-sync:data", "algolia-sync:data"},
+		{ClusterTopology, "algolia-sync:data", "{algolia-sync:data}"},
+		{ClusterTopology, "{sync}:data", "{sync}:data"},
+		{ClusterTopology, "odd{}key", "{odd{}key}"},
+	} {
+		got := queueKey(config.RedisConfig{Topology: tc.topology, Key: tc.key})
+		if got != tc.want {
+			t.Errorf("%s %q: expected %q, got %q", tc.topology, tc.key, tc.want, got)
+		}
+	}
+}
+
+func TestBuildClientPicksTheTopology(t *testing.T) {
+	cluster, err := buildClient(config.RedisConfig{Topology: ClusterTopology, ClusterAddrs: "a:7000, b:7001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cluster.(*redis.ClusterClient); !ok {
+		t.Errorf("expected a cluster client, got %T", cluster)
+	}
+	cluster.Close()
+
+	sentinel, err := buildClient(config.RedisConfig{Topology: SentinelTopology, SentinelAddrs: "s:26379", SentinelMaster: "main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sentinel.Close()
+
+	for _, cfg := range []config.RedisConfig{
+		{Topology: ClusterTopology},
+		{Topology: SentinelTopology, SentinelAddrs: "s:26379"},
+		{Topology: "mesh"},
+	} {
+		if _, err := buildClient(cfg); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
+
+func TestBuildTLSConfigRejectsACAFileWithoutCertificates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buildTLSConfig(config.RedisConfig{TLSCAFile: path}); err == nil {
+		t.Error("expected an error for a CA file with no certificates")
+	}
+
+	tlsConfig, err := buildTLSConfig(config.RedisConfig{TLS: true, TLSServerName: "redis.internal"})
+	if err != nil || tlsConfig == nil || tlsConfig.ServerName != "redis.internal" {
+		t.Errorf("expected a TLS config for redis.internal, got %+v, %v", tlsConfig, err)
+	}
+	if tlsConfig, _ := buildTLSConfig(config.RedisConfig{}); tlsConfig != nil {
+		t.Error("expected no TLS config when nothing asks for it")
+	}
+}
@@ -0,0 +1,200 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Keyed is what the coalescing mode needs to know about an item: which record
+// it describes, and how recent it is. Of two items with the same key, the one
+// with the higher updatedAt wins when both carry one, and the later queuedAt
+// otherwise.
+type Keyed interface {
+	QueueKey() string
+	QueueVersion() (updatedAt, queuedAt int64)
+}
+
+// The coalescing mode keeps one pending entry per record instead of a list.
+//
+// A catalogue replay pushes ~30,000 items, and the same anime often appears
+// several times before the sync runs; as a list, every one of them was an
+// Algolia operation, and all but the last were overwritten moments later.
+// Keyed by id, a newer create, update or delete replaces the pending one, so a
+// run sends at most one operation per anime.
+//
+// Three keys hold the queue, and each has a claimed twin the sync works from:
+// the entries by id, their versions by id, and the order ids first arrived in.
+func (r *RedisServiceImpl[T]) pendingKey() string  { return r.key + ":pending" }
+func (r *RedisServiceImpl[T]) versionsKey() string { return r.key + ":versions" }
+func (r *RedisServiceImpl[T]) orderKey() string    { return r.key + ":order" }
+
+// coalesceScript replaces the pending entry for an id unless the stored one is
+// newer. The first arrival fixes the id's position (ZADD NX), so an anime that
+// keeps changing is not pushed back indefinitely.
+var coalesceScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[2], ARGV[1])
+if current then
+  local sep = string.find(current, ':')
+  local curUpdated = tonumber(string.sub(current, 1, sep - 1))
+  local curQueued = tonumber(string.sub(current, sep + 1))
+  local newUpdated = tonumber(ARGV[2])
+  local newQueued = tonumber(ARGV[3])
+  local older
+  if curUpdated > 0 and newUpdated > 0 then
+    older = newUpdated < curUpdated
+  else
+    older = newQueued < curQueued
+  end
+  if older then
+    return 0
+  end
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[4])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2] .. ':' .. ARGV[3])
+redis.call('ZADD', KEYS[3], 'NX', ARGV[5], ARGV[1])
+return 1
+`)
+
+// claimCoalescedScript moves all three live keys to their claimed names at
+// once, or does nothing when the queue is empty.
+var claimCoalescedScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[3]) == 0 then
+  return 0
+end
+redis.call('RENAME', KEYS[1], KEYS[4])
+redis.call('RENAME', KEYS[2], KEYS[5])
+redis.call('RENAME', KEYS[3], KEYS[6])
+return 1
+`)
+
+func (r *RedisServiceImpl[T]) storeCoalesced(ctx context.Context, data T, encoded []byte) error {
+	keys, args, err := r.coalesceArgs(data, encoded)
+	if err != nil {
+		return err
+	}
+
+	stored, err := coalesceScript.Run(ctx, r.client, keys, args...).Int()
+	if err != nil {
+		return err
+	}
+	if stored == 0 {
+		logger.FromCtx(ctx).Info("dropped an item older than the one already pending",
+			zap.String("key", args[0].(string)))
+	}
+	return nil
+}
+
+func (r *RedisServiceImpl[T]) coalesceArgs(data T, encoded []byte) ([]string, []any, error) {
+	keyed, ok := any(data).(Keyed)
+	if !ok {
+		return nil, nil, fmt.Errorf("coalescing queue needs items that implement redis.Keyed, got %T", data)
+	}
+	id := keyed.QueueKey()
+	if id == "" {
+		return nil, nil, fmt.Errorf("cannot coalesce an item with no key")
+	}
+	updatedAt, queuedAt := keyed.QueueVersion()
+
+	return []string{r.pendingKey(), r.versionsKey(), r.orderKey()},
+		[]any{id, updatedAt, queuedAt, encoded, time.Now().UnixMilli()}, nil
+}
+
+// getAllCoalesced claims the pending entries and returns them in arrival order,
+// recovering an orphaned claim first as the batch mode does.
+func (r *RedisServiceImpl[T]) getAllCoalesced(ctx context.Context) ([]T, error) {
+	log := logger.FromCtx(ctx)
+	claimedPending := r.pendingKey() + ":claimed"
+	claimedOrder := r.orderKey() + ":claimed"
+
+	if claimed, err := r.claimCoalesced(ctx); err != nil || !claimed {
+		return nil, err
+	}
+
+	ids, err := r.client.ZRange(ctx, claimedOrder, 0, -1).Result()
+	if err != nil {
+		log.Error("Failed to get data from Redis", zap.Error(err))
+		return nil, err
+	}
+
+	var results []T
+	for start := 0; start < len(ids); start += 1000 {
+		page := ids[start:min(start+1000, len(ids))]
+		raws, err := r.client.HMGet(ctx, claimedPending, page...).Result()
+		if err != nil {
+			log.Error("Failed to get data from Redis", zap.Error(err))
+			return nil, err
+		}
+		for i, raw := range raws {
+			s, ok := raw.(string)
+			if !ok {
+				continue
+			}
+			var data T
+			if decodeErr := DecodeEntry(s, &data); decodeErr != nil {
+				log.Warn("Failed to unmarshal item, dead-lettering it", zap.Error(decodeErr))
+				err := fencedTx(ctx, r.client, func(pipe redis.Pipeliner) error {
+					pipe.HDel(ctx, claimedPending, page[i])
+					pipe.ZRem(ctx, claimedOrder, page[i])
+					return pushDeadLetter(ctx, pipe, r.key, newDeadLetter(s, UndecodableReason, decodeErr, 0))
+				})
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			results = append(results, data)
+		}
+	}
+
+	log.Info("Retrieved data from Redis", zap.Int("count", len(results)))
+	return results, nil
+}
+
+// claimCoalesced claims the pending entries, or reports false when there is
+// nothing to claim.
+func (r *RedisServiceImpl[T]) claimCoalesced(ctx context.Context) (bool, error) {
+	log := logger.FromCtx(ctx)
+	claimedOrder := r.orderKey() + ":claimed"
+
+	orphaned, err := r.client.Exists(ctx, claimedOrder).Result()
+	if err != nil {
+		log.Error("Failed to check for an orphaned batch", zap.Error(err))
+		return false, err
+	}
+	if orphaned > 0 {
+		log.Warn("recovering a batch left behind by a previous run",
+			zap.String("key", claimedOrder))
+		return true, nil
+	}
+
+	var claim *redis.Cmd
+	err = fencedTx(ctx, r.client, func(pipe redis.Pipeliner) error {
+		claim = claimCoalescedScript.Eval(ctx, pipe, []string{
+			r.pendingKey(), r.versionsKey(), r.orderKey(),
+			r.pendingKey() + ":claimed", r.versionsKey() + ":claimed", claimedOrder,
+		})
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to claim the Redis queue", zap.Error(err))
+		return false, err
+	}
+	claimed, err := claim.Int()
+	return claimed == 1, err
+}
+
+func (r *RedisServiceImpl[T]) clearCoalesced(ctx context.Context) error {
+	return fencedTx(ctx, r.client, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx,
+			r.pendingKey()+":claimed",
+			r.versionsKey()+":claimed",
+			r.orderKey()+":claimed",
+		)
+		return nil
+	})
+}
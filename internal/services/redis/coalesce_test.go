@@ -0,0 +1,112 @@
+package redis
+
+import (
+	"context"
+	"testing"
+)
+
+type versioned struct {
+	ID        string `json:"id"`
+	Action    string `json:"action"`
+	UpdatedAt int64  `json:"updated_at"`
+	Queued    int64  `json:"queued"`
+}
+
+func (v versioned) QueueKey() string { return v.ID }
+
+func (v versioned) QueueVersion() (int64, int64) { return v.UpdatedAt, v.Queued }
+
+func newCoalescingService(t *testing.T) *RedisServiceImpl[versioned] {
+	t.Helper()
+	plain, _ := newTestService(t)
+	return &RedisServiceImpl[versioned]{client: plain.client, key: plain.key, coalesce: true}
+}
+
+func TestCoalescingKeepsOnlyTheLatestItemPerKey(t *testing.T) {
+	r := newCoalescingService(t)
+	ctx := context.Background()
+
+	for _, v := range []versioned{
+		{ID: "a", Action: "create", Queued: 1},
+		{ID: "b", Action: "create", Queued: 2},
+		{ID: "a", Action: "update", Queued: 3},
+		{ID: "a", Action: "delete", Queued: 4},
+	} {
+		if err := r.StoreData(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, err := r.GetAllData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("expected one item per anime, got %+v", items)
+	}
+	// Position is where the anime first arrived; content is the latest.
+	if items[0].ID != "a" || items[0].Action != "delete" || items[1].ID != "b" {
+		t.Errorf("expected a's delete then b, got %+v", items)
+	}
+}
+
+// A retried or replayed older event must not replace a newer pending one.
+func TestCoalescingIgnoresAnOlderItem(t *testing.T) {
+	r := newCoalescingService(t)
+	ctx := context.Background()
+
+	_ = r.StoreData(ctx, versioned{ID: "a", Action: "update", UpdatedAt: 200, Queued: 1})
+	_ = r.StoreData(ctx, versioned{ID: "a", Action: "create", UpdatedAt: 100, Queued: 2})
+
+	items, _ := r.GetAllData(ctx)
+	if len(items) != 1 || items[0].UpdatedAt != 200 {
+		t.Errorf("the newer source version should win despite arriving first, got %+v", items)
+	}
+}
+
+func TestCoalescingFallsBackToQueueTimeWithoutASourceVersion(t *testing.T) {
+	r := newCoalescingService(t)
+	ctx := context.Background()
+
+	_ = r.StoreData(ctx, versioned{ID: "a", Action: "update", UpdatedAt: 200, Queued: 5})
+	_ = r.StoreData(ctx, versioned{ID: "a", Action: "delete", Queued: 6})
+
+	items, _ := r.GetAllData(ctx)
+	if len(items) != 1 || items[0].Action != "delete" {
+		t.Errorf("with one side unversioned, the later arrival should win, got %+v", items)
+	}
+}
+
+func TestCoalescedItemsArrivingMidSyncWaitForTheNextRun(t *testing.T) {
+	r := newCoalescingService(t)
+	ctx := context.Background()
+
+	_ = r.StoreData(ctx, versioned{ID: "a", Queued: 1})
+	first, _ := r.GetAllData(ctx)
+	_ = r.StoreData(ctx, versioned{ID: "a", Action: "update", Queued: 2})
+
+	// The run dies before clearing; the next one must finish the orphan first.
+	again, _ := r.GetAllData(ctx)
+	if len(first) != 1 || len(again) != 1 || again[0].Action != "" {
+		t.Fatalf("expected the orphaned claim to be recovered, got %+v", again)
+	}
+	if err := r.ClearData(ctx); err != nil {
+		t.Fatal(err)
+	}
+	next, _ := r.GetAllData(ctx)
+	if len(next) != 1 || next[0].Action != "update" {
+		t.Errorf("the update queued mid-sync should be next, got %+v", next)
+	}
+	_ = r.ClearData(ctx)
+	if empty, err := r.GetAllData(ctx); err != nil || len(empty) != 0 {
+		t.Errorf("expected an empty queue, got %+v %v", empty, err)
+	}
+}
+
+func TestCoalescingRejectsItemsWithoutAKey(t *testing.T) {
+	plain, _ := newTestService(t)
+	r := &RedisServiceImpl[item]{client: plain.client, key: "q", coalesce: true}
+	if err := r.StoreData(context.Background(), item{ID: "a"}); err == nil {
+		t.Error("an item that does not implement Keyed cannot be coalesced")
+	}
+}
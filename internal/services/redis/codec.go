@@ -0,0 +1,138 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Codecs selectable through RedisConfig.Codec.
+const (
+	JSONCodec     = "json"
+	MsgpackCodec  = "msgpack"
+	ZstdJSONCodec = "zstd-json"
+)
+
+// The first byte of an entry says how the rest is encoded. JSON entries are
+// written as they always were, with no prefix: their opening '{' is the
+// marker, so everything already queued still reads, and switching back to
+// JSON leaves nothing an older build cannot read. The other formats start
+// with a byte JSON never does.
+const (
+	msgpackVersion  byte = 0x01
+	zstdJSONVersion byte = 0x02
+)
+
+// Codec encodes queue entries.
+//
+// Entries were verbose JSON, synopsis and all, and a catalogue replay queues
+// tens of thousands of them; the compact formats cut what Redis holds during
+// one. Decoding goes by each entry's version byte rather than the configured
+// codec, so a rollout can change the codec with entries of the old format
+// still queued.
+type Codec interface {
+	Encode(v any) ([]byte, error)
+}
+
+// NewCodec returns the codec called name.
+func NewCodec(name string) (Codec, error) {
+	switch name {
+	case "", JSONCodec:
+		return jsonCodec{}, nil
+	case MsgpackCodec:
+		return msgpackCodec{}, nil
+	case ZstdJSONCodec:
+		return zstdJSONCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+type msgpackCodec struct{}
+
+// Encode uses the json tags, so a field is named the same in every format.
+func (msgpackCodec) Encode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(msgpackVersion)
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type zstdJSONCodec struct{}
+
+func (zstdJSONCodec) Encode(v any) ([]byte, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return zstdEncoder().EncodeAll(plain, []byte{zstdJSONVersion}), nil
+}
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll and
+// DecodeAll, and costly to build, so one of each serves the process.
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil)
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil)
+		return dec
+	})
+)
+
+// DecodeEntry decodes an entry in any of the formats into v.
+func DecodeEntry(raw string, v any) error {
+	if raw == "" {
+		return fmt.Errorf("empty entry")
+	}
+	switch raw[0] {
+	case msgpackVersion:
+		dec := msgpack.NewDecoder(bytes.NewReader([]byte(raw[1:])))
+		dec.SetCustomStructTag("json")
+		return dec.Decode(v)
+	case zstdJSONVersion:
+		plain, err := zstdDecoder().DecodeAll([]byte(raw[1:]), nil)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(plain, v)
+	}
+	return json.Unmarshal([]byte(raw), v)
+}
+
+// codecFor resolves a configured codec name. A name this build does not know
+// falls back to JSON, which every build reads, rather than stopping the
+// consumer.
+func codecFor(ctx context.Context, name string) Codec {
+	codec, err := NewCodec(name)
+	if err != nil {
+		logger.FromCtx(ctx).Error("Falling back to the JSON codec", zap.Error(err))
+		return jsonCodec{}
+	}
+	return codec
+}
+
+// encodeWith encodes data with codec, or as JSON when there is none.
+func encodeWith(codec Codec, data any) ([]byte, error) {
+	if codec == nil {
+		codec = jsonCodec{}
+	}
+	return codec.Encode(data)
+}
@@ -0,0 +1,89 @@
+package redis
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	in := versioned{ID: "42", Action: "update", UpdatedAt: 1700000000, Queued: 1700000001}
+	for _, name := range []string{JSONCodec, MsgpackCodec, ZstdJSONCodec} {
+		codec, err := NewCodec(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := codec.Encode(in)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var out versioned
+		if err := DecodeEntry(string(encoded), &out); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if out != in {
+			t.Errorf("%s: expected %+v, got %+v", name, in, out)
+		}
+	}
+}
+
+func TestJSONCodecWritesUnprefixedJSON(t *testing.T) {
+	encoded, _ := jsonCodec{}.Encode(item{ID: "a"})
+	if string(encoded) != `{"id":"a"}` {
+		t.Errorf("JSON entries must stay readable by older builds, got %q", encoded)
+	}
+}
+
+func TestUnknownCodecIsRejected(t *testing.T) {
+	if _, err := NewCodec("gzip"); err == nil {
+		t.Error("expected an error for an unknown codec")
+	}
+}
+
+func TestGetAllDataReadsMixedFormats(t *testing.T) {
+	r, _ := newTestService(t)
+	ctx := context.Background()
+	store(t, r, "a")
+	r.codec = msgpackCodec{}
+	store(t, r, "b")
+	r.codec = zstdJSONCodec{}
+	store(t, r, "c")
+
+	items, err := r.GetAllData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, it := range items {
+		got = append(got, it.ID)
+	}
+	if strings.Join(got, ",") != "c,b,a" {
+		t.Errorf("expected all three entries whatever their format, got %v", got)
+	}
+}
+
+func TestBinaryDeadLetterRequeuesByteForByte(t *testing.T) {
+	r, _ := newTestService(t)
+	r.codec = msgpackCodec{}
+	r.maxAttempts = 1
+	ctx := context.Background()
+	store(t, r, "a")
+
+	claimed, _ := r.Claim(ctx, 1)
+	if err := r.Nack(ctx, claimed...); err != nil {
+		t.Fatal(err)
+	}
+	dlq := &DeadLetterQueueImpl{client: r.client, key: r.key}
+	letters, _ := dlq.List(ctx, 0)
+	if len(letters) != 1 || letters[0].Raw != claimed[0].Raw {
+		t.Fatalf("expected the binary entry back as it was stored, got %+v", letters)
+	}
+
+	if _, err := dlq.Requeue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	back, _ := r.Claim(ctx, 1)
+	if len(back) != 1 || back[0].Data.ID != "a" || back[0].Raw != claimed[0].Raw {
+		t.Errorf("expected the requeued entry to decode as before, got %+v", back)
+	}
+}
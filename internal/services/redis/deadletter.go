@@ -0,0 +1,281 @@
+package redis
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Reasons an entry is dead-lettered.
+const (
+	UndecodableReason = "undecodable"
+	MaxAttemptsReason = "max_attempts"
+)
+
+// DeadLetter is a queue entry taken out of circulation, kept with enough
+// context to decide what to do with it.
+type DeadLetter struct {
+	// ID is a digest of Raw, stable across requeues of the same entry.
+	ID       string `json:"id"`
+	Reason   string `json:"reason"`
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+	DeadAt   int64  `json:"dead_at"`
+	// Raw is the entry byte for byte, so requeuing restores exactly what the
+	// consumer stored.
+	Raw string `json:"raw"`
+	// RawEncoding is "base64" when Raw is stored that way. The binary codecs
+	// write entries that are not valid UTF-8, which JSON would mangle.
+	RawEncoding string `json:"raw_encoding,omitempty"`
+}
+
+// DeadLetterQueue is the operator's side of the dead-letter list.
+//
+// Entries used to vanish: one that did not decode was logged as "skipping" and
+// then deleted with the rest of the batch, and one Algolia kept refusing was
+// sent again on every run with nothing to show why. Both now end up here.
+type DeadLetterQueue interface {
+	List(ctx context.Context, limit int64) ([]DeadLetter, error)
+	Get(ctx context.Context, id string) (*DeadLetter, error)
+	// Requeue puts entries back on the queue with a fresh attempt count. No ids
+	// means every entry. An entry the queue cannot take back stays where it is,
+	// and the error says why; the count is of those that were requeued.
+	Requeue(ctx context.Context, ids ...string) (int, error)
+	// Purge deletes entries for good. No ids means every entry.
+	Purge(ctx context.Context, ids ...string) (int, error)
+}
+
+type DeadLetterQueueImpl struct {
+	client redis.UniversalClient
+	key    string
+	// store queues a requeued entry on pipe as the queue mode stores a new
+	// one, so the sync finds it where it looks: pushed onto the list, added to
+	// the stream, or coalesced with what is pending for the same anime. Nil
+	// pushes onto the list.
+	store func(ctx context.Context, pipe redis.Pipeliner, raw string) error
+}
+
+// NewDeadLetterQueue returns the dead letters of the queue redisCfg
+// configures, whose entries are Ts.
+func NewDeadLetterQueue[T any](ctx context.Context, redisCfg config.RedisConfig) DeadLetterQueue {
+	client := newClient(ctx, redisCfg)
+	var target pipelineStorer[T]
+	if redisCfg.QueueMode == StreamQueueMode {
+		target = newStreamService[T](client, redisCfg)
+	} else {
+		target = &RedisServiceImpl[T]{
+			client:   client,
+			key:      queueKey(redisCfg),
+			coalesce: redisCfg.QueueMode == CoalesceQueueMode,
+		}
+	}
+	return &DeadLetterQueueImpl{
+		client: client,
+		key:    queueKey(redisCfg),
+		store:  storeRaw(target),
+	}
+}
+
+// storeRaw stores an entry as it was written, through target. Only the
+// coalescing mode needs it decoded, for the anime it describes.
+func storeRaw[T any](target pipelineStorer[T]) func(ctx context.Context, pipe redis.Pipeliner, raw string) error {
+	return func(ctx context.Context, pipe redis.Pipeliner, raw string) error {
+		var data T
+		decodeErr := DecodeEntry(raw, &data)
+		if err := target.storeOn(ctx, pipe, data, []byte(raw)); err != nil {
+			if decodeErr != nil {
+				return fmt.Errorf("%w: %v", err, decodeErr)
+			}
+			return err
+		}
+		return nil
+	}
+}
+
+func deadLetterKey(key string) string {
+	return key + ":dead"
+}
+
+func newDeadLetter(raw, reason string, cause error, attempts int) DeadLetter {
+	letter := DeadLetter{
+		ID:       entryDigest(raw)[:16],
+		Reason:   reason,
+		Attempts: attempts,
+		DeadAt:   time.Now().Unix(),
+		Raw:      raw,
+	}
+	if cause != nil {
+		letter.Error = cause.Error()
+	}
+	return letter
+}
+
+// pushDeadLetter adds to the list as part of the caller's pipeline, so moving
+// an entry out of the queue and into the list happens together.
+func pushDeadLetter(ctx context.Context, pipe redis.Pipeliner, key string, letter DeadLetter) error {
+	if !utf8.ValidString(letter.Raw) {
+		letter.Raw = base64.StdEncoding.EncodeToString([]byte(letter.Raw))
+		letter.RawEncoding = "base64"
+	}
+	encoded, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	pipe.LPush(ctx, deadLetterKey(key), encoded)
+	return nil
+}
+
+// List returns the newest entries first.
+func (d *DeadLetterQueueImpl) List(ctx context.Context, limit int64) ([]DeadLetter, error) {
+	letters, _, err := d.load(ctx, limit)
+	return letters, err
+}
+
+func (d *DeadLetterQueueImpl) Get(ctx context.Context, id string) (*DeadLetter, error) {
+	letters, _, err := d.load(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, letter := range letters {
+		if letter.ID == id {
+			return &letter, nil
+		}
+	}
+	return nil, fmt.Errorf("no dead letter with id %q", id)
+}
+
+func (d *DeadLetterQueueImpl) Requeue(ctx context.Context, ids ...string) (int, error) {
+	log := logger.FromCtx(ctx)
+
+	letters, stored, err := d.matching(ctx, ids)
+	if err != nil {
+		return 0, err
+	}
+	if len(letters) == 0 {
+		return 0, nil
+	}
+
+	var refused []error
+	_, err = d.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, letter := range letters {
+			// A store that fails queues nothing, so the letter stays.
+			if err := d.storeEntry(ctx, pipe, letter.Raw); err != nil {
+				refused = append(refused, fmt.Errorf("%s: %w", letter.ID, err))
+				continue
+			}
+			pipe.LRem(ctx, deadLetterKey(d.key), 1, stored[i])
+			pipe.HDel(ctx, attemptsKeyFor(d.key), entryDigest(letter.Raw))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to requeue dead letters", zap.Error(err))
+		return 0, err
+	}
+	requeued := len(letters) - len(refused)
+	log.Info("requeued dead letters", zap.Int("count", requeued))
+	if len(refused) > 0 {
+		return requeued, fmt.Errorf("%d entries could not be requeued: %w", len(refused), errors.Join(refused...))
+	}
+	return requeued, nil
+}
+
+func (d *DeadLetterQueueImpl) storeEntry(ctx context.Context, pipe redis.Pipeliner, raw string) error {
+	if d.store == nil {
+		pipe.LPush(ctx, d.key, raw)
+		return nil
+	}
+	return d.store(ctx, pipe, raw)
+}
+
+func (d *DeadLetterQueueImpl) Purge(ctx context.Context, ids ...string) (int, error) {
+	log := logger.FromCtx(ctx)
+
+	_, stored, err := d.matching(ctx, ids)
+	if err != nil {
+		return 0, err
+	}
+	if len(stored) == 0 {
+		return 0, nil
+	}
+
+	_, err = d.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, entry := range stored {
+			pipe.LRem(ctx, deadLetterKey(d.key), 1, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to purge dead letters", zap.Error(err))
+		return 0, err
+	}
+	log.Info("purged dead letters", zap.Int("count", len(stored)))
+	return len(stored), nil
+}
+
+// matching returns the entries with the given ids, or all of them, alongside
+// their stored form, which LREM needs to find them.
+func (d *DeadLetterQueueImpl) matching(ctx context.Context, ids []string) ([]DeadLetter, []string, error) {
+	letters, stored, err := d.load(ctx, 0)
+	if err != nil || len(ids) == 0 {
+		return letters, stored, err
+	}
+
+	wanted := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		wanted[id] = struct{}{}
+	}
+	var (
+		matchedLetters []DeadLetter
+		matchedStored  []string
+	)
+	for i, letter := range letters {
+		if _, ok := wanted[letter.ID]; ok {
+			matchedLetters = append(matchedLetters, letter)
+			matchedStored = append(matchedStored, stored[i])
+		}
+	}
+	return matchedLetters, matchedStored, nil
+}
+
+// load reads up to limit entries; zero reads them all. The list is expected to
+// stay small enough that scanning it for an id is fine.
+func (d *DeadLetterQueueImpl) load(ctx context.Context, limit int64) ([]DeadLetter, []string, error) {
+	stored, err := d.client.LRange(ctx, deadLetterKey(d.key), 0, limit-1).Result()
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to read dead letters", zap.Error(err))
+		return nil, nil, err
+	}
+
+	letters := make([]DeadLetter, 0, len(stored))
+	kept := make([]string, 0, len(stored))
+	for _, entry := range stored {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(entry), &letter); err != nil {
+			// Written by this package, so this is not expected; surface it
+			// without making the rest unreadable.
+			logger.FromCtx(ctx).Warn("Failed to unmarshal dead letter", zap.Error(err))
+			continue
+		}
+		if letter.RawEncoding == "base64" {
+			raw, err := base64.StdEncoding.DecodeString(letter.Raw)
+			if err != nil {
+				logger.FromCtx(ctx).Warn("Failed to decode dead letter", zap.Error(err))
+				continue
+			}
+			letter.Raw, letter.RawEncoding = string(raw), ""
+		}
+		letters = append(letters, letter)
+		kept = append(kept, entry)
+	}
+	return letters, kept, nil
+}
@@ -0,0 +1,184 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/weeb-vip/algolia-sync/config"
+)
+
+func TestNackDeadLettersAnItemOutOfAttempts(t *testing.T) {
+	r, mr := newTestService(t)
+	r.maxAttempts = 2
+	ctx := context.Background()
+	store(t, r, "poison")
+
+	first, _ := r.Claim(ctx, 1)
+	first[0].Err = errors.New("record too big")
+	if err := r.Nack(ctx, first...); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := r.Claim(ctx, 1)
+	second[0].Err = errors.New("record too big")
+	if err := r.Nack(ctx, second...); err != nil {
+		t.Fatal(err)
+	}
+
+	if rest, _ := r.Claim(ctx, 1); len(rest) != 0 {
+		t.Fatalf("the item should be out of circulation, got %v", ids(rest))
+	}
+	if mr.Exists(r.attemptsKey()) {
+		t.Error("attempt count should be cleared once dead-lettered")
+	}
+
+	dlq := &DeadLetterQueueImpl{client: r.client, key: r.key}
+	letters, err := dlq.List(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("expected one dead letter, got %d", len(letters))
+	}
+	l := letters[0]
+	if l.Reason != MaxAttemptsReason || l.Attempts != 2 || l.Error != "record too big" {
+		t.Errorf("dead letter should record why and how often: %+v", l)
+	}
+	if l.Raw != first[0].Raw || l.DeadAt == 0 {
+		t.Errorf("dead letter should keep the original entry and a timestamp: %+v", l)
+	}
+}
+
+// Undecodable entries used to be skipped and then deleted with the batch.
+func TestGetAllDataDeadLettersUndecodableEntries(t *testing.T) {
+	r, mr := newTestService(t)
+	ctx := context.Background()
+	mr.Lpush(r.key, "{truncated")
+	store(t, r, "a")
+
+	items, err := r.GetAllData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].ID != "a" {
+		t.Fatalf("expected only a, got %v", items)
+	}
+	if claimed, _ := mr.List(r.claimedKey()); len(claimed) != 1 {
+		t.Errorf("the bad entry should leave the claimed batch, got %v", claimed)
+	}
+
+	dlq := &DeadLetterQueueImpl{client: r.client, key: r.key}
+	letters, _ := dlq.List(ctx, 0)
+	if len(letters) != 1 || letters[0].Reason != UndecodableReason || letters[0].Raw != "{truncated" {
+		t.Errorf("expected the raw bytes dead-lettered as undecodable, got %+v", letters)
+	}
+}
+
+func TestRequeueAndPurgeDeadLetters(t *testing.T) {
+	r, _ := newTestService(t)
+	r.maxAttempts = 1
+	ctx := context.Background()
+	store(t, r, "a", "b", "c")
+
+	claimed, _ := r.Claim(ctx, 3)
+	if err := r.Nack(ctx, claimed...); err != nil {
+		t.Fatal(err)
+	}
+	dlq := &DeadLetterQueueImpl{client: r.client, key: r.key}
+	letters, _ := dlq.List(ctx, 0)
+	if len(letters) != 3 {
+		t.Fatalf("expected 3 dead letters, got %d", len(letters))
+	}
+
+	byID := map[string]string{}
+	for _, l := range letters {
+		byID[l.Raw] = l.ID
+	}
+	got, err := dlq.Get(ctx, byID[claimed[1].Raw])
+	if err != nil || got.Raw != claimed[1].Raw {
+		t.Fatalf("inspect should find the entry by id, got %+v %v", got, err)
+	}
+
+	if n, err := dlq.Requeue(ctx, byID[claimed[1].Raw]); err != nil || n != 1 {
+		t.Fatalf("expected 1 requeued, got %d %v", n, err)
+	}
+	back, _ := r.Claim(ctx, 10)
+	if len(back) != 1 || back[0].Data.ID != "b" || back[0].Attempts != 0 {
+		t.Errorf("requeued entry should return with a fresh count, got %+v", back)
+	}
+
+	if n, err := dlq.Purge(ctx); err != nil || n != 2 {
+		t.Fatalf("purge with no ids should remove the rest, got %d %v", n, err)
+	}
+	if left, _ := dlq.List(ctx, 0); len(left) != 0 {
+		t.Errorf("expected an empty dead-letter list, got %v", left)
+	}
+}
+
+// TestRequeueGoesWhereTheModeReads requeues a letter in each mode and claims it
+// back as the sync would.
+func TestRequeueGoesWhereTheModeReads(t *testing.T) {
+	for _, mode := range []string{BatchQueueMode, CoalesceQueueMode, StreamQueueMode} {
+		t.Run(mode, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			redisCfg := config.RedisConfig{
+				URL:         "redis://" + mr.Addr(),
+				Key:         "q",
+				QueueMode:   mode,
+				ClaimSize:   10,
+				StreamGroup: "sync",
+			}
+			ctx := context.Background()
+			queue := NewRedisService[versioned](ctx, redisCfg)
+			dlq := NewDeadLetterQueue[versioned](ctx, redisCfg)
+
+			raw, err := encodeWith(nil, versioned{ID: "a", Action: "update", UpdatedAt: 5})
+			if err != nil {
+				t.Fatal(err)
+			}
+			letter := newDeadLetter(string(raw), MaxAttemptsReason, errors.New("refused"), 5)
+			_, err = newClient(ctx, redisCfg).TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return pushDeadLetter(ctx, pipe, queueKey(redisCfg), letter)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n, err := dlq.Requeue(ctx); err != nil || n != 1 {
+				t.Fatalf("Requeue = %d, %v", n, err)
+			}
+			items, err := queue.GetAllData(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != 1 || items[0].ID != "a" || items[0].UpdatedAt != 5 {
+				t.Errorf("claimed %+v, want the requeued a", items)
+			}
+			if left, _ := dlq.List(ctx, 0); len(left) != 0 {
+				t.Errorf("dead letters left: %+v", left)
+			}
+		})
+	}
+}
+
+func TestRequeueKeepsWhatTheModeCannotTake(t *testing.T) {
+	mr := miniredis.RunT(t)
+	redisCfg := config.RedisConfig{URL: "redis://" + mr.Addr(), Key: "q", QueueMode: CoalesceQueueMode}
+	ctx := context.Background()
+	dlq := NewDeadLetterQueue[versioned](ctx, redisCfg)
+	_, err := newClient(ctx, redisCfg).TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		return pushDeadLetter(ctx, pipe, "q", newDeadLetter("not an entry", UndecodableReason, errors.New("bad"), 0))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := dlq.Requeue(ctx); err == nil || n != 0 {
+		t.Errorf("Requeue = %d, %v; want nothing requeued and why", n, err)
+	}
+	if left, _ := dlq.List(ctx, 0); len(left) != 1 {
+		t.Errorf("the letter should stay dead-lettered, got %+v", left)
+	}
+}
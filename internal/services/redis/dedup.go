@@ -0,0 +1,74 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/weeb-vip/algolia-sync/config"
+)
+
+// Dedup remembers, for a while, which messages have been queued.
+//
+// A consumer restart reads the uncommitted Kafka offsets again, and Pulsar
+// redelivers whatever was not acknowledged, so the same message was queued
+// once per delivery. A message is known by its place in its topic and, for a
+// CloudEvent, by its id, which survives a producer sending it twice.
+//
+// A message is marked only once it is queued. One that was queued and not
+// marked, because the process stopped in between, is queued again on
+// redelivery: a duplicate costs an Algolia write, a message marked and never
+// queued would be lost.
+type Dedup struct {
+	client redis.UniversalClient
+	prefix string
+	ttl    time.Duration
+}
+
+// NewDedup returns nil, which dedupes nothing, when DedupTTL is zero.
+func NewDedup(ctx context.Context, redisCfg config.RedisConfig) *Dedup {
+	if redisCfg.DedupTTL <= 0 {
+		return nil
+	}
+	return &Dedup{
+		client: newClient(ctx, redisCfg),
+		// Under the queue key, so in a cluster every key shares its slot and
+		// one EXISTS can check them all.
+		prefix: queueKey(redisCfg) + ":dedup:",
+		ttl:    time.Duration(redisCfg.DedupTTL) * time.Second,
+	}
+}
+
+// Seen tells whether a message known by any of keys has been queued.
+func (d *Dedup) Seen(ctx context.Context, keys ...string) (bool, error) {
+	if d == nil || len(keys) == 0 {
+		return false, nil
+	}
+	n, err := d.client.Exists(ctx, d.keys(keys)...).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Mark records that the message known by keys has been queued.
+func (d *Dedup) Mark(ctx context.Context, keys ...string) error {
+	if d == nil || len(keys) == 0 {
+		return nil
+	}
+	_, err := d.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range d.keys(keys) {
+			pipe.Set(ctx, key, 1, d.ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+func (d *Dedup) keys(keys []string) []string {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = d.prefix + key
+	}
+	return prefixed
+}
@@ -0,0 +1,47 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/weeb-vip/algolia-sync/config"
+)
+
+func TestDedupRemembersAMessageUntilItsTTL(t *testing.T) {
+	plain, mr := newTestService(t)
+	d := &Dedup{client: plain.client, prefix: "q:dedup:", ttl: time.Minute}
+	ctx := context.Background()
+
+	if seen, err := d.Seen(ctx, "kafka:anime:0:7"); err != nil || seen {
+		t.Fatalf("Seen before Mark = %v, %v", seen, err)
+	}
+	if err := d.Mark(ctx, "kafka:anime:0:7", "cloudevent:evt-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Known by either key: the same event at another offset is a duplicate.
+	for _, keys := range [][]string{{"kafka:anime:0:7"}, {"kafka:anime:1:3", "cloudevent:evt-1"}} {
+		if seen, err := d.Seen(ctx, keys...); err != nil || !seen {
+			t.Errorf("Seen(%v) = %v, %v, want seen", keys, seen, err)
+		}
+	}
+
+	mr.FastForward(2 * time.Minute)
+	if seen, err := d.Seen(ctx, "kafka:anime:0:7", "cloudevent:evt-1"); err != nil || seen {
+		t.Errorf("Seen after the TTL = %v, %v, want forgotten", seen, err)
+	}
+}
+
+func TestDedupOffWithoutATTL(t *testing.T) {
+	d := NewDedup(context.Background(), config.RedisConfig{DedupTTL: 0})
+	if d != nil {
+		t.Fatalf("NewDedup = %+v, want none", d)
+	}
+	if err := d.Mark(context.Background(), "a"); err != nil {
+		t.Errorf("Mark = %v", err)
+	}
+	if seen, err := d.Seen(context.Background(), "a"); err != nil || seen {
+		t.Errorf("Seen = %v, %v, want nothing seen", seen, err)
+	}
+}
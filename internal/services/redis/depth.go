@@ -0,0 +1,65 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DepthReader reports how many items are waiting to reach Algolia.
+type DepthReader interface {
+	// Depth counts the items queued and not yet cleared, including any batch
+	// a sync has claimed, since those are not in Algolia yet either.
+	Depth(ctx context.Context) (int64, error)
+}
+
+func (r *RedisServiceImpl[T]) Depth(ctx context.Context) (int64, error) {
+	var counts []*redis.IntCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if r.coalesce {
+			counts = append(counts,
+				pipe.ZCard(ctx, r.orderKey()),
+				pipe.ZCard(ctx, r.orderKey()+":claimed"))
+			return nil
+		}
+		counts = append(counts,
+			pipe.LLen(ctx, r.key),
+			pipe.LLen(ctx, r.claimedKey()),
+			pipe.LLen(ctx, r.processingKey()))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var depth int64
+	for _, count := range counts {
+		depth += count.Val()
+	}
+	return depth, nil
+}
+
+// Depth is the group's lag plus what it has read and not acknowledged. The
+// stream's length is no use: it keeps acknowledged entries until trimmed.
+// Redis reports the lag from 7.0; older servers count only the unacknowledged.
+func (s *StreamServiceImpl[T]) Depth(ctx context.Context) (int64, error) {
+	// The group may not exist before the first sync, and every entry is
+	// waiting until it does.
+	if err := s.ensureGroup(ctx); err != nil {
+		return 0, err
+	}
+	groups, err := s.client.XInfoGroups(ctx, s.stream).Result()
+	if err != nil {
+		return 0, err
+	}
+	for _, group := range groups {
+		if group.Name != s.group {
+			continue
+		}
+		if group.Lag < 0 {
+			return 0, fmt.Errorf("redis cannot tell the lag of group %q", s.group)
+		}
+		return group.Lag + group.Pending, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,24 @@
+package redis
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDepthCountsLiveAndClaimedItems(t *testing.T) {
+	r, _ := newTestService(t)
+	ctx := context.Background()
+	store(t, r, "a", "b")
+	if _, err := r.GetAllData(ctx); err != nil {
+		t.Fatal(err)
+	}
+	store(t, r, "c")
+
+	if depth, err := r.Depth(ctx); err != nil || depth != 3 {
+		t.Errorf("expected the claimed batch and the new item counted, got %d %v", depth, err)
+	}
+	_ = r.ClearData(ctx)
+	if depth, _ := r.Depth(ctx); depth != 1 {
+		t.Errorf("expected only c left, got %d", depth)
+	}
+}
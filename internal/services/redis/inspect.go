@@ -0,0 +1,515 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Lists a QueueInspector can look at. A mode without one of them sees it as
+// empty.
+const (
+	// LiveList is where StoreData writes: the list, the coalescing mode's
+	// pending entries, or the stream.
+	LiveList = "live"
+	// ClaimedList is the claimed batch of the batch and coalescing modes.
+	ClaimedList = "claimed"
+	// ProcessingList holds what the reliable mode has handed out, and what
+	// the stream's consumer group has read and not acknowledged.
+	ProcessingList = "processing"
+)
+
+// QueueLists are the lists in the order a sync consumes them.
+var QueueLists = []string{ClaimedList, ProcessingList, LiveList}
+
+// QueueEntry is one stored entry, decoded if it could be.
+type QueueEntry[T any] struct {
+	// Position counts from the oldest entry, which is 0.
+	Position int64
+	Raw      string
+	Data     T
+	// Err is set when Raw did not decode; Data is then the zero value.
+	Err error
+}
+
+// QueueInspector reads and repairs the queue without claiming it, for
+// operators who would otherwise reach for redis-cli and LRANGE the raw JSON.
+//
+// The batch and reliable modes share their lists. The coalescing mode keeps
+// its entries in hashes ordered by arrival, and the stream mode in the stream
+// and its group's pending entries; each is read where it is kept.
+type QueueInspector[T any] interface {
+	Len(ctx context.Context, list string) (int64, error)
+	// Scan calls fn for each entry of list, oldest first, until fn returns
+	// false.
+	Scan(ctx context.Context, list string, fn func(QueueEntry[T]) bool) error
+	// Drop removes entries from list by their stored form.
+	Drop(ctx context.Context, list string, raws ...string) (int, error)
+	// RequeueClaimed moves the claimed batch back onto the live queue, where
+	// it is consumed before anything queued since.
+	RequeueClaimed(ctx context.Context) (int, error)
+}
+
+func NewQueueInspector[T any](ctx context.Context, redisCfg config.RedisConfig) (QueueInspector[T], error) {
+	client := newClient(ctx, redisCfg)
+	switch redisCfg.QueueMode {
+	case "", BatchQueueMode, ReliableQueueMode, CoalesceQueueMode:
+		return &RedisServiceImpl[T]{
+			client:   client,
+			key:      queueKey(redisCfg),
+			coalesce: redisCfg.QueueMode == CoalesceQueueMode,
+		}, nil
+	case StreamQueueMode:
+		return newStreamService[T](client, redisCfg), nil
+	}
+	return nil, fmt.Errorf("unknown queue mode %q", redisCfg.QueueMode)
+}
+
+// scanPageSize bounds one LRANGE, so scanning a replay-sized queue does not
+// pull it into memory at once.
+const scanPageSize = 1000
+
+func (r *RedisServiceImpl[T]) listKey(list string) (string, error) {
+	switch list {
+	case LiveList:
+		return r.key, nil
+	case ClaimedList:
+		return r.claimedKey(), nil
+	case ProcessingList:
+		return r.processingKey(), nil
+	}
+	return "", fmt.Errorf("unknown queue list %q", list)
+}
+
+func (r *RedisServiceImpl[T]) Len(ctx context.Context, list string) (int64, error) {
+	if r.coalesce {
+		return r.lenCoalesced(ctx, list)
+	}
+	key, err := r.listKey(list)
+	if err != nil {
+		return 0, err
+	}
+	return r.client.LLen(ctx, key).Result()
+}
+
+// Scan pages from the right, where the oldest entries are. Pushes land on the
+// left, so entries arriving mid-scan do not shift the ones still to come; they
+// are simply not seen.
+func (r *RedisServiceImpl[T]) Scan(ctx context.Context, list string, fn func(QueueEntry[T]) bool) error {
+	if r.coalesce {
+		return r.scanCoalesced(ctx, list, fn)
+	}
+	key, err := r.listKey(list)
+	if err != nil {
+		return err
+	}
+
+	for offset := int64(0); ; offset += scanPageSize {
+		page, err := r.client.LRange(ctx, key, -(offset + scanPageSize), -(offset + 1)).Result()
+		if err != nil {
+			logger.FromCtx(ctx).Error("Failed to read the queue", zap.Error(err))
+			return err
+		}
+		for i := len(page) - 1; i >= 0; i-- {
+			entry := QueueEntry[T]{
+				Position: offset + int64(len(page)-1-i),
+				Raw:      page[i],
+			}
+			entry.Err = DecodeEntry(page[i], &entry.Data)
+			if !fn(entry) {
+				return nil
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+	}
+}
+
+func (r *RedisServiceImpl[T]) Drop(ctx context.Context, list string, raws ...string) (int, error) {
+	if r.coalesce {
+		return r.dropCoalesced(ctx, list, raws)
+	}
+	key, err := r.listKey(list)
+	if err != nil {
+		return 0, err
+	}
+	if len(raws) == 0 {
+		return 0, nil
+	}
+
+	var removed []*redis.IntCmd
+	err = fencedTx(ctx, r.client, func(pipe redis.Pipeliner) error {
+		removed = removed[:0]
+		for _, raw := range raws {
+			removed = append(removed, pipe.LRem(ctx, key, 1, raw))
+		}
+		return nil
+	})
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to drop queue entries", zap.Error(err))
+		return 0, err
+	}
+
+	n := 0
+	for _, cmd := range removed {
+		n += int(cmd.Val())
+	}
+	logger.FromCtx(ctx).Info("dropped queue entries", zap.String("list", list), zap.Int("count", n))
+	return n, nil
+}
+
+// RequeueClaimed has the same layout to undo as Recover, so it reuses its
+// script.
+func (r *RedisServiceImpl[T]) RequeueClaimed(ctx context.Context) (int, error) {
+	if r.coalesce {
+		return r.requeueClaimedCoalesced(ctx)
+	}
+	n, err := recoverList(ctx, r.client, r.claimedKey(), r.key)
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to requeue the claimed batch", zap.Error(err))
+		return 0, err
+	}
+	if n > 0 {
+		logger.FromCtx(ctx).Info("requeued the claimed batch", zap.Int("count", n))
+	}
+	return n, nil
+}
+
+// coalescedKeys are the pending, versions and order keys behind list, or none
+// for the processing list, which the coalescing mode does not have.
+func (r *RedisServiceImpl[T]) coalescedKeys(list string) ([]string, error) {
+	switch list {
+	case LiveList:
+		return []string{r.pendingKey(), r.versionsKey(), r.orderKey()}, nil
+	case ClaimedList:
+		return []string{r.pendingKey() + ":claimed", r.versionsKey() + ":claimed", r.orderKey() + ":claimed"}, nil
+	case ProcessingList:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown queue list %q", list)
+}
+
+func (r *RedisServiceImpl[T]) lenCoalesced(ctx context.Context, list string) (int64, error) {
+	keys, err := r.coalescedKeys(list)
+	if err != nil || keys == nil {
+		return 0, err
+	}
+	return r.client.HLen(ctx, keys[0]).Result()
+}
+
+// scanCoalesced pages through the ids in arrival order. An id whose entry has
+// gone, because a sync acknowledged it mid-scan, is skipped.
+func (r *RedisServiceImpl[T]) scanCoalesced(ctx context.Context, list string, fn func(QueueEntry[T]) bool) error {
+	keys, err := r.coalescedKeys(list)
+	if err != nil || keys == nil {
+		return err
+	}
+
+	var position int64
+	for offset := int64(0); ; offset += scanPageSize {
+		ids, err := r.client.ZRange(ctx, keys[2], offset, offset+scanPageSize-1).Result()
+		if err != nil {
+			logger.FromCtx(ctx).Error("Failed to read the queue", zap.Error(err))
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		raws, err := r.client.HMGet(ctx, keys[0], ids...).Result()
+		if err != nil {
+			logger.FromCtx(ctx).Error("Failed to read the queue", zap.Error(err))
+			return err
+		}
+		for _, raw := range raws {
+			s, ok := raw.(string)
+			if !ok {
+				continue
+			}
+			entry := QueueEntry[T]{Position: position, Raw: s}
+			entry.Err = DecodeEntry(s, &entry.Data)
+			position++
+			if !fn(entry) {
+				return nil
+			}
+		}
+		if len(ids) < scanPageSize {
+			return nil
+		}
+	}
+}
+
+// dropCoalescedScript removes ids whose pending entry is still the one given,
+// so an entry that was replaced by a newer one since it was read is kept.
+var dropCoalescedScript = redis.NewScript(`
+local n = 0
+for i = 1, #ARGV, 2 do
+  if redis.call('HGET', KEYS[1], ARGV[i]) == ARGV[i + 1] then
+    redis.call('HDEL', KEYS[1], ARGV[i])
+    redis.call('HDEL', KEYS[2], ARGV[i])
+    redis.call('ZREM', KEYS[3], ARGV[i])
+    n = n + 1
+  end
+end
+return n
+`)
+
+// dropCoalesced finds each entry by the id it decodes to; one that does not
+// decode has no id and is not dropped.
+func (r *RedisServiceImpl[T]) dropCoalesced(ctx context.Context, list string, raws []string) (int, error) {
+	keys, err := r.coalescedKeys(list)
+	if err != nil || keys == nil {
+		return 0, err
+	}
+
+	args := make([]any, 0, 2*len(raws))
+	for _, raw := range raws {
+		var data T
+		if DecodeEntry(raw, &data) != nil {
+			continue
+		}
+		if keyed, ok := any(data).(Keyed); ok && keyed.QueueKey() != "" {
+			args = append(args, keyed.QueueKey(), raw)
+		}
+	}
+	if len(args) == 0 {
+		return 0, nil
+	}
+
+	var dropped *redis.Cmd
+	err = fencedTx(ctx, r.client, func(pipe redis.Pipeliner) error {
+		dropped = dropCoalescedScript.Eval(ctx, pipe, keys, args...)
+		return nil
+	})
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to drop queue entries", zap.Error(err))
+		return 0, err
+	}
+	n, err := dropped.Int()
+	if err != nil {
+		return 0, err
+	}
+	logger.FromCtx(ctx).Info("dropped queue entries", zap.String("list", list), zap.Int("count", n))
+	return n, nil
+}
+
+// requeueCoalescedScript merges the claimed keys back into the live ones, as
+// coalesceScript would have had the claimed entries never left: an id pending
+// in both keeps the newer entry, and the earlier of the two arrivals. It
+// returns how many claimed ids there were.
+var requeueCoalescedScript = redis.NewScript(`
+local ids = redis.call('ZRANGE', KEYS[6], 0, -1, 'WITHSCORES')
+for i = 1, #ids, 2 do
+  local id, arrived = ids[i], tonumber(ids[i + 1])
+  local raw = redis.call('HGET', KEYS[4], id)
+  local version = redis.call('HGET', KEYS[5], id)
+  if raw and version then
+    local current = redis.call('HGET', KEYS[2], id)
+    local older = false
+    if current then
+      local sep = string.find(current, ':')
+      local curUpdated = tonumber(string.sub(current, 1, sep - 1))
+      local curQueued = tonumber(string.sub(current, sep + 1))
+      sep = string.find(version, ':')
+      local updated = tonumber(string.sub(version, 1, sep - 1))
+      local queued = tonumber(string.sub(version, sep + 1))
+      if curUpdated > 0 and updated > 0 then
+        older = updated <= curUpdated
+      else
+        older = queued <= curQueued
+      end
+    end
+    if not older then
+      redis.call('HSET', KEYS[1], id, raw)
+      redis.call('HSET', KEYS[2], id, version)
+    end
+    local score = redis.call('ZSCORE', KEYS[3], id)
+    if not score or arrived < tonumber(score) then
+      redis.call('ZADD', KEYS[3], arrived, id)
+    end
+  end
+end
+redis.call('DEL', KEYS[4], KEYS[5], KEYS[6])
+return #ids / 2
+`)
+
+func (r *RedisServiceImpl[T]) requeueClaimedCoalesced(ctx context.Context) (int, error) {
+	live, _ := r.coalescedKeys(LiveList)
+	claimed, _ := r.coalescedKeys(ClaimedList)
+
+	var moved *redis.Cmd
+	err := fencedTx(ctx, r.client, func(pipe redis.Pipeliner) error {
+		moved = requeueCoalescedScript.Eval(ctx, pipe, append(live, claimed...))
+		return nil
+	})
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to requeue the claimed batch", zap.Error(err))
+		return 0, err
+	}
+	n, err := moved.Int()
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		logger.FromCtx(ctx).Info("requeued the claimed batch", zap.Int("count", n))
+	}
+	return n, nil
+}
+
+// The stream mode's live list is the stream itself, acknowledged history
+// included until it is trimmed, and its processing list is what the group has
+// read and not acknowledged. It has no claimed batch.
+
+func (s *StreamServiceImpl[T]) Len(ctx context.Context, list string) (int64, error) {
+	switch list {
+	case LiveList:
+		return s.client.XLen(ctx, s.stream).Result()
+	case ProcessingList:
+		if err := s.ensureGroup(ctx); err != nil {
+			return 0, err
+		}
+		pending, err := s.client.XPending(ctx, s.stream, s.group).Result()
+		if err != nil {
+			return 0, err
+		}
+		return pending.Count, nil
+	case ClaimedList:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("unknown queue list %q", list)
+}
+
+func (s *StreamServiceImpl[T]) Scan(ctx context.Context, list string, fn func(QueueEntry[T]) bool) error {
+	var position int64
+	return s.walk(ctx, list, func(msg redis.XMessage) bool {
+		raw, _ := msg.Values[streamField].(string)
+		entry := QueueEntry[T]{Position: position, Raw: raw}
+		entry.Err = DecodeEntry(raw, &entry.Data)
+		position++
+		return fn(entry)
+	})
+}
+
+// walk calls fn for each entry of list, oldest first, until fn returns false.
+func (s *StreamServiceImpl[T]) walk(ctx context.Context, list string, fn func(redis.XMessage) bool) error {
+	var next func(ctx context.Context, after string) ([]redis.XMessage, error)
+	switch list {
+	case LiveList:
+		next = s.rangeAfter
+	case ProcessingList:
+		if err := s.ensureGroup(ctx); err != nil {
+			return err
+		}
+		next = s.pendingAfter
+	case ClaimedList:
+		return nil
+	default:
+		return fmt.Errorf("unknown queue list %q", list)
+	}
+
+	for after := "-"; ; {
+		messages, err := next(ctx, after)
+		if err != nil {
+			logger.FromCtx(ctx).Error("Failed to read the queue", zap.Error(err))
+			return err
+		}
+		for _, msg := range messages {
+			if !fn(msg) {
+				return nil
+			}
+		}
+		if len(messages) < scanPageSize {
+			return nil
+		}
+		after = "(" + messages[len(messages)-1].ID
+	}
+}
+
+// rangeAfter reads a page of the stream from after, which is "-" for the
+// start or an exclusive "(id".
+func (s *StreamServiceImpl[T]) rangeAfter(ctx context.Context, after string) ([]redis.XMessage, error) {
+	return s.client.XRangeN(ctx, s.stream, after, "+", scanPageSize).Result()
+}
+
+// pendingAfter reads a page of the group's pending entries from after. An
+// entry trimmed from the stream while pending has nothing left to show.
+func (s *StreamServiceImpl[T]) pendingAfter(ctx context.Context, after string) ([]redis.XMessage, error) {
+	pending, err := s.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: s.stream,
+		Group:  s.group,
+		Start:  after,
+		End:    "+",
+		Count:  scanPageSize,
+	}).Result()
+	if err != nil || len(pending) == 0 {
+		return nil, err
+	}
+
+	ranges := make([]*redis.XMessageSliceCmd, len(pending))
+	_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, entry := range pending {
+			ranges[i] = pipe.XRange(ctx, s.stream, entry.ID, entry.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]redis.XMessage, 0, len(pending))
+	for i, cmd := range ranges {
+		found := cmd.Val()
+		if len(found) == 0 {
+			found = []redis.XMessage{{ID: pending[i].ID}}
+		}
+		messages = append(messages, found[0])
+	}
+	return messages, nil
+}
+
+// Drop acknowledges and deletes the entries of list stored as raws, so one a
+// worker holds is not reclaimed either.
+func (s *StreamServiceImpl[T]) Drop(ctx context.Context, list string, raws ...string) (int, error) {
+	if len(raws) == 0 {
+		return 0, nil
+	}
+	wanted := make(map[string]int, len(raws))
+	for _, raw := range raws {
+		wanted[raw]++
+	}
+
+	var ids []string
+	err := s.walk(ctx, list, func(msg redis.XMessage) bool {
+		if raw, _ := msg.Values[streamField].(string); wanted[raw] > 0 {
+			wanted[raw]--
+			ids = append(ids, msg.ID)
+		}
+		return true
+	})
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	var deleted *redis.IntCmd
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, s.stream, s.group, ids...)
+		deleted = pipe.XDel(ctx, s.stream, ids...)
+		return nil
+	})
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to drop queue entries", zap.Error(err))
+		return 0, err
+	}
+	n := int(deleted.Val())
+	logger.FromCtx(ctx).Info("dropped queue entries", zap.String("list", list), zap.Int("count", n))
+	return n, nil
+}
+
+// RequeueClaimed has nothing to do: the stream has no claimed batch, and an
+// entry a worker abandoned is reclaimed by the next one after ClaimIdle.
+func (s *StreamServiceImpl[T]) RequeueClaimed(ctx context.Context) (int, error) {
+	return 0, nil
+}
@@ -0,0 +1,223 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func scanIDs(t *testing.T, r *RedisServiceImpl[item], list string) []string {
+	t.Helper()
+	var out []string
+	err := r.Scan(context.Background(), list, func(e QueueEntry[item]) bool {
+		if e.Position != int64(len(out)) {
+			t.Fatalf("entry %q at position %d, expected %d", e.Data.ID, e.Position, len(out))
+		}
+		out = append(out, e.Data.ID)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestScanWalksOldestFirstAcrossPages(t *testing.T) {
+	r, _ := newTestService(t)
+	var want []string
+	for i := 0; i < scanPageSize+5; i++ {
+		want = append(want, fmt.Sprintf("%04d", i))
+	}
+	store(t, r, want...)
+
+	got := scanIDs(t, r, LiveList)
+	if len(got) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("entry %d: expected %s, got %s", i, want[i], got[i])
+		}
+	}
+}
+
+func TestScanReportsUndecodableEntries(t *testing.T) {
+	r, mr := newTestService(t)
+	store(t, r, "a")
+	mr.Lpush(r.key, "nope")
+
+	var errs int
+	_ = r.Scan(context.Background(), LiveList, func(e QueueEntry[item]) bool {
+		if e.Err != nil {
+			errs++
+		}
+		return true
+	})
+	if errs != 1 {
+		t.Errorf("expected one undecodable entry, got %d", errs)
+	}
+}
+
+func TestDropRemovesOnlyTheGivenEntries(t *testing.T) {
+	r, _ := newTestService(t)
+	ctx := context.Background()
+	store(t, r, "a", "b", "c")
+
+	var raw string
+	_ = r.Scan(ctx, LiveList, func(e QueueEntry[item]) bool {
+		if e.Data.ID == "b" {
+			raw = e.Raw
+			return false
+		}
+		return true
+	})
+	n, err := r.Drop(ctx, LiveList, raw)
+	if err != nil || n != 1 {
+		t.Fatalf("expected one entry dropped, got %d, %v", n, err)
+	}
+	if got := scanIDs(t, r, LiveList); len(got) != 2 || got[0] != "a" || got[1] != "c" {
+		t.Errorf("expected a, c; got %v", got)
+	}
+}
+
+func TestRequeueClaimedPutsTheBatchAheadOfNewerEntries(t *testing.T) {
+	r, _ := newTestService(t)
+	ctx := context.Background()
+	store(t, r, "a", "b")
+	if _, err := r.GetAllData(ctx); err != nil {
+		t.Fatal(err)
+	}
+	store(t, r, "c")
+
+	n, err := r.RequeueClaimed(ctx)
+	if err != nil || n != 2 {
+		t.Fatalf("expected two entries requeued, got %d, %v", n, err)
+	}
+	if got := scanIDs(t, r, LiveList); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("expected a, b, c; got %v", got)
+	}
+	if n, _ := r.Len(ctx, ClaimedList); n != 0 {
+		t.Errorf("claimed batch should be gone, has %d entries", n)
+	}
+}
+
+func TestInspectCoalescedQueue(t *testing.T) {
+	r := newCoalescingService(t)
+	ctx := context.Background()
+	for _, v := range []versioned{
+		{ID: "a", Action: "create", UpdatedAt: 1},
+		{ID: "b", Action: "create", UpdatedAt: 5},
+	} {
+		if err := r.StoreData(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.GetAllData(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Newer for a, older for b, and c is new: requeueing keeps a's newer
+	// entry and b's claimed one.
+	for _, v := range []versioned{
+		{ID: "a", Action: "update", UpdatedAt: 2},
+		{ID: "b", Action: "update", UpdatedAt: 3},
+		{ID: "c", Action: "create", UpdatedAt: 1},
+	} {
+		if err := r.StoreData(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := r.Len(ctx, ClaimedList); err != nil || n != 2 {
+		t.Fatalf("claimed Len = %d, %v; want 2", n, err)
+	}
+	if n, err := r.Len(ctx, LiveList); err != nil || n != 3 {
+		t.Fatalf("live Len = %d, %v; want 3", n, err)
+	}
+	if n, err := r.Len(ctx, ProcessingList); err != nil || n != 0 {
+		t.Fatalf("processing Len = %d, %v; the mode has none", n, err)
+	}
+
+	n, err := r.RequeueClaimed(ctx)
+	if err != nil || n != 2 {
+		t.Fatalf("RequeueClaimed = %d, %v; want 2", n, err)
+	}
+	got := map[string]versioned{}
+	var order []string
+	err = r.Scan(ctx, LiveList, func(e QueueEntry[versioned]) bool {
+		got[e.Data.ID] = e.Data
+		order = append(order, e.Data.ID)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 3 || order[2] != "c" {
+		t.Fatalf("live entries %v, want a and b ahead of c", order)
+	}
+	if got["a"].UpdatedAt != 2 || got["b"].Action != "create" {
+		t.Errorf("requeue should keep the newer entry per id, got %+v", got)
+	}
+	if n, _ := r.Len(ctx, ClaimedList); n != 0 {
+		t.Errorf("claimed batch should be gone, has %d entries", n)
+	}
+
+	var raw string
+	_ = r.Scan(ctx, LiveList, func(e QueueEntry[versioned]) bool {
+		if e.Data.ID == "b" {
+			raw = e.Raw
+		}
+		return true
+	})
+	if n, err := r.Drop(ctx, LiveList, raw); err != nil || n != 1 {
+		t.Fatalf("Drop = %d, %v; want 1", n, err)
+	}
+	if n, _ := r.Len(ctx, LiveList); n != 2 {
+		t.Errorf("expected a and c left, have %d entries", n)
+	}
+}
+
+func TestInspectStreamQueue(t *testing.T) {
+	workers, _ := newTestStreams(t, "one")
+	w := workers[0]
+	ctx := context.Background()
+	for _, id := range []string{"a", "b", "c"} {
+		_ = w.StoreData(ctx, item{ID: id})
+	}
+	// ClaimSize is 2, so a and b are read and c waits.
+	if _, err := w.GetAllData(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := w.Len(ctx, LiveList); err != nil || n != 3 {
+		t.Fatalf("live Len = %d, %v; want 3", n, err)
+	}
+	if n, err := w.Len(ctx, ProcessingList); err != nil || n != 2 {
+		t.Fatalf("processing Len = %d, %v; want 2", n, err)
+	}
+
+	var pending []string
+	var raw string
+	err := w.Scan(ctx, ProcessingList, func(e QueueEntry[item]) bool {
+		pending = append(pending, e.Data.ID)
+		if e.Data.ID == "a" {
+			raw = e.Raw
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0] != "a" || pending[1] != "b" {
+		t.Fatalf("pending entries %v, want a, b", pending)
+	}
+
+	if n, err := w.Drop(ctx, ProcessingList, raw); err != nil || n != 1 {
+		t.Fatalf("Drop = %d, %v; want 1", n, err)
+	}
+	if n, _ := w.Len(ctx, LiveList); n != 2 {
+		t.Errorf("expected a deleted from the stream, %d entries left", n)
+	}
+	if n, _ := w.Len(ctx, ProcessingList); n != 1 {
+		t.Errorf("expected only b pending, %d are", n)
+	}
+}
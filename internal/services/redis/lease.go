@@ -0,0 +1,302 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// What a sync does when another run holds the lock; see RedisConfig.LockBusy.
+const (
+	SkipWhenLocked = "skip"
+	WaitWhenLocked = "wait"
+	FailWhenLocked = "fail"
+)
+
+var (
+	// ErrLockHeld is returned, wrapped in a *HeldError, when another run
+	// holds the lock.
+	ErrLockHeld = errors.New("the sync lock is held by another run")
+	// ErrLeaseLost means the lease expired or was taken over; whatever the
+	// run does next may overlap with another run.
+	ErrLeaseLost = errors.New("the sync lease was lost")
+)
+
+// LeaseHolder is what the lock key records about the run holding it.
+type LeaseHolder struct {
+	Holder string `json:"holder"`
+	// Token increases with every acquisition, so a later holder always has a
+	// higher one than any earlier holder.
+	Token int64 `json:"token"`
+	Since int64 `json:"since"`
+}
+
+// HeldError reports who holds the lock.
+type HeldError struct {
+	Holder LeaseHolder
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("%s: %s (token %d, since %s)", ErrLockHeld, e.Holder.Holder, e.Holder.Token,
+		time.Unix(e.Holder.Since, 0).UTC().Format(time.RFC3339))
+}
+
+func (e *HeldError) Unwrap() error { return ErrLockHeld }
+
+// Locker hands out the lease a sync run holds while it works the queue.
+//
+// A claimed batch left behind is taken to be orphaned and worked by the next
+// run. That is right when the previous run died, and wrong when it is merely
+// slow: a run outlasting its cron interval had a second one pick up the same
+// claimed key and send it alongside, each then deleting what the other was
+// still working. Only the holder of the lease touches the claimed batch now.
+type Locker struct {
+	client redis.UniversalClient
+	key    string
+	holder string
+	ttl    time.Duration
+}
+
+func NewLocker(ctx context.Context, redisCfg config.RedisConfig) *Locker {
+	return newLocker(newClient(ctx, redisCfg), redisCfg)
+}
+
+func newLocker(client redis.UniversalClient, redisCfg config.RedisConfig) *Locker {
+	host, _ := os.Hostname()
+	ttl := time.Duration(redisCfg.LockTTL) * time.Second
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	return &Locker{
+		client: client,
+		key:    queueKey(redisCfg) + ":lock",
+		holder: fmt.Sprintf("%s-%d", host, os.Getpid()),
+		ttl:    ttl,
+	}
+}
+
+func (l *Locker) fenceKey() string {
+	return l.key + ":fence"
+}
+
+// acquireScript takes the lock if it is free, stamping it with the next
+// fencing token, and otherwise returns the current holder.
+var acquireScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current then
+  return {0, current}
+end
+local token = redis.call('INCR', KEYS[2])
+local value = string.format('{"holder":%s,"token":%d,"since":%s}', cjson.encode(ARGV[1]), token, ARGV[2])
+redis.call('SET', KEYS[1], value, 'PX', ARGV[3])
+return {1, value}
+`)
+
+// renewScript and releaseScript only act on the lock while it still holds
+// this lease's value, so a run whose lease lapsed cannot extend or free the
+// next holder's.
+var renewScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Acquire takes the lease, trying for up to wait before giving up with a
+// *HeldError. A zero wait tries once.
+func (l *Locker) Acquire(ctx context.Context, wait time.Duration) (*Lease, error) {
+	log := logger.FromCtx(ctx)
+	deadline := time.Now().Add(wait)
+
+	for logged := false; ; logged = true {
+		res, err := acquireScript.Run(ctx, l.client, []string{l.key, l.fenceKey()},
+			l.holder, time.Now().Unix(), l.ttl.Milliseconds()).Slice()
+		if err != nil {
+			log.Error("Failed to acquire the sync lock", zap.Error(err))
+			return nil, err
+		}
+
+		value, _ := res[1].(string)
+		var holder LeaseHolder
+		if err := json.Unmarshal([]byte(value), &holder); err != nil {
+			return nil, fmt.Errorf("unreadable sync lock %q: %w", value, err)
+		}
+
+		if acquired, _ := res[0].(int64); acquired == 1 {
+			log.Info("acquired the sync lock",
+				zap.String("holder", holder.Holder), zap.Int64("token", holder.Token))
+			return newLease(ctx, l, value, holder), nil
+		}
+
+		if !logged {
+			log.Info("the sync lock is held by another run",
+				zap.String("holder", holder.Holder),
+				zap.Int64("token", holder.Token),
+				zap.Time("since", time.Unix(holder.Since, 0)))
+		}
+		if !time.Now().Before(deadline) {
+			return nil, &HeldError{Holder: holder}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(min(time.Second, time.Until(deadline))):
+		}
+	}
+}
+
+// Lease is a held lock, renewed in the background until released.
+type Lease struct {
+	locker *Locker
+	value  string
+	holder LeaseHolder
+
+	lost     chan struct{}
+	lostOnce sync.Once
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func newLease(ctx context.Context, locker *Locker, value string, holder LeaseHolder) *Lease {
+	lease := &Lease{
+		locker:  locker,
+		value:   value,
+		holder:  holder,
+		lost:    make(chan struct{}),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go lease.keepAlive(context.WithoutCancel(ctx))
+	return lease
+}
+
+// Lost is closed once the lease can no longer be renewed.
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// keepAlive renews at a third of the TTL, leaving two attempts' slack before
+// the lease would lapse.
+func (l *Lease) keepAlive(ctx context.Context) {
+	defer close(l.stopped)
+	ticker := time.NewTicker(l.locker.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if err := l.renew(ctx); err != nil {
+				if errors.Is(err, ErrLeaseLost) {
+					l.markLost(ctx)
+					return
+				}
+				// A failed round trip is not yet a lost lease; the next
+				// tick tries again while there is TTL left.
+				logger.FromCtx(ctx).Warn("Failed to renew the sync lock", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (l *Lease) renew(ctx context.Context) error {
+	renewed, err := renewScript.Run(ctx, l.locker.client, []string{l.locker.key},
+		l.value, l.locker.ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if renewed == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (l *Lease) markLost(ctx context.Context) {
+	l.lostOnce.Do(func() {
+		logger.FromCtx(ctx).Error("lost the sync lock; stopping",
+			zap.Int64("token", l.holder.Token))
+		close(l.lost)
+	})
+}
+
+type leaseKey struct{}
+
+// WithLease returns ctx carrying lease. Every change the Redis services make to
+// the claimed batch under it then applies only while lease holds the lock. A
+// nil lease, held by a run that needs none, fences nothing.
+func WithLease(ctx context.Context, lease *Lease) context.Context {
+	if lease == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, leaseKey{}, lease)
+}
+
+func leaseFrom(ctx context.Context) *Lease {
+	lease, _ := ctx.Value(leaseKey{}).(*Lease)
+	return lease
+}
+
+// fenceRetries bounds how often a fenced transaction starts over because the
+// lock changed under it. The holder's own renewal changes it too, so one
+// conflict does not mean the lease is gone.
+const fenceRetries = 3
+
+// fencedTx runs fn's commands in one MULTI/EXEC. Under a lease it WATCHes the
+// lock and compares its value first, so the commands apply only while the
+// lease holds it. Checking the lease and then changing the claimed batch, as
+// two round trips, let a run that stalled past its TTL in between delete what
+// the next holder was working on. fn may be called more than once.
+func fencedTx(ctx context.Context, client redis.UniversalClient, fn func(redis.Pipeliner) error) error {
+	lease := leaseFrom(ctx)
+	if lease == nil {
+		_, err := client.TxPipelined(ctx, fn)
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err := client.Watch(ctx, func(tx *redis.Tx) error {
+			current, err := tx.Get(ctx, lease.locker.key).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if current != lease.value {
+				lease.markLost(ctx)
+				return fmt.Errorf("%w (token %d)", ErrLeaseLost, lease.holder.Token)
+			}
+			_, err = tx.TxPipelined(ctx, fn)
+			return err
+		}, lease.locker.key)
+		if !errors.Is(err, redis.TxFailedErr) || attempt == fenceRetries {
+			return err
+		}
+	}
+}
+
+// Release stops renewing and frees the lock if this lease still holds it.
+func (l *Lease) Release(ctx context.Context) error {
+	close(l.stop)
+	<-l.stopped
+
+	if err := releaseScript.Run(ctx, l.locker.client, []string{l.locker.key}, l.value).Err(); err != nil {
+		logger.FromCtx(ctx).Error("Failed to release the sync lock", zap.Error(err))
+		return err
+	}
+	logger.FromCtx(ctx).Info("released the sync lock", zap.Int64("token", l.holder.Token))
+	return nil
+}
@@ -0,0 +1,164 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/weeb-vip/algolia-sync/config"
+)
+
+func newTestLockers(t *testing.T, holders ...string) ([]*Locker, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	var lockers []*Locker
+	for _, h := range holders {
+		l := newLocker(client, config.RedisConfig{Key: "q", LockTTL: 30})
+		l.holder = h
+		lockers = append(lockers, l)
+	}
+	return lockers, mr
+}
+
+func TestSecondRunIsToldWhoHoldsTheLock(t *testing.T) {
+	lockers, _ := newTestLockers(t, "first", "second")
+	ctx := context.Background()
+
+	lease, err := lockers[0].Acquire(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lease.Release(ctx)
+
+	_, err = lockers[1].Acquire(ctx, 0)
+	var held *HeldError
+	if !errors.As(err, &held) || !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("expected a HeldError, got %v", err)
+	}
+	if held.Holder.Holder != "first" || held.Holder.Token != lease.holder.Token {
+		t.Errorf("expected first with token %d, got %+v", lease.holder.Token, held.Holder)
+	}
+}
+
+func TestReleasedLockGoesToTheNextRunWithAHigherToken(t *testing.T) {
+	lockers, _ := newTestLockers(t, "first", "second")
+	ctx := context.Background()
+
+	first, _ := lockers[0].Acquire(ctx, 0)
+	if err := first.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	second, err := lockers[1].Acquire(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Release(ctx)
+	if second.holder.Token <= first.holder.Token {
+		t.Errorf("fencing token should increase, got %d after %d", second.holder.Token, first.holder.Token)
+	}
+}
+
+func TestWaitingRunGetsTheLockOnceItIsFree(t *testing.T) {
+	lockers, _ := newTestLockers(t, "first", "second")
+	ctx := context.Background()
+
+	first, _ := lockers[0].Acquire(ctx, 0)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_ = first.Release(ctx)
+	}()
+
+	second, err := lockers[1].Acquire(ctx, 5*time.Second)
+	if err != nil {
+		t.Fatalf("expected the lock after waiting, got %v", err)
+	}
+	_ = second.Release(ctx)
+}
+
+func TestExpiredLeaseCannotTouchTheClaimedBatchOrFreeTheNextHolder(t *testing.T) {
+	lockers, mr := newTestLockers(t, "stalled", "next")
+	ctx := context.Background()
+	client := lockers[0].client
+	_ = client.RPush(ctx, "q:claimed", "a").Err()
+
+	stalled, _ := lockers[0].Acquire(ctx, 0)
+	mr.FastForward(time.Minute)
+	next, err := lockers[1].Acquire(ctx, 0)
+	if err != nil {
+		t.Fatalf("an expired lock should be free, got %v", err)
+	}
+
+	err = fencedTx(WithLease(ctx, stalled), client, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, "q:claimed")
+		return nil
+	})
+	if !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("expected ErrLeaseLost, got %v", err)
+	}
+	if !mr.Exists("q:claimed") {
+		t.Error("the stalled run deleted the claimed batch")
+	}
+	select {
+	case <-stalled.Lost():
+	default:
+		t.Error("Lost should be closed once the fence finds the lease gone")
+	}
+	if err := stalled.renew(ctx); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("renewing a lapsed lease should fail, got %v", err)
+	}
+
+	_ = stalled.Release(ctx)
+	err = fencedTx(WithLease(ctx, next), client, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, "q:claimed")
+		return nil
+	})
+	if err != nil {
+		t.Errorf("the stalled run must not release the next holder's lock, got %v", err)
+	}
+	if mr.Exists("q:claimed") {
+		t.Error("the holder could not clear the claimed batch")
+	}
+	_ = next.Release(ctx)
+}
+
+func TestRenewResetsTheTTL(t *testing.T) {
+	lockers, mr := newTestLockers(t, "only")
+	ctx := context.Background()
+
+	lease, _ := lockers[0].Acquire(ctx, 0)
+	defer lease.Release(ctx)
+	mr.FastForward(20 * time.Second)
+	if err := lease.renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL(lockers[0].key); ttl < 29*time.Second {
+		t.Errorf("expected the TTL reset to 30s, got %v", ttl)
+	}
+}
+
+func TestClearDataKeepsTheBatchOnceTheLeaseIsLost(t *testing.T) {
+	r, mr := newTestService(t)
+	ctx := context.Background()
+	_ = r.StoreData(ctx, item{ID: "a"})
+	if got, _ := r.GetAllData(ctx); len(got) != 1 {
+		t.Fatalf("expected a claimed, got %v", got)
+	}
+
+	lease, err := newLocker(r.client, config.RedisConfig{Key: "q", LockTTL: 30}).Acquire(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lease.Release(ctx)
+	mr.FastForward(time.Minute)
+
+	if err := r.ClearData(WithLease(ctx, lease)); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("expected ErrLeaseLost, got %v", err)
+	}
+	if !mr.Exists(r.claimedKey()) {
+		t.Error("a run without the lease cleared the claimed batch")
+	}
+}
@@ -0,0 +1,351 @@
+package redis
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// PagedQueue claims the queue as GetAllData does, but reads the claimed batch
+// a page at a time instead of returning all of it.
+//
+// GetAllData decodes the whole batch into one slice, and the sync then holds
+// that alongside the Algolia batches built from it; a catalogue replay made the
+// cron job's memory climb with the size of the queue. A page is dropped from
+// the claimed batch as soon as Algolia has it, so a run holds at most one page.
+type PagedQueue[T any] interface {
+	// ClaimPages claims the queue, or recovers an orphaned claim, and returns
+	// an iterator over it in pages of size. It returns nil when there is
+	// nothing to claim.
+	ClaimPages(ctx context.Context, size int) (PageIterator[T], error)
+}
+
+// PageIterator walks a claimed batch oldest first.
+type PageIterator[T any] interface {
+	// Next returns the oldest page not yet acknowledged, or nothing once the
+	// batch is done. Without an Ack in between, it returns the same page
+	// again.
+	Next(ctx context.Context) ([]T, error)
+	// Ack drops the page Next last returned from the claimed batch.
+	Ack(ctx context.Context) error
+	// Fail counts an attempt for the items of that page that did not reach
+	// Algolia, keyed by their index in it, with why. Those that have used up
+	// their attempts are dead-lettered and dropped from the page; it returns
+	// how many were.
+	Fail(ctx context.Context, failed map[int]error) (int, error)
+}
+
+func (r *RedisServiceImpl[T]) ClaimPages(ctx context.Context, size int) (PageIterator[T], error) {
+	if size <= 0 {
+		size = scanPageSize
+	}
+	if r.coalesce {
+		if claimed, err := r.claimCoalesced(ctx); err != nil || !claimed {
+			return nil, err
+		}
+		return &coalescedPages[T]{r: r, size: int64(size)}, nil
+	}
+	if claimed, err := r.claimList(ctx); err != nil || !claimed {
+		return nil, err
+	}
+	return &listPages[T]{r: r, size: int64(size)}, nil
+}
+
+// listPages reads the claimed list from the right, where the oldest entries
+// are. Nothing else writes to a claimed list, so trimming a page off that end
+// is exact.
+type listPages[T any] struct {
+	r    *RedisServiceImpl[T]
+	size int64
+	// current is how many entries the last page holds, and raws what they
+	// are, in the order Next returned them.
+	current int64
+	raws    []string
+}
+
+func (p *listPages[T]) Next(ctx context.Context) ([]T, error) {
+	log := logger.FromCtx(ctx)
+	key := p.r.claimedKey()
+
+	for {
+		raws, err := p.r.client.LRange(ctx, key, -p.size, -1).Result()
+		if err != nil {
+			log.Error("Failed to get data from Redis", zap.Error(err))
+			return nil, err
+		}
+		if len(raws) == 0 {
+			p.current = 0
+			return nil, nil
+		}
+
+		var results []T
+		p.raws = p.raws[:0]
+		for i := len(raws) - 1; i >= 0; i-- {
+			var data T
+			if decodeErr := DecodeEntry(raws[i], &data); decodeErr != nil {
+				log.Warn("Failed to unmarshal item, dead-lettering it", zap.Error(decodeErr))
+				if err := p.deadLetter(ctx, newDeadLetter(raws[i], UndecodableReason, decodeErr, 0)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			results = append(results, data)
+			p.raws = append(p.raws, raws[i])
+		}
+
+		// A page of nothing but undecodable entries is already dealt with;
+		// move on rather than hand back an empty page that reads as the end.
+		if len(results) > 0 {
+			p.current = int64(len(results))
+			log.Info("Retrieved a page from Redis", zap.Int("count", len(results)))
+			return results, nil
+		}
+	}
+}
+
+// deadLetter removes the entry from the tail, which is where this page is.
+func (p *listPages[T]) deadLetter(ctx context.Context, letter DeadLetter) error {
+	err := fencedTx(ctx, p.r.client, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, p.r.claimedKey(), -1, letter.Raw)
+		pipe.HDel(ctx, p.r.attemptsKey(), entryDigest(letter.Raw))
+		return pushDeadLetter(ctx, pipe, p.r.key, letter)
+	})
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to dead-letter an entry", zap.Error(err))
+	}
+	return err
+}
+
+func (p *listPages[T]) Ack(ctx context.Context) error {
+	if p.current == 0 {
+		return nil
+	}
+	err := fencedTx(ctx, p.r.client, func(pipe redis.Pipeliner) error {
+		pipe.LTrim(ctx, p.r.claimedKey(), 0, -(p.current + 1))
+		p.r.forgetAttempts(ctx, pipe, p.raws)
+		return nil
+	})
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to acknowledge a page", zap.Error(err))
+		return err
+	}
+	p.current, p.raws = 0, p.raws[:0]
+	return nil
+}
+
+func (p *listPages[T]) Fail(ctx context.Context, failed map[int]error) (int, error) {
+	dead, err := p.r.countAttempts(ctx, p.raws, failed, p.deadLetter)
+	if err != nil {
+		return 0, err
+	}
+	p.raws = dropIndexes(p.raws, dead)
+	p.current -= int64(len(dead))
+	return len(dead), nil
+}
+
+// coalescedPages reads the claimed ids in arrival order, and acknowledges a
+// page by removing its ids from all three claimed keys.
+type coalescedPages[T any] struct {
+	r    *RedisServiceImpl[T]
+	size int64
+	// current holds the ids of the last page, and raws their entries.
+	current []string
+	raws    []string
+}
+
+func (p *coalescedPages[T]) Next(ctx context.Context) ([]T, error) {
+	log := logger.FromCtx(ctx)
+	claimedPending := p.r.pendingKey() + ":claimed"
+	claimedOrder := p.r.orderKey() + ":claimed"
+
+	for {
+		ids, err := p.r.client.ZRange(ctx, claimedOrder, 0, p.size-1).Result()
+		if err != nil {
+			log.Error("Failed to get data from Redis", zap.Error(err))
+			return nil, err
+		}
+		p.current = nil
+		if len(ids) == 0 {
+			return nil, nil
+		}
+
+		raws, err := p.r.client.HMGet(ctx, claimedPending, ids...).Result()
+		if err != nil {
+			log.Error("Failed to get data from Redis", zap.Error(err))
+			return nil, err
+		}
+
+		var (
+			results []T
+			page    []string
+			pageRaw []string
+			skipped []string
+		)
+		for i, raw := range raws {
+			s, ok := raw.(string)
+			if !ok {
+				skipped = append(skipped, ids[i])
+				continue
+			}
+			var data T
+			if decodeErr := DecodeEntry(s, &data); decodeErr != nil {
+				log.Warn("Failed to unmarshal item, dead-lettering it", zap.Error(decodeErr))
+				err := fencedTx(ctx, p.r.client, func(pipe redis.Pipeliner) error {
+					p.remove(ctx, pipe, ids[i])
+					return pushDeadLetter(ctx, pipe, p.r.key, newDeadLetter(s, UndecodableReason, decodeErr, 0))
+				})
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			results = append(results, data)
+			page = append(page, ids[i])
+			pageRaw = append(pageRaw, s)
+		}
+
+		// An id without an entry has nothing to send; drop it so it does not
+		// take up a slot in every page.
+		if len(skipped) > 0 {
+			err := fencedTx(ctx, p.r.client, func(pipe redis.Pipeliner) error {
+				p.remove(ctx, pipe, skipped...)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if len(results) > 0 {
+			p.current, p.raws = page, pageRaw
+			log.Info("Retrieved a page from Redis", zap.Int("count", len(results)))
+			return results, nil
+		}
+	}
+}
+
+func (p *coalescedPages[T]) Ack(ctx context.Context) error {
+	if len(p.current) == 0 {
+		return nil
+	}
+	err := fencedTx(ctx, p.r.client, func(pipe redis.Pipeliner) error {
+		p.remove(ctx, pipe, p.current...)
+		p.r.forgetAttempts(ctx, pipe, p.raws)
+		return nil
+	})
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to acknowledge a page", zap.Error(err))
+		return err
+	}
+	p.current, p.raws = nil, nil
+	return nil
+}
+
+func (p *coalescedPages[T]) Fail(ctx context.Context, failed map[int]error) (int, error) {
+	byRaw := make(map[string]string, len(p.raws))
+	for i, raw := range p.raws {
+		byRaw[raw] = p.current[i]
+	}
+	dead, err := p.r.countAttempts(ctx, p.raws, failed, func(ctx context.Context, letter DeadLetter) error {
+		err := fencedTx(ctx, p.r.client, func(pipe redis.Pipeliner) error {
+			p.remove(ctx, pipe, byRaw[letter.Raw])
+			pipe.HDel(ctx, p.r.attemptsKey(), entryDigest(letter.Raw))
+			return pushDeadLetter(ctx, pipe, p.r.key, letter)
+		})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	p.current = dropIndexes(p.current, dead)
+	p.raws = dropIndexes(p.raws, dead)
+	return len(dead), nil
+}
+
+func (p *coalescedPages[T]) remove(ctx context.Context, pipe redis.Pipeliner, ids ...string) {
+	members := make([]any, len(ids))
+	for i, id := range ids {
+		members[i] = id
+	}
+	pipe.ZRem(ctx, p.r.orderKey()+":claimed", members...)
+	pipe.HDel(ctx, p.r.pendingKey()+":claimed", ids...)
+	pipe.HDel(ctx, p.r.versionsKey()+":claimed", ids...)
+}
+
+// countAttempts counts an attempt for each of raws at the indexes in failed,
+// and dead-letters through deadLetter those that have used up their attempts.
+// It returns their indexes. The count is kept by entry digest, as the reliable
+// mode keeps it, so a page sent again by the next run carries it along.
+func (r *RedisServiceImpl[T]) countAttempts(
+	ctx context.Context,
+	raws []string,
+	failed map[int]error,
+	deadLetter func(ctx context.Context, letter DeadLetter) error,
+) (map[int]struct{}, error) {
+	log := logger.FromCtx(ctx)
+
+	indexes := make([]int, 0, len(failed))
+	for i := range failed {
+		indexes = append(indexes, i)
+	}
+	counts := make([]*redis.IntCmd, len(indexes))
+	err := fencedTx(ctx, r.client, func(pipe redis.Pipeliner) error {
+		for n, i := range indexes {
+			counts[n] = pipe.HIncrBy(ctx, r.attemptsKey(), entryDigest(raws[i]), 1)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to count attempts", zap.Error(err))
+		return nil, err
+	}
+
+	dead := make(map[int]struct{})
+	if r.maxAttempts <= 0 {
+		return dead, nil
+	}
+	for n, i := range indexes {
+		attempts := int(counts[n].Val())
+		if attempts < r.maxAttempts {
+			continue
+		}
+		if err := deadLetter(ctx, newDeadLetter(raws[i], MaxAttemptsReason, failed[i], attempts)); err != nil {
+			log.Error("Failed to dead-letter an entry", zap.Error(err))
+			return nil, err
+		}
+		dead[i] = struct{}{}
+	}
+	if len(dead) > 0 {
+		log.Warn("dead-lettered items that used up their attempts",
+			zap.Int("count", len(dead)), zap.Int("maxAttempts", r.maxAttempts))
+	}
+	return dead, nil
+}
+
+// forgetAttempts drops the attempt counts of entries that made it.
+func (r *RedisServiceImpl[T]) forgetAttempts(ctx context.Context, pipe redis.Pipeliner, raws []string) {
+	if len(raws) == 0 {
+		return
+	}
+	digests := make([]string, len(raws))
+	for i, raw := range raws {
+		digests[i] = entryDigest(raw)
+	}
+	pipe.HDel(ctx, r.attemptsKey(), digests...)
+}
+
+// dropIndexes returns items without those at the indexes in drop.
+func dropIndexes[E any](items []E, drop map[int]struct{}) []E {
+	if len(drop) == 0 {
+		return items
+	}
+	kept := make([]E, 0, len(items))
+	for i, item := range items {
+		if _, ok := drop[i]; !ok {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
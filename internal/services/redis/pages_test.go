@@ -0,0 +1,210 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func itemIDs(items []item) []string {
+	out := make([]string, len(items))
+	for i, it := range items {
+		out[i] = it.ID
+	}
+	return out
+}
+
+func TestPagesWalkTheClaimedBatchOldestFirst(t *testing.T) {
+	r, mr := newTestService(t)
+	ctx := context.Background()
+	store(t, r, "a", "b", "c", "d", "e")
+
+	pages, err := r.ClaimPages(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Arrives after the claim, so belongs to the next run.
+	store(t, r, "f")
+
+	var got [][]string
+	for {
+		page, err := pages.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		got = append(got, itemIDs(page))
+		if err := pages.Ack(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 3 || got[0][0] != "a" || got[1][0] != "c" || got[2][0] != "e" || len(got[2]) != 1 {
+		t.Errorf("expected pages [a b] [c d] [e], got %v", got)
+	}
+	if mr.Exists(r.claimedKey()) {
+		t.Error("a fully acknowledged batch should leave no claimed key")
+	}
+	if live, _ := mr.List(r.key); len(live) != 1 {
+		t.Errorf("the item queued mid-run should be untouched, got %v", live)
+	}
+}
+
+func TestUnacknowledgedPageIsRecoveredByTheNextRun(t *testing.T) {
+	r, _ := newTestService(t)
+	ctx := context.Background()
+	store(t, r, "a", "b", "c")
+
+	pages, _ := r.ClaimPages(ctx, 2)
+	first, _ := pages.Next(ctx)
+	_ = pages.Ack(ctx)
+	second, _ := pages.Next(ctx)
+	if itemIDs(first)[0] != "a" || itemIDs(second)[0] != "c" {
+		t.Fatalf("unexpected pages %v, %v", itemIDs(first), itemIDs(second))
+	}
+	// The run gives up on c. Asking again returns the same page.
+	if again, _ := pages.Next(ctx); len(again) != 1 || again[0].ID != "c" {
+		t.Fatalf("an unacknowledged page should come back, got %v", itemIDs(again))
+	}
+
+	store(t, r, "d")
+	recovered, err := r.ClaimPages(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := recovered.Next(ctx)
+	if got := itemIDs(page); len(got) != 1 || got[0] != "c" {
+		t.Errorf("next run should resume with c alone, got %v", got)
+	}
+}
+
+func TestPagesDeadLetterUndecodableEntries(t *testing.T) {
+	r, mr := newTestService(t)
+	ctx := context.Background()
+	mr.Lpush(r.key, "nope")
+	mr.Lpush(r.key, "worse")
+	store(t, r, "a")
+
+	pages, _ := r.ClaimPages(ctx, 2)
+	page, err := pages.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := itemIDs(page); len(got) != 1 || got[0] != "a" {
+		t.Fatalf("expected a page past the bad entries holding a, got %v", got)
+	}
+	_ = pages.Ack(ctx)
+	if rest, _ := pages.Next(ctx); len(rest) != 0 {
+		t.Errorf("expected the batch done, got %v", itemIDs(rest))
+	}
+	if dead, _ := mr.List(deadLetterKey(r.key)); len(dead) != 2 {
+		t.Errorf("expected both bad entries dead-lettered, got %d", len(dead))
+	}
+}
+
+func TestCoalescedPagesAcknowledgeByID(t *testing.T) {
+	r := newCoalescingService(t)
+	ctx := context.Background()
+	for i, id := range []string{"a", "b", "c"} {
+		if err := r.StoreData(ctx, versioned{ID: id, Queued: int64(i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pages, err := r.ClaimPages(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := pages.Next(ctx)
+	if len(first) != 2 || first[0].ID != "a" || first[1].ID != "b" {
+		t.Fatalf("expected a, b; got %+v", first)
+	}
+	_ = pages.Ack(ctx)
+	second, _ := pages.Next(ctx)
+	if len(second) != 1 || second[0].ID != "c" {
+		t.Fatalf("expected c, got %+v", second)
+	}
+	_ = pages.Ack(ctx)
+	if rest, _ := pages.Next(ctx); len(rest) != 0 {
+		t.Errorf("expected the batch done, got %+v", rest)
+	}
+}
+
+func TestPagesDeadLetterAnItemOutOfAttempts(t *testing.T) {
+	r, mr := newTestService(t)
+	r.maxAttempts = 2
+	ctx := context.Background()
+	store(t, r, "a", "poison", "b", "c")
+
+	refused := errors.New("record too big")
+	for run := 1; run <= 2; run++ {
+		pages, err := r.ClaimPages(ctx, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, _ := pages.Next(ctx)
+		if got := itemIDs(page); len(got) != 3 || got[1] != "poison" {
+			t.Fatalf("run %d: expected a, poison, b; got %v", run, got)
+		}
+		dead, err := pages.Fail(ctx, map[int]error{1: refused})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run == 1 {
+			if dead != 0 {
+				t.Fatalf("dead-lettered on the first attempt")
+			}
+			continue
+		}
+		if dead != 1 {
+			t.Fatalf("expected poison dead-lettered on its last attempt, got %d", dead)
+		}
+		// The rest of the page made it, so the run goes on past it.
+		if err := pages.Ack(ctx); err != nil {
+			t.Fatal(err)
+		}
+		rest, _ := pages.Next(ctx)
+		if got := itemIDs(rest); len(got) != 1 || got[0] != "c" {
+			t.Errorf("expected c next, got %v", got)
+		}
+	}
+
+	letters, _ := (&DeadLetterQueueImpl{client: r.client, key: r.key}).List(ctx, 0)
+	if len(letters) != 1 || letters[0].Reason != MaxAttemptsReason || letters[0].Attempts != 2 || letters[0].Error != refused.Error() {
+		t.Errorf("expected poison dead-lettered out of attempts, got %+v", letters)
+	}
+	if mr.Exists(r.attemptsKey()) {
+		t.Error("attempt counts should be gone once the items are settled")
+	}
+}
+
+func TestCoalescedPagesDeadLetterAnItemOutOfAttempts(t *testing.T) {
+	r := newCoalescingService(t)
+	r.maxAttempts = 1
+	ctx := context.Background()
+	for i, id := range []string{"a", "poison", "b"} {
+		if err := r.StoreData(ctx, versioned{ID: id, Queued: int64(i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pages, _ := r.ClaimPages(ctx, 3)
+	page, _ := pages.Next(ctx)
+	if len(page) != 3 {
+		t.Fatalf("expected the whole batch, got %+v", page)
+	}
+	if dead, err := pages.Fail(ctx, map[int]error{1: errors.New("refused")}); err != nil || dead != 1 {
+		t.Fatalf("Fail = %d, %v; want poison dead-lettered", dead, err)
+	}
+	if err := pages.Ack(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rest, _ := pages.Next(ctx); len(rest) != 0 {
+		t.Errorf("expected the batch done, got %+v", rest)
+	}
+	letters, _ := (&DeadLetterQueueImpl{client: r.client, key: r.key}).List(ctx, 0)
+	if len(letters) != 1 || letters[0].Reason != MaxAttemptsReason {
+		t.Errorf("expected one dead letter out of attempts, got %+v", letters)
+	}
+}
@@ -2,13 +2,20 @@ package redis
 
 import (
 	"context"
-	"encoding/json"
 	"github.com/redis/go-redis/v9"
 	"github.com/weeb-vip/algolia-sync/config"
 	"github.com/weeb-vip/algolia-sync/internal/logger"
 	"go.uber.org/zap"
 )
 
+// Queue modes selectable through RedisConfig.QueueMode.
+const (
+	BatchQueueMode    = "batch"
+	ReliableQueueMode = "reliable"
+	CoalesceQueueMode = "coalesce"
+	StreamQueueMode   = "stream"
+)
+
 type RedisService[T any] interface {
 	StoreData(ctx context.Context, data T) error
 	GetAllData(ctx context.Context) ([]T, error)
@@ -16,49 +23,45 @@ type RedisService[T any] interface {
 }
 
 type RedisServiceImpl[T any] struct {
-	client *redis.Client
+	client redis.UniversalClient
 	key    string
+	// coalesce keeps one pending entry per record; see coalesce.go.
+	coalesce bool
+	// maxAttempts is how many times an item may fail to reach Algolia before
+	// it is dead-lettered. Zero retries forever.
+	maxAttempts int
+	// codec encodes what StoreData writes; nil writes JSON. Reads decode
+	// whatever format each entry is in.
+	codec Codec
 }
 
 func NewRedisService[T any](ctx context.Context, redisCfg config.RedisConfig) RedisService[T] {
-	log := logger.FromCtx(ctx)
-
-	opts, err := redis.ParseURL(redisCfg.URL)
-	if err != nil {
-		log.Fatal("Failed to parse Redis URL", zap.Error(err))
-	}
-
-	if redisCfg.Password != "" {
-		opts.Password = redisCfg.Password
-	}
-	opts.DB = redisCfg.DB
-
-	client := redis.NewClient(opts)
-
-	// Test connection
-	_, err = client.Ping(ctx).Result()
-	if err != nil {
-		log.Fatal("Failed to connect to Redis", zap.Error(err))
+	if redisCfg.QueueMode == StreamQueueMode {
+		return NewStreamService[T](ctx, redisCfg)
 	}
-
-	log.Info("Successfully connected to Redis")
-
 	return &RedisServiceImpl[T]{
-		client: client,
-		key:    redisCfg.Key,
+		client:      newClient(ctx, redisCfg),
+		key:         queueKey(redisCfg),
+		coalesce:    redisCfg.QueueMode == CoalesceQueueMode,
+		maxAttempts: redisCfg.MaxAttempts,
+		codec:       codecFor(ctx, redisCfg.Codec),
 	}
 }
 
 func (r *RedisServiceImpl[T]) StoreData(ctx context.Context, data T) error {
 	log := logger.FromCtx(ctx)
 
-	jsonData, err := json.Marshal(data)
+	encoded, err := r.encode(data)
 	if err != nil {
-		log.Error("Failed to marshal data to JSON", zap.Error(err))
+		log.Error("Failed to encode data", zap.Error(err))
 		return err
 	}
 
-	err = r.client.LPush(ctx, r.key, jsonData).Err()
+	if r.coalesce {
+		err = r.storeCoalesced(ctx, data, encoded)
+	} else {
+		err = r.client.LPush(ctx, r.key, encoded).Err()
+	}
 	if err != nil {
 		log.Error("Failed to store data in Redis", zap.Error(err))
 		return err
@@ -68,6 +71,25 @@ func (r *RedisServiceImpl[T]) StoreData(ctx context.Context, data T) error {
 	return nil
 }
 
+func (r *RedisServiceImpl[T]) encode(data T) ([]byte, error) {
+	return encodeWith(r.codec, data)
+}
+
+// storeOn queues exactly one command storing data on pipe. EVALSHA cannot
+// fall back to EVAL once it is queued, so the coalescing script is sent whole.
+func (r *RedisServiceImpl[T]) storeOn(ctx context.Context, pipe redis.Pipeliner, data T, encoded []byte) error {
+	if !r.coalesce {
+		pipe.LPush(ctx, r.key, encoded)
+		return nil
+	}
+	keys, args, err := r.coalesceArgs(data, encoded)
+	if err != nil {
+		return err
+	}
+	coalesceScript.Eval(ctx, pipe, keys, args...)
+	return nil
+}
+
 // GetAllData claims the queue by renaming it, then reads the claimed copy.
 //
 // It used to LRANGE the live key and let the caller DEL it afterwards, which
@@ -80,24 +102,11 @@ func (r *RedisServiceImpl[T]) StoreData(ctx context.Context, data T) error {
 // from the claimed one, so nothing can slip through the gap.
 func (r *RedisServiceImpl[T]) GetAllData(ctx context.Context) ([]T, error) {
 	log := logger.FromCtx(ctx)
-
-	// A leftover claimed batch means the previous run died before finishing it.
-	// Work that first: RENAME overwrites its destination, so claiming again
-	// would destroy the orphaned batch -- the same silent loss this is fixing.
-	orphaned, err := r.client.Exists(ctx, r.claimedKey()).Result()
-	if err != nil {
-		log.Error("Failed to check for an orphaned batch", zap.Error(err))
-		return nil, err
+	if r.coalesce {
+		return r.getAllCoalesced(ctx)
 	}
-	if orphaned > 0 {
-		log.Warn("recovering a batch left behind by a previous run",
-			zap.String("key", r.claimedKey()))
-	} else if err := r.client.Rename(ctx, r.key, r.claimedKey()).Err(); err != nil {
-		// Nothing to claim: an empty queue has no key to rename.
-		if err == redis.Nil || err.Error() == "ERR no such key" {
-			return nil, nil
-		}
-		log.Error("Failed to claim the Redis queue", zap.Error(err))
+
+	if claimed, err := r.claimList(ctx); err != nil || !claimed {
 		return nil, err
 	}
 
@@ -110,9 +119,14 @@ func (r *RedisServiceImpl[T]) GetAllData(ctx context.Context) ([]T, error) {
 	var results []T
 	for _, item := range items {
 		var data T
-		err := json.Unmarshal([]byte(item), &data)
+		err := DecodeEntry(item, &data)
 		if err != nil {
-			log.Warn("Failed to unmarshal item, skipping", zap.Error(err))
+			// Taken off the claimed batch as well, so a retried run does not
+			// dead-letter it a second time.
+			log.Warn("Failed to unmarshal item, dead-lettering it", zap.Error(err))
+			if err := r.deadLetter(ctx, r.claimedKey(), newDeadLetter(item, UndecodableReason, err, 0)); err != nil {
+				return nil, err
+			}
 			continue
 		}
 		results = append(results, data)
@@ -122,6 +136,39 @@ func (r *RedisServiceImpl[T]) GetAllData(ctx context.Context) ([]T, error) {
 	return results, nil
 }
 
+// claimList claims the live list, or reports false when there is nothing to
+// claim.
+func (r *RedisServiceImpl[T]) claimList(ctx context.Context) (bool, error) {
+	log := logger.FromCtx(ctx)
+
+	// A leftover claimed batch means the previous run died before finishing it.
+	// Work that first: RENAME overwrites its destination, so claiming again
+	// would destroy the orphaned batch -- the same silent loss this is fixing.
+	orphaned, err := r.client.Exists(ctx, r.claimedKey()).Result()
+	if err != nil {
+		log.Error("Failed to check for an orphaned batch", zap.Error(err))
+		return false, err
+	}
+	if orphaned > 0 {
+		log.Warn("recovering a batch left behind by a previous run",
+			zap.String("key", r.claimedKey()))
+		return true, nil
+	}
+	err = fencedTx(ctx, r.client, func(pipe redis.Pipeliner) error {
+		pipe.Rename(ctx, r.key, r.claimedKey())
+		return nil
+	})
+	if err != nil {
+		// Nothing to claim: an empty queue has no key to rename.
+		if err == redis.Nil || err.Error() == "ERR no such key" {
+			return false, nil
+		}
+		log.Error("Failed to claim the Redis queue", zap.Error(err))
+		return false, err
+	}
+	return true, nil
+}
+
 // claimedKey holds the batch currently being worked. Anything that arrives
 // mid-sync accumulates on the live key and is picked up by the next run.
 func (r *RedisServiceImpl[T]) claimedKey() string {
@@ -132,7 +179,15 @@ func (r *RedisServiceImpl[T]) claimedKey() string {
 func (r *RedisServiceImpl[T]) ClearData(ctx context.Context) error {
 	log := logger.FromCtx(ctx)
 
-	err := r.client.Del(ctx, r.claimedKey()).Err()
+	var err error
+	if r.coalesce {
+		err = r.clearCoalesced(ctx)
+	} else {
+		err = fencedTx(ctx, r.client, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, r.claimedKey())
+			return nil
+		})
+	}
 	if err != nil {
 		log.Error("Failed to clear data from Redis", zap.Error(err))
 		return err
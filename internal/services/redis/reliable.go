@@ -0,0 +1,261 @@
+package redis
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Claimed is one item taken off the queue, carrying what is needed to
+// acknowledge it afterwards.
+type Claimed[T any] struct {
+	Data T
+	// Raw is the entry exactly as stored. LREM matches on value, so it is how
+	// the item is found again on the processing list.
+	Raw string
+	// Attempts counts earlier runs that claimed the item and gave it back.
+	Attempts int
+	// Err is why the item is being given back. Set it before Nack; it is
+	// recorded if the item is dead-lettered.
+	Err error
+}
+
+// ReliableQueue hands items out one at a time and forgets each only once it is
+// acknowledged.
+//
+// The batch mode claims the whole list and keeps or discards it as a unit, so
+// a single record Algolia refuses holds every other item in the batch hostage:
+// the run fails, the claimed key is kept, and the next run sends all of it
+// again, forever. Here each item lives on a processing list while it is being
+// worked and leaves it individually, so a poison record only ever costs itself.
+type ReliableQueue[T any] interface {
+	// Recover returns anything a previous run left on the processing list to
+	// the queue. Call it before the first Claim of a run.
+	Recover(ctx context.Context) (int, error)
+	// Claim moves up to n items onto the processing list, oldest first; n of
+	// zero or less claims a page of the default size.
+	Claim(ctx context.Context, n int) ([]Claimed[T], error)
+	// Ack forgets items that reached Algolia.
+	Ack(ctx context.Context, items ...Claimed[T]) error
+	// Nack puts items back to be claimed again and counts the attempt. Items
+	// that have used up their attempts are dead-lettered instead.
+	Nack(ctx context.Context, items ...Claimed[T]) error
+}
+
+func NewReliableQueue[T any](ctx context.Context, redisCfg config.RedisConfig) ReliableQueue[T] {
+	return &RedisServiceImpl[T]{
+		client:      newClient(ctx, redisCfg),
+		key:         queueKey(redisCfg),
+		maxAttempts: redisCfg.MaxAttempts,
+		codec:       codecFor(ctx, redisCfg.Codec),
+	}
+}
+
+// processingKey holds items claimed by the running sync.
+func (r *RedisServiceImpl[T]) processingKey() string {
+	return r.key + ":processing"
+}
+
+// attemptsKey maps a digest of each entry to how often it has been given back.
+// The count is kept beside the entry rather than inside it so the stored
+// format stays the one StoreData writes.
+func (r *RedisServiceImpl[T]) attemptsKey() string {
+	return attemptsKeyFor(r.key)
+}
+
+func attemptsKeyFor(key string) string {
+	return key + ":attempts"
+}
+
+func entryDigest(raw string) string {
+	sum := sha1.Sum([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// recoverScript moves the processing list back onto the consuming end of the
+// queue in its original order, so a recovered update cannot land behind a newer
+// one for the same anime.
+var recoverScript = redis.NewScript(`
+local n = 0
+while true do
+  local v = redis.call('LPOP', KEYS[1])
+  if not v then break end
+  redis.call('RPUSH', KEYS[2], v)
+  n = n + 1
+end
+return n
+`)
+
+func (r *RedisServiceImpl[T]) Recover(ctx context.Context) (int, error) {
+	log := logger.FromCtx(ctx)
+
+	recovered, err := recoverList(ctx, r.client, r.processingKey(), r.key)
+	if err != nil {
+		log.Error("Failed to recover processing items", zap.Error(err))
+		return 0, err
+	}
+	if recovered > 0 {
+		log.Warn("returned items left by a previous run to the queue",
+			zap.Int("count", recovered))
+	}
+	return recovered, nil
+}
+
+func (r *RedisServiceImpl[T]) Claim(ctx context.Context, n int) ([]Claimed[T], error) {
+	log := logger.FromCtx(ctx)
+
+	if n <= 0 {
+		n = scanPageSize
+	}
+	// StoreData pushes on the left, so the oldest entry is on the right.
+	cmds := make([]*redis.StringCmd, n)
+	err := fencedTx(ctx, r.client, func(pipe redis.Pipeliner) error {
+		for i := range cmds {
+			cmds[i] = pipe.RPopLPush(ctx, r.key, r.processingKey())
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		log.Error("Failed to claim items from Redis", zap.Error(err))
+		return nil, err
+	}
+
+	raws := make([]string, 0, n)
+	for _, cmd := range cmds {
+		raw, err := cmd.Result()
+		if err == redis.Nil {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		raws = append(raws, raw)
+	}
+	if len(raws) == 0 {
+		return nil, nil
+	}
+
+	digests := make([]string, len(raws))
+	for i, raw := range raws {
+		digests[i] = entryDigest(raw)
+	}
+	counts, err := r.client.HMGet(ctx, r.attemptsKey(), digests...).Result()
+	if err != nil {
+		log.Error("Failed to read attempt counts", zap.Error(err))
+		return nil, err
+	}
+
+	claimed := make([]Claimed[T], 0, len(raws))
+	for i, raw := range raws {
+		var data T
+		if err := DecodeEntry(raw, &data); err != nil {
+			log.Warn("Failed to unmarshal item, dead-lettering it", zap.Error(err))
+			if err := r.deadLetter(ctx, r.processingKey(), newDeadLetter(raw, UndecodableReason, err, 0)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		item := Claimed[T]{Data: data, Raw: raw}
+		if s, ok := counts[i].(string); ok {
+			item.Attempts, _ = strconv.Atoi(s)
+		}
+		claimed = append(claimed, item)
+	}
+
+	log.Info("Claimed items from Redis", zap.Int("count", len(claimed)))
+	return claimed, nil
+}
+
+func (r *RedisServiceImpl[T]) Ack(ctx context.Context, items ...Claimed[T]) error {
+	if len(items) == 0 {
+		return nil
+	}
+	err := fencedTx(ctx, r.client, func(pipe redis.Pipeliner) error {
+		for _, item := range items {
+			pipe.LRem(ctx, r.processingKey(), 1, item.Raw)
+			pipe.HDel(ctx, r.attemptsKey(), entryDigest(item.Raw))
+		}
+		return nil
+	})
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to acknowledge items", zap.Error(err))
+	}
+	return err
+}
+
+// Nack returns items to the consuming end of the queue in their original
+// order, so they are claimed again ahead of anything queued since. That does
+// not order a retry after the newer items for the same anime: the run that
+// failed it may have claimed and sent those already, and only the watermarks
+// keep the retry from being written over them. One item that keeps failing
+// costs a single slot per run rather than the whole batch, and is
+// dead-lettered once it has used up its attempts.
+func (r *RedisServiceImpl[T]) Nack(ctx context.Context, items ...Claimed[T]) error {
+	if len(items) == 0 {
+		return nil
+	}
+	log := logger.FromCtx(ctx)
+
+	dead := 0
+	err := fencedTx(ctx, r.client, func(pipe redis.Pipeliner) error {
+		dead = 0
+		// The last entry pushed is the next one claimed, so push newest first.
+		for i := len(items) - 1; i >= 0; i-- {
+			item := items[i]
+			pipe.LRem(ctx, r.processingKey(), 1, item.Raw)
+
+			if r.maxAttempts > 0 && item.Attempts+1 >= r.maxAttempts {
+				pipe.HDel(ctx, r.attemptsKey(), entryDigest(item.Raw))
+				if err := pushDeadLetter(ctx, pipe, r.key, newDeadLetter(item.Raw, MaxAttemptsReason, item.Err, item.Attempts+1)); err != nil {
+					return err
+				}
+				dead++
+				continue
+			}
+
+			pipe.RPush(ctx, r.key, item.Raw)
+			pipe.HIncrBy(ctx, r.attemptsKey(), entryDigest(item.Raw), 1)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to return items to the queue", zap.Error(err))
+		return err
+	}
+	if dead > 0 {
+		log.Warn("dead-lettered items that used up their attempts",
+			zap.Int("count", dead), zap.Int("maxAttempts", r.maxAttempts))
+	}
+	return nil
+}
+
+// recoverList runs recoverScript from list onto the queue at key.
+func recoverList(ctx context.Context, client redis.UniversalClient, list, key string) (int, error) {
+	var moved *redis.Cmd
+	err := fencedTx(ctx, client, func(pipe redis.Pipeliner) error {
+		moved = recoverScript.Eval(ctx, pipe, []string{list, key})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return moved.Int()
+}
+
+// deadLetter moves one entry from list to the dead-letter list.
+func (r *RedisServiceImpl[T]) deadLetter(ctx context.Context, list string, letter DeadLetter) error {
+	err := fencedTx(ctx, r.client, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, list, 1, letter.Raw)
+		return pushDeadLetter(ctx, pipe, r.key, letter)
+	})
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to dead-letter an entry", zap.Error(err))
+	}
+	return err
+}
@@ -0,0 +1,191 @@
+package redis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+type item struct {
+	ID string `json:"id"`
+}
+
+func newTestService(t *testing.T) (*RedisServiceImpl[item], *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	return &RedisServiceImpl[item]{
+		client: redis.NewClient(&redis.Options{Addr: mr.Addr()}),
+		key:    "q",
+	}, mr
+}
+
+func store(t *testing.T, r *RedisServiceImpl[item], ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if err := r.StoreData(context.Background(), item{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func ids(items []Claimed[item]) []string {
+	out := make([]string, len(items))
+	for i, it := range items {
+		out[i] = it.Data.ID
+	}
+	return out
+}
+
+func TestClaimTakesTheOldestItemsFirst(t *testing.T) {
+	r, mr := newTestService(t)
+	ctx := context.Background()
+	store(t, r, "a", "b", "c")
+
+	claimed, err := r.Claim(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(claimed); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("expected a, b; got %v", got)
+	}
+	if n, _ := mr.List(r.processingKey()); len(n) != 2 {
+		t.Errorf("claimed items should sit on the processing list, got %v", n)
+	}
+
+	rest, err := r.Claim(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(rest); len(got) != 1 || got[0] != "c" {
+		t.Errorf("a short queue yields what it has, got %v", got)
+	}
+}
+
+func TestClaimOfNoSizeTakesADefaultPage(t *testing.T) {
+	r, _ := newTestService(t)
+	store(t, r, "a", "b")
+
+	for _, n := range []int{0, -1} {
+		claimed, err := r.Claim(context.Background(), n)
+		if err != nil {
+			t.Fatalf("Claim(%d): %v", n, err)
+		}
+		if err := r.Nack(context.Background(), claimed...); err != nil {
+			t.Fatal(err)
+		}
+		if len(claimed) != 2 {
+			t.Errorf("Claim(%d) took %v, want both items", n, ids(claimed))
+		}
+	}
+}
+
+// The point of the mode: one bad item does not hold the others back.
+func TestAckAndNackSettleItemsIndividually(t *testing.T) {
+	r, mr := newTestService(t)
+	ctx := context.Background()
+	store(t, r, "good", "poison", "also-good")
+
+	claimed, err := r.Claim(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Ack(ctx, claimed[0], claimed[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Nack(ctx, claimed[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if processing, _ := mr.List(r.processingKey()); len(processing) != 0 {
+		t.Errorf("nothing should remain in processing, got %v", processing)
+	}
+	again, err := r.Claim(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(again); len(got) != 1 || got[0] != "poison" {
+		t.Fatalf("only the failed item should come back, got %v", got)
+	}
+	if again[0].Attempts != 1 {
+		t.Errorf("attempt counter should be 1, got %d", again[0].Attempts)
+	}
+
+	if err := r.Nack(ctx, again...); err != nil {
+		t.Fatal(err)
+	}
+	third, _ := r.Claim(ctx, 10)
+	if third[0].Attempts != 2 {
+		t.Errorf("attempt counter should keep counting, got %d", third[0].Attempts)
+	}
+	if err := r.Ack(ctx, third...); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(r.attemptsKey()) {
+		t.Error("acknowledging should forget the attempt count")
+	}
+}
+
+// Returned items go back ahead of newer ones, in the order they were claimed,
+// so an older update is never applied after a newer one.
+func TestReturnedItemsKeepTheirPlace(t *testing.T) {
+	r, _ := newTestService(t)
+	ctx := context.Background()
+	store(t, r, "a", "b")
+
+	claimed, _ := r.Claim(ctx, 2)
+	store(t, r, "c")
+	if err := r.Nack(ctx, claimed...); err != nil {
+		t.Fatal(err)
+	}
+
+	again, _ := r.Claim(ctx, 10)
+	if got := ids(again); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("expected a, b, c; got %v", got)
+	}
+}
+
+func TestRecoverReturnsAnAbandonedRunInOrder(t *testing.T) {
+	r, mr := newTestService(t)
+	ctx := context.Background()
+	store(t, r, "a", "b")
+	if _, err := r.Claim(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	// The run dies here, and a new item arrives before the next one starts.
+	store(t, r, "c")
+
+	n, err := r.Recover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 recovered, got %d", n)
+	}
+	if mr.Exists(r.processingKey()) {
+		t.Error("processing list should be empty after recovery")
+	}
+	again, _ := r.Claim(ctx, 10)
+	if got := ids(again); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("expected a, b, c; got %v", got)
+	}
+}
+
+func TestClaimDropsUndecodableEntries(t *testing.T) {
+	r, mr := newTestService(t)
+	ctx := context.Background()
+	mr.Lpush(r.key, "not json")
+	store(t, r, "a")
+
+	claimed, err := r.Claim(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(claimed); len(got) != 1 || got[0] != "a" {
+		t.Errorf("expected only a, got %v", got)
+	}
+	if processing, _ := mr.List(r.processingKey()); len(processing) != 1 {
+		t.Errorf("the bad entry must not linger in processing, got %v", processing)
+	}
+}
@@ -0,0 +1,344 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.uber.org/zap"
+)
+
+// streamField is the entry field holding the encoded item.
+const streamField = "data"
+
+// StreamServiceImpl is a RedisService on Redis Streams.
+//
+// The list queue is claimed with RENAME, which only one sync worker can do at a
+// time: a second worker either finds nothing or, worse, mistakes the first
+// one's claim for an orphan. A consumer group hands each entry to exactly one
+// member, so any number of workers can share a backlog, and entries a crashed
+// worker read but never acknowledged are reclaimed by the next one after
+// ClaimIdle rather than waiting for someone to notice.
+//
+// Requires Redis 6.2 for XAUTOCLAIM and MINID trimming.
+type StreamServiceImpl[T any] struct {
+	client   redis.UniversalClient
+	key      string
+	stream   string
+	group    string
+	consumer string
+	// readCount caps one GetAllData, so a single worker does not take the
+	// whole backlog and leave the others idle.
+	readCount int64
+	claimIdle time.Duration
+	maxLen    int64
+	maxAge    time.Duration
+	codec     Codec
+	// maxAttempts caps how often an entry is delivered: a stream keeps no
+	// attempt count of its own beyond the group's delivery count, and without
+	// a cap an entry Algolia always refuses was reclaimed forever.
+	maxAttempts int
+
+	groupOnce sync.Once
+	groupErr  error
+
+	mu sync.Mutex
+	// delivered is what the last GetAllData handed out; ClearData
+	// acknowledges exactly these.
+	delivered []string
+	// fetched is how many entries the last GetAllData took from the
+	// stream, including the ones it dead-lettered rather than handed out.
+	fetched int
+}
+
+// DrainedQueue is a queue handed out a part at a time, so a sync keeps asking
+// until it is drained. Drained tells whether the last GetAllData found nothing
+// left to take. What GetAllData returns cannot tell: a part it dead-lettered
+// whole returns nothing, with more behind it.
+type DrainedQueue interface {
+	Drained() bool
+}
+
+func (s *StreamServiceImpl[T]) Drained() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetched == 0
+}
+
+func NewStreamService[T any](ctx context.Context, redisCfg config.RedisConfig) RedisService[T] {
+	service := newStreamService[T](newClient(ctx, redisCfg), redisCfg)
+	service.codec = codecFor(ctx, redisCfg.Codec)
+	return service
+}
+
+func newStreamService[T any](client redis.UniversalClient, redisCfg config.RedisConfig) *StreamServiceImpl[T] {
+	consumer := redisCfg.StreamConsumer
+	if consumer == "" {
+		host, _ := os.Hostname()
+		consumer = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	readCount := int64(redisCfg.ClaimSize)
+	if readCount <= 0 {
+		readCount = scanPageSize
+	}
+	key := queueKey(redisCfg)
+	return &StreamServiceImpl[T]{
+		client:      client,
+		key:         key,
+		stream:      key + ":stream",
+		group:       redisCfg.StreamGroup,
+		consumer:    consumer,
+		readCount:   readCount,
+		claimIdle:   time.Duration(redisCfg.StreamClaimIdle) * time.Second,
+		maxLen:      redisCfg.StreamMaxLen,
+		maxAge:      time.Duration(redisCfg.StreamMaxAge) * time.Second,
+		maxAttempts: redisCfg.MaxAttempts,
+	}
+}
+
+// ensureGroup creates the consumer group on first use. Starting from 0 rather
+// than $ means entries written before any worker existed are still delivered.
+func (s *StreamServiceImpl[T]) ensureGroup(ctx context.Context) error {
+	s.groupOnce.Do(func() {
+		err := s.client.XGroupCreateMkStream(ctx, s.stream, s.group, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			s.groupErr = err
+		}
+	})
+	return s.groupErr
+}
+
+func (s *StreamServiceImpl[T]) StoreData(ctx context.Context, data T) error {
+	log := logger.FromCtx(ctx)
+
+	encoded, err := s.encode(data)
+	if err != nil {
+		log.Error("Failed to encode data", zap.Error(err))
+		return err
+	}
+
+	if err := s.client.XAdd(ctx, s.addArgs(encoded)).Err(); err != nil {
+		log.Error("Failed to store data in Redis", zap.Error(err))
+		return err
+	}
+
+	log.Debug("Data stored in Redis")
+	return nil
+}
+
+func (s *StreamServiceImpl[T]) encode(data T) ([]byte, error) {
+	return encodeWith(s.codec, data)
+}
+
+func (s *StreamServiceImpl[T]) addArgs(encoded []byte) *redis.XAddArgs {
+	args := &redis.XAddArgs{
+		Stream: s.stream,
+		Values: map[string]any{streamField: encoded},
+		// Exact trimming walks the stream on every write; approximate trims
+		// whole nodes and is what Redis recommends.
+		Approx: true,
+	}
+	switch {
+	case s.maxLen > 0:
+		args.MaxLen = s.maxLen
+	case s.maxAge > 0:
+		args.MinID = fmt.Sprintf("%d-0", time.Now().Add(-s.maxAge).UnixMilli())
+	}
+	return args
+}
+
+func (s *StreamServiceImpl[T]) storeOn(ctx context.Context, pipe redis.Pipeliner, data T, encoded []byte) error {
+	pipe.XAdd(ctx, s.addArgs(encoded))
+	return nil
+}
+
+// GetAllData returns up to ClaimSize entries: first any that another worker
+// read and abandoned, then new ones.
+func (s *StreamServiceImpl[T]) GetAllData(ctx context.Context) ([]T, error) {
+	log := logger.FromCtx(ctx)
+
+	if err := s.ensureGroup(ctx); err != nil {
+		log.Error("Failed to create the consumer group", zap.Error(err))
+		return nil, err
+	}
+
+	messages, err := s.reclaim(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := s.deliveryCounts(ctx, messages)
+	if err != nil {
+		return nil, err
+	}
+
+	if remaining := s.readCount - int64(len(messages)); remaining > 0 {
+		streams, err := s.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    s.group,
+			Consumer: s.consumer,
+			Streams:  []string{s.stream, ">"},
+			Count:    remaining,
+			Block:    -1,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			log.Error("Failed to read from the stream", zap.Error(err))
+			return nil, err
+		}
+		for _, stream := range streams {
+			messages = append(messages, stream.Messages...)
+		}
+	}
+
+	var (
+		results   []T
+		delivered []string
+	)
+	for _, msg := range messages {
+		raw, _ := msg.Values[streamField].(string)
+		var data T
+		if decodeErr := DecodeEntry(raw, &data); decodeErr != nil {
+			log.Warn("Failed to unmarshal item, dead-lettering it",
+				zap.String("entry", msg.ID), zap.Error(decodeErr))
+			if err := s.deadLetter(ctx, msg.ID, newDeadLetter(raw, UndecodableReason, decodeErr, 0)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// Every delivery but this one ended without an acknowledgement.
+		if count := deliveries[msg.ID]; s.maxAttempts > 0 && count > int64(s.maxAttempts) {
+			log.Warn("dead-lettering an entry that used up its attempts",
+				zap.String("entry", msg.ID), zap.Int64("deliveries", count),
+				zap.Int("maxAttempts", s.maxAttempts))
+			cause := fmt.Errorf("delivered %d times without being acknowledged", count-1)
+			if err := s.deadLetter(ctx, msg.ID, newDeadLetter(raw, MaxAttemptsReason, cause, int(count-1))); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		results = append(results, data)
+		delivered = append(delivered, msg.ID)
+	}
+
+	s.mu.Lock()
+	s.delivered = delivered
+	s.fetched = len(messages)
+	s.mu.Unlock()
+
+	log.Info("Retrieved data from Redis",
+		zap.Int("count", len(results)), zap.String("consumer", s.consumer))
+	return results, nil
+}
+
+// reclaim takes over entries that have sat unacknowledged for ClaimIdle,
+// which is what a worker that died mid-run leaves behind.
+func (s *StreamServiceImpl[T]) reclaim(ctx context.Context) ([]redis.XMessage, error) {
+	if s.claimIdle <= 0 {
+		return nil, nil
+	}
+	log := logger.FromCtx(ctx)
+
+	var (
+		claimed []redis.XMessage
+		start   = "0-0"
+	)
+	for int64(len(claimed)) < s.readCount {
+		messages, next, err := s.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   s.stream,
+			Group:    s.group,
+			Consumer: s.consumer,
+			MinIdle:  s.claimIdle,
+			Start:    start,
+			Count:    s.readCount - int64(len(claimed)),
+		}).Result()
+		if err != nil {
+			log.Error("Failed to reclaim abandoned entries", zap.Error(err))
+			return nil, err
+		}
+		claimed = append(claimed, messages...)
+		if next == "0-0" || len(messages) == 0 {
+			break
+		}
+		start = next
+	}
+
+	if len(claimed) > 0 {
+		log.Warn("reclaimed entries abandoned by another worker",
+			zap.Int("count", len(claimed)))
+	}
+	return claimed, nil
+}
+
+// deliveryCounts returns how often each reclaimed entry has been delivered,
+// this delivery included, from the group's pending entries. New entries have
+// been delivered once and are not looked up.
+func (s *StreamServiceImpl[T]) deliveryCounts(ctx context.Context, reclaimed []redis.XMessage) (map[string]int64, error) {
+	counts := make(map[string]int64, len(reclaimed))
+	if s.maxAttempts <= 0 || len(reclaimed) == 0 {
+		return counts, nil
+	}
+	log := logger.FromCtx(ctx)
+
+	pending := make([]*redis.XPendingExtCmd, len(reclaimed))
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, msg := range reclaimed {
+			pending[i] = pipe.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: s.stream,
+				Group:  s.group,
+				Start:  msg.ID,
+				End:    msg.ID,
+				Count:  1,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to read delivery counts", zap.Error(err))
+		return nil, err
+	}
+	for _, cmd := range pending {
+		for _, entry := range cmd.Val() {
+			counts[entry.ID] = entry.RetryCount
+		}
+	}
+	return counts, nil
+}
+
+// ClearData acknowledges the entries the last GetAllData returned. Anything
+// delivered since to other workers is theirs to acknowledge.
+func (s *StreamServiceImpl[T]) ClearData(ctx context.Context) error {
+	log := logger.FromCtx(ctx)
+
+	s.mu.Lock()
+	ids := s.delivered
+	s.delivered = nil
+	s.mu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// Acknowledged entries stay in the stream as history until StoreData's
+	// trimming removes them.
+	if err := s.client.XAck(ctx, s.stream, s.group, ids...).Err(); err != nil {
+		log.Error("Failed to acknowledge stream entries", zap.Error(err))
+		return err
+	}
+
+	log.Info("Acknowledged stream entries", zap.Int("count", len(ids)))
+	return nil
+}
+
+func (s *StreamServiceImpl[T]) deadLetter(ctx context.Context, id string, letter DeadLetter) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, s.stream, s.group, id)
+		return pushDeadLetter(ctx, pipe, s.key, letter)
+	})
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to dead-letter an entry", zap.Error(err))
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/weeb-vip/algolia-sync/config"
+)
+
+func newTestStreams(t *testing.T, consumers ...string) ([]*StreamServiceImpl[item], *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	var services []*StreamServiceImpl[item]
+	for _, name := range consumers {
+		services = append(services, newStreamService[item](client, config.RedisConfig{
+			Key:             "q",
+			StreamGroup:     "sync",
+			StreamConsumer:  name,
+			ClaimSize:       2,
+			StreamClaimIdle: 60,
+		}))
+	}
+	return services, mr
+}
+
+func dataIDs(items []item) []string {
+	out := make([]string, len(items))
+	for i, it := range items {
+		out[i] = it.ID
+	}
+	return out
+}
+
+func TestStreamWorkersShareTheBacklog(t *testing.T) {
+	workers, _ := newTestStreams(t, "one", "two")
+	ctx := context.Background()
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if err := workers[0].StoreData(ctx, item{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, err := workers[0].GetAllData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := workers[1].GetAllData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dataIDs(first); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("first worker should take a, b; got %v", got)
+	}
+	if got := dataIDs(second); len(got) != 2 || got[0] != "c" || got[1] != "d" {
+		t.Errorf("second worker should take c, d; got %v", got)
+	}
+
+	for _, w := range workers {
+		if err := w.ClearData(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rest, _ := workers[0].GetAllData(ctx); len(rest) != 0 {
+		t.Errorf("everything was acknowledged, got %v", dataIDs(rest))
+	}
+}
+
+func TestStreamReclaimsEntriesFromACrashedWorker(t *testing.T) {
+	workers, mr := newTestStreams(t, "crashed", "survivor")
+	ctx := context.Background()
+	// Pending idle time follows the server clock, which FastForward does not
+	// move.
+	now := time.Now()
+	mr.SetTime(now)
+	_ = workers[0].StoreData(ctx, item{ID: "a"})
+
+	if got, _ := workers[0].GetAllData(ctx); len(got) != 1 {
+		t.Fatalf("expected the first worker to read a, got %v", dataIDs(got))
+	}
+	// It never acknowledges. Before ClaimIdle, nobody else may take it.
+	if got, _ := workers[1].GetAllData(ctx); len(got) != 0 {
+		t.Fatalf("entry should not be reclaimed while fresh, got %v", dataIDs(got))
+	}
+
+	mr.SetTime(now.Add(2 * time.Minute))
+	got, err := workers[1].GetAllData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := dataIDs(got); len(ids) != 1 || ids[0] != "a" {
+		t.Fatalf("survivor should reclaim a, got %v", ids)
+	}
+	if err := workers[1].ClearData(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mr.SetTime(now.Add(4 * time.Minute))
+	if got, _ := workers[0].GetAllData(ctx); len(got) != 0 {
+		t.Errorf("an acknowledged entry must not come back, got %v", dataIDs(got))
+	}
+}
+
+func TestStreamDeadLettersAnEntryOutOfAttempts(t *testing.T) {
+	workers, mr := newTestStreams(t, "one")
+	w := workers[0]
+	w.maxAttempts = 2
+	ctx := context.Background()
+	now := time.Now()
+	mr.SetTime(now)
+	_ = w.StoreData(ctx, item{ID: "poison"})
+
+	// Algolia refuses it every time, so it is never acknowledged.
+	for attempt := 1; attempt <= 2; attempt++ {
+		got, err := w.GetAllData(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := dataIDs(got); len(ids) != 1 || ids[0] != "poison" {
+			t.Fatalf("attempt %d: got %v, want poison", attempt, ids)
+		}
+		now = now.Add(2 * time.Minute)
+		mr.SetTime(now)
+	}
+
+	got, err := w.GetAllData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("an entry out of attempts must not be delivered again, got %v", dataIDs(got))
+	}
+	dlq := &DeadLetterQueueImpl{client: w.client, key: w.key}
+	letters, err := dlq.List(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Reason != MaxAttemptsReason || letters[0].Attempts != 2 {
+		t.Errorf("dead letters = %+v, want poison after 2 attempts", letters)
+	}
+	pending, err := w.client.XPending(ctx, w.stream, w.group).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Count != 0 {
+		t.Errorf("the dead-lettered entry is still pending: %+v", pending)
+	}
+}
+
+func TestStreamTrimsHistoryByLength(t *testing.T) {
+	workers, mr := newTestStreams(t, "one")
+	w := workers[0]
+	w.maxLen = 3
+	ctx := context.Background()
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		_ = w.StoreData(ctx, item{ID: id})
+	}
+	entries, err := mr.Stream(w.stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 3 {
+		t.Errorf("expected at most 3 entries after trimming, got %d", len(entries))
+	}
+}
+
+func TestStreamDeadLettersUndecodableEntries(t *testing.T) {
+	workers, _ := newTestStreams(t, "one")
+	w := workers[0]
+	ctx := context.Background()
+	w.client.XAdd(ctx, &redis.XAddArgs{Stream: w.stream, Values: map[string]any{streamField: "nope"}})
+	_ = w.StoreData(ctx, item{ID: "a"})
+
+	got, err := w.GetAllData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := dataIDs(got); len(ids) != 1 || ids[0] != "a" {
+		t.Errorf("expected only a, got %v", ids)
+	}
+	dlq := &DeadLetterQueueImpl{client: w.client, key: w.key}
+	if letters, _ := dlq.List(ctx, 0); len(letters) != 1 || letters[0].Raw != "nope" {
+		t.Errorf("expected the bad entry dead-lettered, got %+v", letters)
+	}
+}
+
+func TestStreamIsNotDrainedByAReadItDeadLettersWhole(t *testing.T) {
+	workers, _ := newTestStreams(t, "one")
+	w := workers[0]
+	ctx := context.Background()
+	for range 2 {
+		w.client.XAdd(ctx, &redis.XAddArgs{Stream: w.stream, Values: map[string]any{streamField: "nope"}})
+	}
+	_ = w.StoreData(ctx, item{ID: "a"})
+
+	got, err := w.GetAllData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 || w.Drained() {
+		t.Fatalf("got %v, drained %v; want nothing, and more to read", dataIDs(got), w.Drained())
+	}
+	if got, _ = w.GetAllData(ctx); len(got) != 1 || w.Drained() {
+		t.Fatalf("got %v, drained %v; want a", dataIDs(got), w.Drained())
+	}
+	if got, _ = w.GetAllData(ctx); len(got) != 0 || !w.Drained() {
+		t.Errorf("got %v, drained %v; want the stream drained", dataIDs(got), w.Drained())
+	}
+}
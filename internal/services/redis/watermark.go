@@ -0,0 +1,195 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/weeb-vip/algolia-sync/config"
+)
+
+// Watermark is the newest version of a record the sync has sent to Algolia,
+// and whether that was a delete. Versions are the updatedAt of Keyed.
+type Watermark struct {
+	Version int64
+	Deleted bool
+}
+
+// Admits tells whether an item at version may still be applied over w. Kafka
+// retries and the retry topic can deliver an older update after a newer one,
+// and without this the sync wrote the stale document over the fresh one.
+//
+// After a write, anything at least as new is admitted, so the same version
+// sent again is harmless. After a delete, only something newer is: the delete
+// is a tombstone, so a late create of the row it removed cannot bring the
+// anime back. An item with no version cannot be ordered against a write and
+// is admitted over one, but not over a tombstone: a versionless delete leaves
+// a tombstone at 0, and admitting the redelivered create it deleted brought
+// the anime back. Only a versioned write lifts it, or the tombstone expiring
+// or being forgotten (see Watermarks).
+func (w Watermark) Admits(version int64) bool {
+	if version == 0 {
+		return !w.Deleted
+	}
+	if w.Deleted {
+		return version > w.Version
+	}
+	return version >= w.Version
+}
+
+// Advanced is w once an item at version, a delete or not, has been sent. It
+// never goes back, and a delete leaves a tombstone at least as new as what it
+// deleted even when it carries no version of its own.
+func (w Watermark) Advanced(version int64, deleted bool) Watermark {
+	if deleted {
+		return Watermark{Version: max(w.Version, version), Deleted: true}
+	}
+	if version > w.Version {
+		return Watermark{Version: version}
+	}
+	return w
+}
+
+// Watermarks keeps a Watermark per record, in one hash beside the queue. A
+// write's watermark stays while the anime does, so the hash holds one small
+// field per anime in the index. A tombstone is kept tombstoneTTL past the
+// delete, long enough to outlive any retry, and then removed: the deleted
+// anime would otherwise hold a field for good, and block a later create that
+// carries no version.
+type Watermarks struct {
+	client redis.UniversalClient
+	key    string
+	// tombstones orders the ids whose watermark is a tombstone by when
+	// it was left, so the expired ones are found without a scan.
+	tombstones   string
+	tombstoneTTL time.Duration
+}
+
+func NewWatermarks(ctx context.Context, redisCfg config.RedisConfig) *Watermarks {
+	key := queueKey(redisCfg) + ":watermarks"
+	return &Watermarks{
+		client:       newClient(ctx, redisCfg),
+		key:          key,
+		tombstones:   key + ":tombstones",
+		tombstoneTTL: time.Duration(redisCfg.WatermarkTombstoneTTL) * time.Second,
+	}
+}
+
+// Get returns the watermarks of ids; an id never synced has none. A nil
+// Watermarks, for a sync that keeps none, has none for any id.
+func (w *Watermarks) Get(ctx context.Context, ids ...string) (map[string]Watermark, error) {
+	marks := make(map[string]Watermark, len(ids))
+	if w == nil || len(ids) == 0 {
+		return marks, nil
+	}
+	raws, err := w.client.HMGet(ctx, w.key, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, raw := range raws {
+		s, ok := raw.(string)
+		if !ok {
+			continue
+		}
+		mark, err := parseWatermark(s)
+		if err != nil {
+			return nil, fmt.Errorf("watermark of %s: %w", ids[i], err)
+		}
+		marks[ids[i]] = mark
+	}
+	return marks, nil
+}
+
+// advanceScript is Watermark.Advanced applied to the stored watermarks, in one
+// step, so two workers recording out of order cannot undo each other. It also
+// removes the tombstones left more than ARGV[1] seconds ago, unless something
+// newer has replaced them; 0 keeps them.
+var advanceScript = redis.NewScript(`
+local now = tonumber(redis.call('TIME')[1])
+local ttl = tonumber(ARGV[1])
+if ttl > 0 then
+  for _, id in ipairs(redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', now - ttl)) do
+    local current = redis.call('HGET', KEYS[1], id)
+    if current and string.sub(current, -2) == ':1' then
+      redis.call('HDEL', KEYS[1], id)
+    end
+    redis.call('ZREM', KEYS[2], id)
+  end
+end
+for i = 2, #ARGV, 3 do
+  local id = ARGV[i]
+  -- Versions are compared as numbers but written back as the strings they
+  -- came as: Lua would print a microsecond timestamp in exponent form.
+  local version = ARGV[i + 1]
+  local deleted = ARGV[i + 2] == '1'
+  local curVersion = '0'
+  local current = redis.call('HGET', KEYS[1], id)
+  if current then
+    curVersion = string.sub(current, 1, string.find(current, ':') - 1)
+  end
+  local newer = tonumber(version) > tonumber(curVersion)
+  if deleted then
+    if not newer then
+      version = curVersion
+    end
+    redis.call('HSET', KEYS[1], id, version .. ':1')
+    redis.call('ZADD', KEYS[2], now, id)
+  elseif newer then
+    redis.call('HSET', KEYS[1], id, version .. ':0')
+    redis.call('ZREM', KEYS[2], id)
+  end
+end
+return 1
+`)
+
+// Advance records marks as sent. Call it only once Algolia has them: a
+// watermark ahead of the index would drop the retry that should repair it.
+func (w *Watermarks) Advance(ctx context.Context, marks map[string]Watermark) error {
+	if w == nil || len(marks) == 0 {
+		return nil
+	}
+	args := make([]any, 0, 1+3*len(marks))
+	args = append(args, int64(w.tombstoneTTL.Seconds()))
+	for id, mark := range marks {
+		deleted := "0"
+		if mark.Deleted {
+			deleted = "1"
+		}
+		args = append(args, id, mark.Version, deleted)
+	}
+	return advanceScript.Run(ctx, w.client, []string{w.key, w.tombstones}, args...).Err()
+}
+
+// Forget removes the watermarks of ids, so the next item for each is applied
+// whatever its version. It is how a deleted anime is created again before its
+// tombstone expires, when the create carries no version newer than the delete.
+func (w *Watermarks) Forget(ctx context.Context, ids ...string) error {
+	if w == nil || len(ids) == 0 {
+		return nil
+	}
+	_, err := w.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, w.key, ids...)
+		members := make([]any, len(ids))
+		for i, id := range ids {
+			members[i] = id
+		}
+		pipe.ZRem(ctx, w.tombstones, members...)
+		return nil
+	})
+	return err
+}
+
+func parseWatermark(s string) (Watermark, error) {
+	version, deleted, ok := strings.Cut(s, ":")
+	if !ok {
+		return Watermark{}, fmt.Errorf("malformed watermark %q", s)
+	}
+	v, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return Watermark{}, fmt.Errorf("malformed watermark %q: %w", s, err)
+	}
+	return Watermark{Version: v, Deleted: deleted == "1"}, nil
+}
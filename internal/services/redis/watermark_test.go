@@ -0,0 +1,185 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWatermarkAdmits(t *testing.T) {
+	tests := map[string]struct {
+		mark    Watermark
+		version int64
+		want    bool
+	}{
+		"nothing sent yet":                        {Watermark{}, 5, true},
+		"newer than a write":                      {Watermark{Version: 5}, 6, true},
+		"same as a write":                         {Watermark{Version: 5}, 5, true},
+		"older than a write":                      {Watermark{Version: 5}, 4, false},
+		"newer than a delete":                     {Watermark{Version: 5, Deleted: true}, 6, true},
+		"same as a delete":                        {Watermark{Version: 5, Deleted: true}, 5, false},
+		"older than a delete":                     {Watermark{Version: 5, Deleted: true}, 4, false},
+		"unversioned after a write":               {Watermark{Version: 5}, 0, true},
+		"unversioned after a delete":              {Watermark{Version: 5, Deleted: true}, 0, false},
+		"unversioned after an unversioned delete": {Watermark{Deleted: true}, 0, false},
+		"versioned after an unversioned delete":   {Watermark{Deleted: true}, 1, true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tt.mark.Admits(tt.version); got != tt.want {
+				t.Errorf("%+v.Admits(%d) = %v, want %v", tt.mark, tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnversionedDeleteKeepsAStaleCreateOut(t *testing.T) {
+	plain, _ := newTestService(t)
+	w := &Watermarks{client: plain.client, key: "q:watermarks", tombstones: "q:watermarks:tombstones"}
+	ctx := context.Background()
+
+	// The delete carries no version, and the create it removed is delivered
+	// again afterwards, also without one.
+	if err := w.Advance(ctx, map[string]Watermark{"a": Watermark{}.Advanced(0, true)}); err != nil {
+		t.Fatal(err)
+	}
+	marks, err := w.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marks["a"].Admits(0) {
+		t.Errorf("a stale create was admitted over the tombstone %+v", marks["a"])
+	}
+}
+
+func TestWatermarksNeverGoBack(t *testing.T) {
+	plain, _ := newTestService(t)
+	w := &Watermarks{client: plain.client, key: "q:watermarks", tombstones: "q:watermarks:tombstones"}
+	ctx := context.Background()
+
+	// Microsecond timestamps, past what Lua prints without an exponent.
+	const v1, v2, v3 = int64(1700000000000001), int64(1700000000000002), int64(1700000000000003)
+	steps := []map[string]Watermark{
+		{"a": {Version: v2}, "b": {Version: v2}, "c": {Version: v1}},
+		{"a": {Version: v1}, "b": {Version: v1, Deleted: true}, "c": {Version: 0, Deleted: true}},
+		{"c": {Version: v3}},
+	}
+	for _, marks := range steps {
+		if err := w.Advance(ctx, marks); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := w.Get(ctx, "a", "b", "c", "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Watermark{
+		// An older write does not lower it.
+		"a": {Version: v2},
+		// An older delete leaves a tombstone at what it deleted.
+		"b": {Version: v2, Deleted: true},
+		// A newer write brings a deleted anime back.
+		"c": {Version: v3},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for id, mark := range want {
+		if got[id] != mark {
+			t.Errorf("%s: got %+v, want %+v", id, got[id], mark)
+		}
+	}
+}
+
+func TestTombstonesExpire(t *testing.T) {
+	plain, mr := newTestService(t)
+	w := &Watermarks{client: plain.client, key: "q:watermarks", tombstones: "q:watermarks:tombstones", tombstoneTTL: time.Hour}
+	ctx := context.Background()
+
+	now := time.Now()
+	mr.SetTime(now)
+	marks := map[string]Watermark{
+		"deleted":   {Deleted: true},
+		"recreated": {Version: 1, Deleted: true},
+		"written":   {Version: 1},
+	}
+	if err := w.Advance(ctx, marks); err != nil {
+		t.Fatal(err)
+	}
+	mr.SetTime(now.Add(30 * time.Minute))
+	if err := w.Advance(ctx, map[string]Watermark{"recreated": {Version: 2}, "late": {Deleted: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An hour after the first deletes, the next advance removes what is
+	// still a tombstone from them, and nothing else.
+	mr.SetTime(now.Add(61 * time.Minute))
+	if err := w.Advance(ctx, map[string]Watermark{"other": {Version: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := w.Get(ctx, "deleted", "recreated", "written", "late")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Watermark{
+		"recreated": {Version: 2},
+		"written":   {Version: 1},
+		"late":      {Deleted: true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for id, mark := range want {
+		if got[id] != mark {
+			t.Errorf("%s: got %+v, want %+v", id, got[id], mark)
+		}
+	}
+	if !mr.Exists("q:watermarks:tombstones") {
+		t.Error("the tombstone still pending expiry was forgotten")
+	}
+}
+
+func TestForgetLetsADeletedAnimeBack(t *testing.T) {
+	plain, _ := newTestService(t)
+	w := &Watermarks{client: plain.client, key: "q:watermarks", tombstones: "q:watermarks:tombstones"}
+	ctx := context.Background()
+
+	if err := w.Advance(ctx, map[string]Watermark{"a": {Deleted: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Forget(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	marks, err := w.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !marks["a"].Admits(0) {
+		t.Errorf("a create was held back by %+v after Forget", marks["a"])
+	}
+}
+
+func TestWatermarkAdvancedMatchesTheScript(t *testing.T) {
+	mark := Watermark{}.Advanced(5, false).Advanced(3, false)
+	if mark != (Watermark{Version: 5}) {
+		t.Errorf("older write: %+v", mark)
+	}
+	if mark = mark.Advanced(0, true); mark != (Watermark{Version: 5, Deleted: true}) {
+		t.Errorf("unversioned delete: %+v", mark)
+	}
+	if mark = mark.Advanced(6, false); mark != (Watermark{Version: 6}) {
+		t.Errorf("newer write: %+v", mark)
+	}
+}
+
+func TestNoWatermarksAdmitEverything(t *testing.T) {
+	var w *Watermarks
+	marks, err := w.Get(context.Background(), "a")
+	if err != nil || len(marks) != 0 {
+		t.Errorf("Get = %+v, %v, want no watermarks", marks, err)
+	}
+	if err := w.Advance(context.Background(), map[string]Watermark{"a": {Version: 1}}); err != nil {
+		t.Errorf("Advance = %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"github.com/weeb-vip/algolia-sync/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// pipelineStorer is a service whose writes can be grouped on one pipeline.
+type pipelineStorer[T any] interface {
+	RedisService[T]
+	redisClient() redis.UniversalClient
+	encode(data T) ([]byte, error)
+	storeOn(ctx context.Context, pipe redis.Pipeliner, data T, encoded []byte) error
+}
+
+func (r *RedisServiceImpl[T]) redisClient() redis.UniversalClient  { return r.client }
+func (s *StreamServiceImpl[T]) redisClient() redis.UniversalClient { return s.client }
+
+// WriterStats counts what a BufferedWriter has done since it started.
+type WriterStats struct {
+	Stored uint64
+	Failed uint64
+	// Flushes is the number of pipelines sent; Stored+Failed over Flushes is
+	// the average group size.
+	Flushes uint64
+}
+
+type pendingWrite[T any] struct {
+	data    T
+	encoded []byte
+	done    chan error
+}
+
+// BufferedWriter groups concurrent StoreData calls into pipelines.
+//
+// One LPUSH round trip per Kafka message held a replay to whatever Redis
+// latency allowed, however many partitions were being consumed. Here each
+// StoreData still waits for its own item to be written -- the consumer
+// commits the offset when it returns, so it must not return before the push
+// is durable -- but calls that arrive while a pipeline is in flight go out
+// together in the next one.
+//
+// Grouping costs a lone writer nothing: with no pipeline in flight, an item is
+// sent at once. Linger trades that for larger groups by holding the first item
+// back a little.
+type BufferedWriter[T any] struct {
+	target   pipelineStorer[T]
+	maxItems int
+	linger   time.Duration
+
+	mu      sync.Mutex
+	pending []pendingWrite[T]
+	closed  bool
+	wake    chan struct{}
+
+	stored  atomic.Uint64
+	failed  atomic.Uint64
+	flushes atomic.Uint64
+
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+// NewBufferedWriter wraps service, which must be one this package built. The
+// writer runs until ctx is done or Close, then writes what is pending and hands
+// later calls straight to Redis.
+func NewBufferedWriter[T any](ctx context.Context, service RedisService[T], redisCfg config.RedisConfig) (*BufferedWriter[T], error) {
+	target, ok := service.(pipelineStorer[T])
+	if !ok {
+		return nil, fmt.Errorf("cannot buffer writes to %T", service)
+	}
+	maxItems := redisCfg.WriteBatchSize
+	if maxItems <= 0 {
+		maxItems = 500
+	}
+	w := &BufferedWriter[T]{
+		target:   target,
+		maxItems: maxItems,
+		linger:   time.Duration(redisCfg.WriteLinger) * time.Millisecond,
+		wake:     make(chan struct{}, 1),
+		stopped:  make(chan struct{}),
+	}
+	ctx, w.stop = context.WithCancel(ctx)
+	go func() {
+		defer close(w.stopped)
+		w.run(ctx)
+	}()
+	return w, nil
+}
+
+// Close writes what is pending and waits for it. The connection is shared and
+// stays open; see CloseClients.
+func (w *BufferedWriter[T]) Close() error {
+	w.stop()
+	<-w.stopped
+	return nil
+}
+
+func (w *BufferedWriter[T]) StoreData(ctx context.Context, data T) error {
+	encoded, err := w.target.encode(data)
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to encode data", zap.Error(err))
+		return err
+	}
+	write := pendingWrite[T]{data: data, encoded: encoded, done: make(chan error, 1)}
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		w.flush(ctx, []pendingWrite[T]{write})
+		return <-write.done
+	}
+	w.pending = append(w.pending, write)
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case err := <-write.done:
+		return err
+	case <-ctx.Done():
+		// The item may still be written; the caller treats it as failed and
+		// is redelivered it, which the queue tolerates.
+		return ctx.Err()
+	}
+}
+
+func (w *BufferedWriter[T]) GetAllData(ctx context.Context) ([]T, error) {
+	return w.target.GetAllData(ctx)
+}
+
+func (w *BufferedWriter[T]) ClearData(ctx context.Context) error {
+	return w.target.ClearData(ctx)
+}
+
+func (w *BufferedWriter[T]) Stats() WriterStats {
+	return WriterStats{
+		Stored:  w.stored.Load(),
+		Failed:  w.failed.Load(),
+		Flushes: w.flushes.Load(),
+	}
+}
+
+func (w *BufferedWriter[T]) run(ctx context.Context) {
+	log := logger.FromCtx(ctx)
+	// A group already taken is written even if ctx ends meanwhile; its
+	// callers are waiting to hear how it went.
+	flushCtx := context.WithoutCancel(ctx)
+	report := time.NewTicker(time.Minute)
+	defer report.Stop()
+	var last WriterStats
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.mu.Lock()
+			w.closed = true
+			rest := w.pending
+			w.pending = nil
+			w.mu.Unlock()
+			if len(rest) > 0 {
+				w.flush(flushCtx, rest)
+			}
+			return
+		case <-report.C:
+			stats := w.Stats()
+			if stats != last {
+				log.Info("redis writer throughput",
+					zap.Uint64("stored", stats.Stored-last.Stored),
+					zap.Uint64("failed", stats.Failed-last.Failed),
+					zap.Uint64("flushes", stats.Flushes-last.Flushes))
+				last = stats
+			}
+			continue
+		case <-w.wake:
+		}
+
+		if w.linger > 0 {
+			w.waitForGroup(ctx)
+		}
+		for {
+			batch := w.take()
+			if len(batch) == 0 {
+				break
+			}
+			w.flush(flushCtx, batch)
+		}
+	}
+}
+
+// waitForGroup holds off for linger, or until a full group is pending.
+func (w *BufferedWriter[T]) waitForGroup(ctx context.Context) {
+	timer := time.NewTimer(w.linger)
+	defer timer.Stop()
+	for {
+		w.mu.Lock()
+		full := len(w.pending) >= w.maxItems
+		w.mu.Unlock()
+		if full {
+			return
+		}
+		select {
+		case <-timer.C:
+			return
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+		}
+	}
+}
+
+func (w *BufferedWriter[T]) take() []pendingWrite[T] {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := min(len(w.pending), w.maxItems)
+	batch := w.pending[:n:n]
+	w.pending = w.pending[n:]
+	return batch
+}
+
+// flush sends batch on one pipeline and tells each caller how its own item
+// fared.
+func (w *BufferedWriter[T]) flush(ctx context.Context, batch []pendingWrite[T]) {
+	queued := make([]pendingWrite[T], 0, len(batch))
+	start := time.Now()
+	cmds, err := w.target.redisClient().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, write := range batch {
+			if err := w.target.storeOn(ctx, pipe, write.data, write.encoded); err != nil {
+				w.finish(write, err)
+				continue
+			}
+			queued = append(queued, write)
+		}
+		return nil
+	})
+	w.flushes.Add(1)
+	metrics.RedisFlushSeconds.Observe(time.Since(start).Seconds())
+
+	// A Redis error reply fails only its own command. Anything else -- no
+	// connection, a read cut short -- leaves the commands' own results
+	// unreliable, so the whole group is failed and redelivered.
+	var replyErr redis.Error
+	perCommand := err == nil || errors.As(err, &replyErr)
+	for i, write := range queued {
+		switch {
+		case perCommand && i < len(cmds):
+			w.finish(write, cmds[i].Err())
+		case err != nil:
+			w.finish(write, err)
+		default:
+			w.finish(write, fmt.Errorf("no reply for a pipelined write"))
+		}
+	}
+	if err != nil {
+		logger.FromCtx(ctx).Error("Failed to store data in Redis",
+			zap.Error(err), zap.Int("count", len(batch)))
+	}
+}
+
+func (w *BufferedWriter[T]) finish(write pendingWrite[T], err error) {
+	if err != nil {
+		w.failed.Add(1)
+	} else {
+		w.stored.Add(1)
+	}
+	write.done <- err
+}
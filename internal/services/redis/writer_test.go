@@ -0,0 +1,129 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weeb-vip/algolia-sync/config"
+)
+
+func TestBufferedWriterGroupsConcurrentWrites(t *testing.T) {
+	r, mr := newTestService(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, err := NewBufferedWriter[item](ctx, r, config.RedisConfig{WriteBatchSize: 50, WriteLinger: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 200
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.StoreData(ctx, item{ID: fmt.Sprint(i)}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, _ := mr.List(r.key); len(got) != n {
+		t.Fatalf("expected %d items once every StoreData returned, got %d", n, len(got))
+	}
+	stats := w.Stats()
+	if stats.Stored != n || stats.Failed != 0 {
+		t.Errorf("expected %d stored and none failed, got %+v", n, stats)
+	}
+	if stats.Flushes >= n/2 {
+		t.Errorf("expected writes to share pipelines, got %d flushes for %d items", stats.Flushes, n)
+	}
+}
+
+func TestBufferedWriterSendsALoneWriteAtOnce(t *testing.T) {
+	r, mr := newTestService(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, _ := NewBufferedWriter[item](ctx, r, config.RedisConfig{})
+
+	start := time.Now()
+	for _, id := range []string{"a", "b", "c"} {
+		if err := w.StoreData(ctx, item{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("sequential writes should not wait for a group, took %v", elapsed)
+	}
+	// Order is kept: the oldest is at the consuming end.
+	if got, _ := mr.List(r.key); len(got) != 3 || got[2] != `{"id":"a"}` {
+		t.Errorf("expected a, b, c in push order, got %v", got)
+	}
+}
+
+func TestBufferedWriterReportsEachItemsOwnFailure(t *testing.T) {
+	plain, mr := newTestService(t)
+	r := &RedisServiceImpl[versioned]{client: plain.client, key: plain.key, coalesce: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, _ := NewBufferedWriter[versioned](ctx, r, config.RedisConfig{})
+
+	if err := w.StoreData(ctx, versioned{ID: "a", Queued: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.StoreData(ctx, versioned{Queued: 2}); err == nil {
+		t.Error("an item with no key cannot be coalesced and should fail alone")
+	}
+	if got, _ := mr.HKeys(r.pendingKey()); len(got) != 1 {
+		t.Errorf("expected a pending, got %v", got)
+	}
+	if stats := w.Stats(); stats.Stored != 1 || stats.Failed != 1 {
+		t.Errorf("expected one stored and one failed, got %+v", stats)
+	}
+}
+
+func TestBufferedWriterWritesDirectlyAfterShutdown(t *testing.T) {
+	r, mr := newTestService(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	w, _ := NewBufferedWriter[item](ctx, r, config.RedisConfig{})
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := w.StoreData(context.Background(), item{ID: "late"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := mr.List(r.key); len(got) != 1 {
+		t.Errorf("expected the late write stored, got %v", got)
+	}
+}
+
+func TestBufferedWriterCloseWritesWhatIsPending(t *testing.T) {
+	r, mr := newTestService(t)
+	w, _ := NewBufferedWriter[item](context.Background(), r, config.RedisConfig{WriteLinger: 60000})
+
+	stored := make(chan error, 1)
+	go func() { stored <- w.StoreData(context.Background(), item{ID: "a"}) }()
+	for {
+		w.mu.Lock()
+		n := len(w.pending)
+		w.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-stored; err != nil {
+		t.Errorf("the pending write should succeed at Close, got %v", err)
+	}
+	if got, _ := mr.List(r.key); len(got) != 1 {
+		t.Errorf("expected the pending item written, got %v", got)
+	}
+}
@@ -3,7 +3,9 @@ package redis_processor
 import (
 	"fmt"
 	"github.com/weeb-vip/algolia-sync/internal/logger"
-	"github.com/weeb-vip/algolia-sync/internal/services/redis"
+	"github.com/weeb-vip/algolia-sync/internal/metrics"
+	"github.com/weeb-vip/algolia-sync/internal/services/queue"
+	"github.com/weeb-vip/algolia-sync/internal/tracing"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
 	"time"
@@ -14,12 +16,12 @@ type ImageProcessor interface {
 }
 
 type ImageProcessorImpl struct {
-	redisService redis.RedisService[QueuedItem]
+	queue queue.Queue[QueuedItem]
 }
 
-func NewImageProcessor(redisService redis.RedisService[QueuedItem]) ImageProcessor {
+func NewImageProcessor(q queue.Queue[QueuedItem]) ImageProcessor {
 	return &ImageProcessorImpl{
-		redisService: redisService,
+		queue: q,
 	}
 }
 
@@ -46,15 +48,21 @@ func (p *ImageProcessorImpl) Process(ctx context.Context, data Payload) error {
 		Action:    data.Action,
 		Data:      data.Data,
 		Timestamp: time.Now().Unix(),
+		Trace:     tracing.Inject(ctx),
+		EventID:   data.EventID,
+		EventTime: data.EventTime,
 	}
 
 	// Store in Redis
-	err := p.redisService.StoreData(ctx, queuedItem)
+	err := p.queue.StoreData(ctx, queuedItem)
 	if err != nil {
+		metrics.Failures.WithLabelValues(metrics.QueueStage, string(data.Action)).Inc()
 		log.Error("Failed to store data in Redis")
 		return err
 	}
 
+	metrics.ItemsQueued.WithLabelValues(string(data.Action)).Inc()
+
 	log.Info("Successfully stored data in Redis queue",
 		zap.String("action", string(data.Action)),
 		zap.String("objectId", objectID))
@@ -1,6 +1,10 @@
 package redis_processor
 
-import "encoding/json"
+import (
+	"encoding/json"
+
+	"github.com/weeb-vip/algolia-sync/internal/tracing"
+)
 
 type Action = string
 
@@ -76,6 +80,10 @@ type AlgoliaSchema struct {
 type Payload struct {
 	Action Action `json:"action"`
 	Data   Schema `json:"data"`
+	// EventID and EventTime, in unix microseconds like updated_at, are the
+	// id and time of the CloudEvent the payload arrived as, if it did.
+	EventID   string `json:"event_id,omitempty"`
+	EventTime int64  `json:"event_time,omitempty"`
 }
 
 // QueuedItem represents an item stored in Redis with metadata
@@ -83,6 +91,30 @@ type QueuedItem struct {
 	Action    Action `json:"action"`
 	Data      Schema `json:"data"`
 	Timestamp int64  `json:"timestamp"`
+	// Trace is the trace context of the message the item came from, so the
+	// sync's Algolia write joins the same trace.
+	Trace tracing.Context `json:"trace,omitempty"`
+	// EventID and EventTime are the payload's, kept to tell a redelivered
+	// event from a new one and to order events for the same anime.
+	EventID   string `json:"event_id,omitempty"`
+	EventTime int64  `json:"event_time,omitempty"`
+}
+
+// QueueKey and QueueVersion let the coalescing queue keep only the latest
+// state of each anime.
+func (q QueuedItem) QueueKey() string {
+	return q.Data.Id
+}
+
+func (q QueuedItem) QueueVersion() (updatedAt, queuedAt int64) {
+	if q.Data.UpdatedAt != nil {
+		updatedAt = *q.Data.UpdatedAt
+	} else {
+		// A CloudEvent without the row's own timestamp is ordered by when
+		// it happened.
+		updatedAt = q.EventTime
+	}
+	return updatedAt, q.Timestamp
 }
 
 // ToAlgoliaSchema converts Schema (with JSON strings) to AlgoliaSchema (with arrays)
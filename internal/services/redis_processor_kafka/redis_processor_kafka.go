@@ -6,7 +6,9 @@ import (
 	"github.com/ThatCatDev/ep/v2/event"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/weeb-vip/algolia-sync/internal/logger"
-	"github.com/weeb-vip/algolia-sync/internal/services/redis"
+	"github.com/weeb-vip/algolia-sync/internal/metrics"
+	"github.com/weeb-vip/algolia-sync/internal/services/queue"
+	"github.com/weeb-vip/algolia-sync/internal/tracing"
 	"go.uber.org/zap"
 	"time"
 )
@@ -16,12 +18,12 @@ type RedisProcessor interface {
 }
 
 type RedisProcessorImpl struct {
-	redisService redis.RedisService[QueuedItem]
+	queue queue.Queue[QueuedItem]
 }
 
-func NewRedisProcessor(redisService redis.RedisService[QueuedItem]) RedisProcessor {
+func NewRedisProcessor(q queue.Queue[QueuedItem]) RedisProcessor {
 	return &RedisProcessorImpl{
-		redisService: redisService,
+		queue: q,
 	}
 }
 
@@ -47,15 +49,21 @@ func (p *RedisProcessorImpl) Process(ctx context.Context, data event.Event[*kafk
 		Action:    payload.Action,
 		Data:      payload.Data,
 		Timestamp: time.Now().Unix(),
+		Trace:     tracing.Inject(ctx),
+		EventID:   payload.EventID,
+		EventTime: payload.EventTime,
 	}
 
 	// Store in Redis
-	err := p.redisService.StoreData(ctx, queuedItem)
+	err := p.queue.StoreData(ctx, queuedItem)
 	if err != nil {
+		metrics.Failures.WithLabelValues(metrics.QueueStage, string(payload.Action)).Inc()
 		log.Error("Failed to store data in Redis")
 		return data, err
 	}
 
+	metrics.ItemsQueued.WithLabelValues(string(payload.Action)).Inc()
+
 	log.Info("Successfully stored data in Redis queue", 
 		zap.String("action", string(payload.Action)),
 		zap.String("objectId", objectID))
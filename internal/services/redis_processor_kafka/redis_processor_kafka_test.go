@@ -9,7 +9,7 @@ import (
 	"github.com/weeb-vip/algolia-sync/internal/logger"
 )
 
-// MockRedisService implements redis.RedisService for testing
+// MockRedisService implements queue.Queue for testing
 type MockRedisService struct {
 	StoredItems []QueuedItem
 	StoreErr    error
@@ -0,0 +1,81 @@
+package schema_registry
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hamba/avro/v2"
+	"github.com/hamba/avro/v2/registry"
+	"github.com/weeb-vip/algolia-sync/config"
+)
+
+// ErrMalformed marks a message that cannot be decoded however often it is
+// tried: not in the wire format, naming a schema the registry does not have,
+// or not matching the one it names. A registry that could not be reached is
+// not one, as it may answer next time.
+var ErrMalformed = errors.New("malformed Avro message")
+
+// The Confluent wire format: a zero byte, the schema id as four big-endian
+// bytes, then the Avro binary encoding.
+const (
+	magicByte  = 0
+	headerSize = 5
+)
+
+// api matches Avro fields to Go fields by their json tags, so the types the
+// JSON path decodes into decode Avro as well, and the two encodings cannot
+// drift apart. Fields the schema has and the type does not are skipped.
+var api = avro.Config{TagKey: "json"}.Freeze()
+
+// Decoder decodes Avro messages in Confluent's wire format, looking each
+// schema up in the registry by the id the message carries. The registry
+// client keeps every schema it has fetched, so each is fetched once.
+type Decoder struct {
+	schemas *registry.Client
+}
+
+func NewDecoder(cfg config.SchemaRegistryConfig) (*Decoder, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("Avro decoding needs SCHEMA_REGISTRY_URL")
+	}
+	opts := []registry.ClientFunc{
+		registry.WithHTTPClient(&http.Client{Timeout: time.Duration(cfg.Timeout) * time.Millisecond}),
+	}
+	if cfg.Username != "" || cfg.Password != "" {
+		opts = append(opts, registry.WithBasicAuth(cfg.Username, cfg.Password))
+	}
+	client, err := registry.NewClient(cfg.URL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Decoder{schemas: client}, nil
+}
+
+// Decode decodes data into v, which is a pointer to a struct tagged as for
+// JSON.
+func (d *Decoder) Decode(ctx context.Context, data []byte, v any) error {
+	if len(data) < headerSize {
+		return fmt.Errorf("%w: %d bytes is too short", ErrMalformed, len(data))
+	}
+	if data[0] != magicByte {
+		return fmt.Errorf("%w: magic byte %#x", ErrMalformed, data[0])
+	}
+	id := int(binary.BigEndian.Uint32(data[1:headerSize]))
+
+	schema, err := d.schemas.GetSchema(ctx, id)
+	if err != nil {
+		var registryErr registry.Error
+		if errors.As(err, &registryErr) && registryErr.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%w: schema %d is not registered", ErrMalformed, id)
+		}
+		return fmt.Errorf("fetching schema %d: %w", id, err)
+	}
+	if err := api.Unmarshal(schema, data[headerSize:], v); err != nil {
+		return fmt.Errorf("%w: schema %d: %v", ErrMalformed, id, err)
+	}
+	return nil
+}
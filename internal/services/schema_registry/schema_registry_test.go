@@ -0,0 +1,184 @@
+package schema_registry
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hamba/avro/v2"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/services/debezium"
+	"github.com/weeb-vip/algolia-sync/internal/services/redis_processor"
+)
+
+const animeSchema = `{"type":"record","name":"Anime","fields":[
+	{"name":"id","type":"string"},
+	{"name":"url_slug","type":["null","string"],"default":null},
+	{"name":"title_en","type":["null","string"],"default":null},
+	{"name":"episodes","type":["null","int"],"default":null},
+	{"name":"updated_at","type":["null",{"type":"long","logicalType":"timestamp-micros"}],"default":null},
+	{"name":"licensor_count","type":"int","default":0}
+]}`
+
+var payloadSchema = `{"type":"record","name":"Payload","fields":[
+	{"name":"action","type":"string"},
+	{"name":"data","type":` + animeSchema + `}
+]}`
+
+var envelopeSchema = `{"type":"record","name":"Envelope","namespace":"anime.public.anime","fields":[
+	{"name":"before","type":["null",` + animeSchema + `],"default":null},
+	{"name":"after","type":["null","Anime"],"default":null},
+	{"name":"op","type":"string"},
+	{"name":"ts_ms","type":["null","long"],"default":null}
+]}`
+
+// fakeRegistry stands in for a Schema Registry serving schemas by id, counting
+// the lookups.
+func fakeRegistry(t *testing.T, schemas map[int]string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var lookups atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /schemas/ids/{id}", func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		for id, schema := range schemas {
+			if r.PathValue("id") == strconv.Itoa(id) {
+				_ = json.NewEncoder(w).Encode(map[string]string{"schema": schema})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error_code": 40403, "message": "Schema not found"})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &lookups
+}
+
+// wire encodes v with schema in Confluent's wire format under id.
+func wire(t *testing.T, id int, schema string, v any) []byte {
+	t.Helper()
+	body, err := avro.Marshal(avro.MustParse(schema), v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(header[1:], uint32(id))
+	return append(header, body...)
+}
+
+func newTestDecoder(t *testing.T, url string) *Decoder {
+	t.Helper()
+	decoder, err := NewDecoder(config.SchemaRegistryConfig{URL: url, Timeout: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoder
+}
+
+func anime() map[string]any {
+	return map[string]any{
+		"id":             "anime-1",
+		"url_slug":       map[string]any{"string": "platinum-end"},
+		"title_en":       map[string]any{"string": "Platinum End"},
+		"episodes":       map[string]any{"int": 24},
+		"updated_at":     nil,
+		"licensor_count": 2,
+	}
+}
+
+func TestDecodeMapsAvroOntoTheSchemaAndFetchesItOnce(t *testing.T) {
+	server, lookups := fakeRegistry(t, map[int]string{7: payloadSchema})
+	decoder := newTestDecoder(t, server.URL)
+	message := wire(t, 7, payloadSchema, map[string]any{"action": "update", "data": anime()})
+
+	for i := 0; i < 3; i++ {
+		var payload redis_processor.Payload
+		if err := decoder.Decode(context.Background(), message, &payload); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		data := payload.Data
+		if payload.Action != redis_processor.UpdateAction || data.Id != "anime-1" {
+			t.Fatalf("decoded %+v", payload)
+		}
+		if data.UrlSlug == nil || *data.UrlSlug != "platinum-end" || data.Episodes == nil || *data.Episodes != 24 {
+			t.Errorf("slug %v, episodes %v, want platinum-end and 24", data.UrlSlug, data.Episodes)
+		}
+		if data.UpdatedAt != nil {
+			t.Errorf("updated_at = %v, want it unset", *data.UpdatedAt)
+		}
+	}
+	if got := lookups.Load(); got != 1 {
+		t.Errorf("schema fetched %d times, want once", got)
+	}
+}
+
+func TestDecodeReadsDebeziumEnvelopes(t *testing.T) {
+	server, _ := fakeRegistry(t, map[int]string{3: envelopeSchema})
+	decoder := newTestDecoder(t, server.URL)
+	message := wire(t, 3, envelopeSchema, map[string]any{
+		"before": map[string]any{"anime.public.anime.Anime": anime()},
+		"after":  nil,
+		"op":     "d",
+		"ts_ms":  map[string]any{"long": int64(1700000000000)},
+	})
+
+	var envelope debezium.Envelope
+	if err := decoder.Decode(context.Background(), message, &envelope); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	payload, err := envelope.Payload()
+	if err != nil {
+		t.Fatalf("Payload: %v", err)
+	}
+	if payload.Action != redis_processor.DeleteAction || payload.Data.Id != "anime-1" {
+		t.Errorf("decoded %+v, want the delete of anime-1", payload)
+	}
+}
+
+func TestDecodeMarksWhatCanNeverBeDecoded(t *testing.T) {
+	server, _ := fakeRegistry(t, map[int]string{7: payloadSchema})
+	decoder := newTestDecoder(t, server.URL)
+	valid := wire(t, 7, payloadSchema, map[string]any{"action": "create", "data": anime()})
+
+	tests := map[string][]byte{
+		"too short":         {0, 0, 0},
+		"json":              []byte(`{"action":"create","data":{"id":"anime-1"}}`),
+		"unknown schema":    wire(t, 99, payloadSchema, map[string]any{"action": "create", "data": anime()}),
+		"truncated message": valid[:headerSize+4],
+	}
+	for name, message := range tests {
+		t.Run(name, func(t *testing.T) {
+			var payload redis_processor.Payload
+			err := decoder.Decode(context.Background(), message, &payload)
+			if !errors.Is(err, ErrMalformed) {
+				t.Errorf("Decode = %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
+
+func TestDecodeDoesNotBlameTheMessageForTheRegistry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	decoder := newTestDecoder(t, server.URL)
+
+	var payload redis_processor.Payload
+	err := decoder.Decode(context.Background(), wire(t, 7, payloadSchema, map[string]any{"action": "create", "data": anime()}), &payload)
+	if err == nil || errors.Is(err, ErrMalformed) {
+		t.Errorf("Decode = %v, want an error that is not ErrMalformed", err)
+	}
+}
+
+func TestNewDecoderNeedsARegistry(t *testing.T) {
+	if _, err := NewDecoder(config.SchemaRegistryConfig{}); err == nil {
+		t.Error("NewDecoder accepted an empty URL")
+	}
+}
@@ -0,0 +1,73 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Context is trace context in the form it is stored in: the traceparent and
+// tracestate headers, and baggage, keyed by name. A queued item carries one
+// through Redis, so the sync that indexes it continues the trace of the
+// message that produced it.
+type Context map[string]string
+
+// Inject returns the trace context of ctx, or nil when there is none, so an
+// item without a trace stores nothing extra.
+func Inject(ctx context.Context) Context {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return Context(carrier)
+}
+
+// Extract returns ctx carrying the trace in tc, as the parent of the next span
+// started from it.
+func Extract(ctx context.Context, tc Context) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(tc))
+}
+
+// KafkaHeaders reads and writes trace context in a Kafka message's headers.
+type KafkaHeaders struct {
+	Message *kafka.Message
+}
+
+func (h KafkaHeaders) Get(key string) string {
+	// The last header wins, as a producer re-injecting context appends.
+	for i := len(h.Message.Headers) - 1; i >= 0; i-- {
+		if h.Message.Headers[i].Key == key {
+			return string(h.Message.Headers[i].Value)
+		}
+	}
+	return ""
+}
+
+func (h KafkaHeaders) Set(key, value string) {
+	for i, header := range h.Message.Headers {
+		if header.Key == key {
+			h.Message.Headers[i].Value = []byte(value)
+			return
+		}
+	}
+	h.Message.Headers = append(h.Message.Headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (h KafkaHeaders) Keys() []string {
+	keys := make([]string, 0, len(h.Message.Headers))
+	for _, header := range h.Message.Headers {
+		keys = append(keys, header.Key)
+	}
+	return keys
+}
+
+// ExtractKafka returns ctx carrying the trace in msg's headers.
+func ExtractKafka(ctx context.Context, msg *kafka.Message) context.Context {
+	if msg == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, KafkaHeaders{Message: msg})
+}
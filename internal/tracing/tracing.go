@@ -0,0 +1,72 @@
+package tracing
+
+import (
+	"context"
+	"strings"
+
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Setup installs the tracer every span here comes from, exporting over
+// OTLP/HTTP to the configured collector, and returns what flushes and stops
+// it. Without an endpoint spans are not recorded, but trace context is still
+// passed along, so a trace begun upstream survives a hop through a process
+// that does not export.
+func Setup(ctx context.Context, appCfg config.AppConfig, tracingCfg config.TracingConfig) (func(ctx context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	if tracingCfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(strings.TrimSuffix(tracingCfg.Endpoint, "/")+"/v1/traces"))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			semconv.ServiceName(appCfg.APPName),
+			semconv.ServiceVersion(appCfg.Version)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK())
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// A trace begun upstream keeps the producer's decision, so one
+		// message is either traced end to end or not at all.
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(tracingCfg.SampleRatio))))
+	otel.SetTracerProvider(provider)
+	logger.FromCtx(ctx).Info("Exporting traces", zap.String("endpoint", tracingCfg.Endpoint))
+
+	return provider.Shutdown, nil
+}
+
+// Tracer is what every span here is started from.
+func Tracer() trace.Tracer {
+	return otel.Tracer("github.com/weeb-vip/algolia-sync")
+}
+
+// End ends span, marking it failed if err is set.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
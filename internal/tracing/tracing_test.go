@@ -0,0 +1,141 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/weeb-vip/algolia-sync/config"
+	"github.com/weeb-vip/algolia-sync/internal/logger"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector stands in for an OpenTelemetry collector's OTLP/HTTP receiver and
+// keeps every span it is sent.
+type collector struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req collectortrace.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	for _, resourceSpans := range req.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			c.spans = append(c.spans, scopeSpans.Spans...)
+		}
+	}
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write([]byte{})
+}
+
+func (c *collector) span(t *testing.T, name string) *tracepb.Span {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, span := range c.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("collector has no span %q", name)
+	return nil
+}
+
+func TestTraceContinuesFromKafkaHeadersThroughTheQueue(t *testing.T) {
+	received := &collector{}
+	srv := httptest.NewServer(received)
+	defer srv.Close()
+
+	ctx := logger.WithCtx(context.Background(), logger.Get())
+	shutdown, err := Setup(ctx, config.AppConfig{APPName: "algolia-sync-test"},
+		config.TracingConfig{Endpoint: srv.URL, SampleRatio: 1})
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	const upstreamTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	msg := &kafka.Message{Headers: []kafka.Header{{
+		Key:   "traceparent",
+		Value: []byte("00-" + upstreamTrace + "-00f067aa0ba902b7-01"),
+	}}}
+
+	consumeCtx, consume := Tracer().Start(ExtractKafka(ctx, msg), "kafka receive")
+	// What the consumer stores, through the encoding the queue uses.
+	stored, err := json.Marshal(struct {
+		Trace Context `json:"trace,omitempty"`
+	}{Trace: Inject(consumeCtx)})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	consume.End()
+
+	var queued struct {
+		Trace Context `json:"trace,omitempty"`
+	}
+	if err := json.Unmarshal(stored, &queued); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	_, index := Tracer().Start(Extract(ctx, queued.Trace), "algolia index")
+	End(index, nil)
+
+	if err := shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	consumeSpan := received.span(t, "kafka receive")
+	indexSpan := received.span(t, "algolia index")
+	if got := hex.EncodeToString(consumeSpan.TraceId); got != upstreamTrace {
+		t.Errorf("consumer span trace = %s, want the producer's %s", got, upstreamTrace)
+	}
+	if got := hex.EncodeToString(indexSpan.TraceId); got != upstreamTrace {
+		t.Errorf("index span trace = %s, want the producer's %s", got, upstreamTrace)
+	}
+	if hex.EncodeToString(indexSpan.ParentSpanId) != hex.EncodeToString(consumeSpan.SpanId) {
+		t.Errorf("index span parent = %x, want the consumer span %x", indexSpan.ParentSpanId, consumeSpan.SpanId)
+	}
+}
+
+func TestInjectStoresNothingWithoutATrace(t *testing.T) {
+	if _, err := Setup(context.Background(), config.AppConfig{}, config.TracingConfig{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if tc := Inject(context.Background()); tc != nil {
+		t.Errorf("Inject() = %v, want nil", tc)
+	}
+}
+
+func TestKafkaHeadersSetReplacesAnExistingHeader(t *testing.T) {
+	msg := &kafka.Message{Headers: []kafka.Header{{Key: "traceparent", Value: []byte("old")}}}
+	carrier := KafkaHeaders{Message: msg}
+	carrier.Set("traceparent", "new")
+
+	if len(msg.Headers) != 1 {
+		t.Fatalf("headers = %d, want 1", len(msg.Headers))
+	}
+	if got := carrier.Get("traceparent"); got != "new" {
+		t.Errorf("Get = %q, want %q", got, "new")
+	}
+}